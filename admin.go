@@ -0,0 +1,197 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminLocks{})
+	caddy.RegisterModule(AdminHealth{})
+}
+
+// exposed holds the storages whose locks are served by AdminLocks and
+// healthExposed those whose health is served by AdminHealth.
+var (
+	exposedMu     sync.RWMutex
+	exposed       = map[*S3]struct{}{}
+	healthExposed = map[*S3]struct{}{}
+)
+
+func (s3 *S3) exposeLocks() {
+	exposedMu.Lock()
+	defer exposedMu.Unlock()
+	exposed[s3] = struct{}{}
+}
+
+func (s3 *S3) unexposeLocks() {
+	exposedMu.Lock()
+	defer exposedMu.Unlock()
+	delete(exposed, s3)
+}
+
+func (s3 *S3) exposeHealth() {
+	exposedMu.Lock()
+	defer exposedMu.Unlock()
+	healthExposed[s3] = struct{}{}
+}
+
+func (s3 *S3) unexposeHealth() {
+	exposedMu.Lock()
+	defer exposedMu.Unlock()
+	delete(healthExposed, s3)
+}
+
+// storageID identifies s3 in the admin API by its name, or by its
+// location if it has none.
+func (s3 *S3) storageID() string {
+	if s3.Name != "" {
+		return s3.Name
+	}
+	return fmt.Sprintf("%s/%s/%s", s3.Host, s3.Bucket, strings.Trim(s3.prefix(), "/"))
+}
+
+// AdminLocks serves the lock files of the storages with ExposeLocks set
+// at /s3-storage/locks of the Caddy admin API, which applies the same
+// access controls as to all other admin endpoints.
+type AdminLocks struct{}
+
+func (AdminLocks) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.s3_storage_locks",
+		New: func() caddy.Module { return new(AdminLocks) },
+	}
+}
+
+func (al AdminLocks) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/s3-storage/locks",
+		Handler: caddy.AdminHandlerFunc(al.serveLocks),
+	}}
+}
+
+// storageLocks is the admin API representation of the locks of a storage.
+type storageLocks struct {
+	Storage string     `json:"storage"`
+	Locks   []LockInfo `json:"locks"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func (AdminLocks) serveLocks(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	exposedMu.RLock()
+	storages := make([]*S3, 0, len(exposed))
+	for s3 := range exposed {
+		storages = append(storages, s3)
+	}
+	exposedMu.RUnlock()
+
+	result := make([]storageLocks, 0, len(storages))
+	for _, s3 := range storages {
+		sl := storageLocks{Storage: s3.storageID()}
+		locks, err := s3.ListLocks(r.Context())
+		if err != nil {
+			sl.Error = err.Error()
+		}
+		sl.Locks = locks
+		result = append(result, sl)
+	}
+	slices.SortFunc(result, func(a, b storageLocks) int { return strings.Compare(a.Storage, b.Storage) })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// AdminHealth serves the result of Ping for the storages with ExposeHealth
+// set at /s3-storage/health of the Caddy admin API. It responds with 503
+// Service Unavailable if any of them is unreachable, for use as a
+// readiness probe.
+type AdminHealth struct{}
+
+func (AdminHealth) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.s3_storage_health",
+		New: func() caddy.Module { return new(AdminHealth) },
+	}
+}
+
+func (ah AdminHealth) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/s3-storage/health",
+		Handler: caddy.AdminHandlerFunc(ah.serveHealth),
+	}}
+}
+
+// storageHealth is the admin API representation of the health of a
+// storage.
+type storageHealth struct {
+	Storage string `json:"storage"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (AdminHealth) serveHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	exposedMu.RLock()
+	storages := make([]*S3, 0, len(healthExposed))
+	for s3 := range healthExposed {
+		storages = append(storages, s3)
+	}
+	exposedMu.RUnlock()
+
+	// A deep check writes and decrypts the sentinel object instead of only
+	// checking that the bucket is reachable.
+	deep, _ := strconv.ParseBool(r.URL.Query().Get("deep"))
+
+	result := make([]storageHealth, len(storages))
+	var wg sync.WaitGroup
+	for i, s3 := range storages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result[i].Storage = s3.storageID()
+			check := s3.Ping
+			if deep {
+				check = s3.HealthCheck
+			}
+			if err := check(r.Context()); err != nil {
+				result[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(result, func(a, b storageHealth) int { return strings.Compare(a.Storage, b.Storage) })
+
+	status := http.StatusOK
+	for _, sh := range result {
+		if sh.Error != "" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(result)
+}
+
+var (
+	_ caddy.AdminRouter = (*AdminLocks)(nil)
+	_ caddy.AdminRouter = (*AdminHealth)(nil)
+)
@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminLocks(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.Name = "certs"
+	s3Storage.exposeLocks()
+	defer s3Storage.unexposeLocks()
+
+	acquired := time.Now().Truncate(time.Second)
+	stale := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fake.putObject("test-bucket", "test/certificates/example.com.lock", []byte(acquired.Format(time.RFC3339)), acquired)
+	fake.putObject("test-bucket", "test/certificates/example.org.lock", []byte(stale.Format(time.RFC3339)), stale)
+	fake.putObject("test-bucket", "test/issue_cert_example.net.lock", nil, stale)
+	fake.putObject("test-bucket", "test/certificates/example.com/example.com.crt", []byte("cert"), acquired)
+
+	route := AdminLocks{}.Routes()[0]
+	if route.Pattern != "/s3-storage/locks" {
+		t.Errorf("Unexpected route pattern %s", route.Pattern)
+	}
+
+	w := httptest.NewRecorder()
+	err := route.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/s3-storage/locks", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result []storageLocks
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].Storage != "certs" {
+		t.Fatalf("Expected locks of one storage named certs, got %+v", result)
+	}
+	locks := map[string]LockInfo{}
+	for _, li := range result[0].Locks {
+		locks[li.Key] = li
+	}
+	if len(locks) != 3 {
+		t.Errorf("Expected 3 locks, got %+v", result[0].Locks)
+	}
+	if li := locks["certificates/example.com"]; !li.AcquiredAt.Equal(acquired) || li.Expired {
+		t.Errorf("Expected held lock acquired at %v, got %+v", acquired, li)
+	}
+	if li := locks["certificates/example.org"]; !li.AcquiredAt.Equal(stale) || !li.Expired {
+		t.Errorf("Expected expired lock acquired at %v, got %+v", stale, li)
+	}
+	if li := locks["issue_cert_example.net"]; !li.Invalid {
+		t.Errorf("Expected empty lock to be invalid, got %+v", li)
+	}
+
+	w = httptest.NewRecorder()
+	err = route.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/s3-storage/locks", nil))
+	if err == nil {
+		t.Error("Expected error for methods other than GET")
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	healthy := newFakeStorage(t, fake)
+	healthy.Name = "healthy"
+	healthy.exposeHealth()
+	defer healthy.unexposeHealth()
+
+	route := AdminHealth{}.Routes()[0]
+	if route.Pattern != "/s3-storage/health" {
+		t.Errorf("Unexpected route pattern %s", route.Pattern)
+	}
+	serve := func(query ...string) (int, []storageHealth) {
+		w := httptest.NewRecorder()
+		err := route.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/s3-storage/health"+strings.Join(query, ""), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []storageHealth
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, result
+	}
+
+	code, result := serve()
+	if code != http.StatusOK || len(result) != 1 || result[0].Error != "" {
+		t.Errorf("Expected healthy storage, got %d %+v", code, result)
+	}
+
+	broken := newFakeStorage(t, fake)
+	broken.Name = "broken"
+	broken.Bucket = "missing-bucket"
+	broken.exposeHealth()
+	defer broken.unexposeHealth()
+
+	code, result = serve()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with an unreachable storage, got %d", code)
+	}
+	if len(result) != 2 || result[0].Storage != "broken" || result[0].Error == "" || result[1].Error != "" {
+		t.Errorf("Expected only the broken storage to report an error, got %+v", result)
+	}
+	broken.unexposeHealth()
+
+	if fake.object("test-bucket", healthy.objName(healthKey)) != nil {
+		t.Error("Expected the shallow check not to write the sentinel")
+	}
+	code, result = serve("?deep=true")
+	if code != http.StatusOK || len(result) != 1 || result[0].Error != "" {
+		t.Errorf("Expected deep check to pass, got %d %+v", code, result)
+	}
+	if fake.object("test-bucket", healthy.objName(healthKey)) == nil {
+		t.Error("Expected the deep check to write the sentinel")
+	}
+}
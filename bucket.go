@@ -0,0 +1,161 @@
+package s3
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// bucketGuard makes sure a bucket is only created once, even if several
+// storages writing to it start at the same time.
+type bucketGuard struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+var (
+	bucketGuardsMu sync.Mutex
+	bucketGuards   = map[string]*bucketGuard{}
+)
+
+func (s3 *S3) bucketGuard() *bucketGuard {
+	bucketGuardsMu.Lock()
+	defer bucketGuardsMu.Unlock()
+
+	id := s3.Host + "/" + s3.Bucket
+	g, ok := bucketGuards[id]
+	if !ok {
+		g = &bucketGuard{}
+		bucketGuards[id] = g
+	}
+	return g
+}
+
+// ensureBucket creates the bucket if it does not exist yet. Once it is
+// known to exist, later calls return immediately. Failures are not
+// remembered, so the next call tries again.
+func (s3 *S3) ensureBucket(ctx context.Context) error {
+	g := s3.bucketGuard()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ready {
+		return nil
+	}
+
+	exists, err := s3.Client.BucketExists(ctx, s3.Bucket)
+	if err != nil {
+		return fmt.Errorf("checking bucket: %w", err)
+	}
+	if !exists {
+		s3.Logger.Info("creating bucket", zap.String("bucket", s3.Bucket))
+		err = s3.Client.MakeBucket(ctx, s3.Bucket, minio.MakeBucketOptions{Region: s3.Region})
+		// Another instance may have created the bucket after the check
+		// above. BucketAlreadyExists means it belongs to another account
+		// and is still an error.
+		if err != nil && minio.ToErrorResponse(err).Code != "BucketAlreadyOwnedByYou" {
+			return fmt.Errorf("creating bucket: %w", err)
+		}
+	}
+	g.ready = true
+	return nil
+}
+
+// ErrBucketNotFound is returned by Provision if the bucket does not exist
+// and CreateBucket is not set.
+var ErrBucketNotFound = errors.New("bucket does not exist")
+
+// checkBucket verifies that the bucket exists and is accessible with the
+// configured credentials, so that misconfigurations are reported when the
+// storage is provisioned instead of on the first Store or Load.
+func (s3 *S3) checkBucket(ctx context.Context) error {
+	exists, err := s3.Client.BucketExists(ctx, s3.Bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusForbidden {
+			return fmt.Errorf("checking access to bucket %q, set skip_bucket_check if the credentials lack s3:ListBucket: %w", s3.Bucket, err)
+		}
+		return fmt.Errorf("checking access to bucket %q: %w", s3.Bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s, create it or set create_bucket", ErrBucketNotFound, s3.Bucket)
+	}
+	return nil
+}
+
+// bucketSetupKey is the sentinel object recording the bucket setup done by
+// the instance that held its lock, so that other instances can skip it.
+const bucketSetupKey = ".bucket-setup"
+
+// setupBucket applies the bucket configuration after the bucket has been
+// created. With SerializeBucketSetup, instances starting at the same time
+// take turns holding a lock and only the first one applies a setup that
+// differs from the one recorded in the sentinel object.
+func (s3 *S3) setupBucket(ctx context.Context) error {
+	if !s3.SerializeBucketSetup || len(s3.NotificationConfigs) == 0 {
+		return s3.configureNotifications(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cmp.Or(s3.BucketSetupTimeout, caddy.Duration(defaultBucketSetupTimeout))))
+	defer cancel()
+	if err := s3.waitLock(ctx, bucketSetupKey); err != nil {
+		return fmt.Errorf("waiting for bucket setup: %w", err)
+	}
+	defer func() {
+		if err := s3.Unlock(context.WithoutCancel(ctx), bucketSetupKey); err != nil {
+			s3.Logger.Warn("releasing bucket setup lock failed", zap.Error(err))
+		}
+	}()
+
+	sum, err := json.Marshal(s3.NotificationConfigs)
+	if err != nil {
+		return err
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(sum))
+
+	name := s3.objName(bucketSetupKey)
+	obj, err := s3.Client.GetObject(ctx, s3.Bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("reading bucket setup: %w", err)
+	}
+	done, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("reading bucket setup: %w", err)
+	}
+	if string(done) == digest {
+		s3.Logger.Debug("bucket setup already done by another instance")
+		return nil
+	}
+
+	if err := s3.configureNotifications(ctx); err != nil {
+		return err
+	}
+	_, err = s3.Client.PutObject(ctx, s3.Bucket, name, strings.NewReader(digest), int64(len(digest)), minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("recording bucket setup: %w", err)
+	}
+	return nil
+}
+
+// lazyCreateBucket ensures the bucket exists before a write if
+// CreateBucket is "lazy".
+func (s3 *S3) lazyCreateBucket(ctx context.Context) error {
+	if s3.CreateBucket != "lazy" {
+		return nil
+	}
+	if err := s3.ensureBucket(ctx); err != nil {
+		return err
+	}
+	return s3.configureNotifications(ctx)
+}
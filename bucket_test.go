@@ -0,0 +1,247 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestLazyCreateBucket(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t)
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.CreateBucket = "lazy"
+
+	var creates atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.Trim(r.URL.Path, "/") == "test-bucket" {
+			creates.Add(1)
+		}
+		return false
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s3Storage.Store(ctx, fmt.Sprintf("key-%d", i), []byte("test-data"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := creates.Load(); got != 1 {
+		t.Errorf("Expected bucket to be created once, got %d", got)
+	}
+	if keys := fake.keys("test-bucket"); len(keys) != 20 {
+		t.Errorf("Expected 20 objects, got %d", len(keys))
+	}
+}
+
+// TestEnsureBucketRace covers another instance creating the bucket between
+// the existence check and MakeBucket.
+func TestEnsureBucketRace(t *testing.T) {
+	for code, ok := range map[string]bool{
+		"BucketAlreadyOwnedByYou": true,
+		"BucketAlreadyExists":     false,
+	} {
+		fake := newFakeS3(t)
+		s3Storage := newFakeStorage(t, fake)
+		fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if strings.Trim(r.URL.Path, "/") != "test-bucket" {
+				return false
+			}
+			switch r.Method {
+			case http.MethodHead:
+				writeFakeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			case http.MethodPut:
+				writeFakeError(w, http.StatusConflict, code, "The requested bucket name is not available")
+			default:
+				return false
+			}
+			return true
+		})
+
+		err := s3Storage.ensureBucket(t.Context())
+		if ok && err != nil {
+			t.Errorf("%s: expected bucket created by another instance to be accepted, got %v", code, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: expected error for a bucket owned by another account", code)
+		}
+	}
+}
+
+func TestNotificationConfig(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	s3Storage := &S3{
+		Host:          fake.host(),
+		Bucket:        "test-bucket",
+		AccessKey:     "test",
+		SecretKey:     "test",
+		Prefix:        "test",
+		InsecureHosts: []string{"127.0.0.1"},
+		CreateBucket:  "provision",
+		NotificationConfigs: []NotificationConfig{
+			{Arn: "arn:aws:sqs:us-east-1:123456789012:cert-changes"},
+			{Arn: "arn:aws:sns:us-east-1:123456789012:cert-removals", Events: []string{"s3:ObjectRemoved:*"}},
+		},
+	}
+	err := s3Storage.Provision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := fake.notification("test-bucket")
+	for _, want := range []string{
+		"<Queue>arn:aws:sqs:us-east-1:123456789012:cert-changes</Queue>",
+		"<Topic>arn:aws:sns:us-east-1:123456789012:cert-removals</Topic>",
+		"<Event>s3:ObjectCreated:*</Event>",
+		"<Event>s3:ObjectRemoved:*</Event>",
+		"<Name>prefix</Name><Value>test/</Value>",
+	} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("Expected notification configuration to contain %s, got %s", want, cfg)
+		}
+	}
+}
+
+func TestNotificationConfigRequiresCreateBucket(t *testing.T) {
+	s3Storage := &S3{
+		NotificationConfigs: []NotificationConfig{{Arn: "arn:aws:sqs:us-east-1:123456789012:cert-changes"}},
+	}
+	if err := s3Storage.validateNotifications(); err == nil {
+		t.Error("Expected error for notification_config without create_bucket")
+	}
+
+	s3Storage.CreateBucket = "lazy"
+	if err := s3Storage.validateNotifications(); err != nil {
+		t.Error(err)
+	}
+
+	s3Storage.NotificationConfigs[0].Arn = "arn:aws:s3:::bucket"
+	if err := s3Storage.validateNotifications(); err == nil {
+		t.Error("Expected error for unsupported notification service")
+	}
+}
+
+func TestProvisionChecksBucket(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	newStorage := func(config string) *S3 {
+		d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+			host %s
+			bucket test-bucket
+			access_key test
+			secret_key test
+			insecure true
+			%s
+		}`, fake.host(), config))
+		s3Storage := new(S3)
+		if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		return s3Storage
+	}
+
+	err := newStorage("").Provision(ctx)
+	if !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected missing bucket error, got %v", err)
+	}
+	if err := newStorage("skip_bucket_check true").Provision(ctx); err != nil {
+		t.Errorf("Expected bucket check to be skipped, got %v", err)
+	}
+	if err := newStorage("create_bucket true").Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := newStorage("").Provision(ctx); err != nil {
+		t.Errorf("Expected created bucket to pass the check, got %v", err)
+	}
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return true
+		}
+		return false
+	})
+	err = newStorage("").Provision(ctx)
+	if err == nil || !strings.Contains(err.Error(), "skip_bucket_check") {
+		t.Errorf("Expected access denied error to suggest skip_bucket_check, got %v", err)
+	}
+}
+
+func TestSerializeBucketSetup(t *testing.T) {
+	defer func(timeout, poll time.Duration) { LockTimeout, LockPollInterval = timeout, poll }(LockTimeout, LockPollInterval)
+	LockPollInterval = 10 * time.Millisecond
+
+	fake := newFakeS3(t)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	var setups atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && r.URL.Query().Has("notification") {
+			setups.Add(1)
+		}
+		return false
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s3Storage := &S3{
+				Host:                 fake.host(),
+				Bucket:               "test-bucket",
+				AccessKey:            "test",
+				SecretKey:            "test",
+				Prefix:               "test",
+				InsecureHosts:        []string{"127.0.0.1"},
+				CreateBucket:         "provision",
+				SerializeBucketSetup: true,
+				NotificationConfigs: []NotificationConfig{
+					{Arn: "arn:aws:sqs:us-east-1:123456789012:cert-changes"},
+				},
+			}
+			errs <- s3Storage.Provision(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := setups.Load(); got != 1 {
+		t.Errorf("Expected bucket to be set up once, got %d", got)
+	}
+	if keys := fake.keys("test-bucket"); !slices.Equal(keys, []string{"test/" + bucketSetupKey}) {
+		t.Errorf("Expected only the setup sentinel to remain, got %v", keys)
+	}
+}
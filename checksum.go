@@ -0,0 +1,42 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// checksumSuffix is appended to the object name of a value to form the name
+// of its checksum sidecar.
+const checksumSuffix = ".sha256"
+
+func (s3 *S3) objChecksumName(key string) string {
+	return s3.objName(key) + checksumSuffix
+}
+
+// isChecksumName reports whether name refers to a checksum sidecar, which
+// only exist if WriteChecksumSidecar is set.
+func (s3 *S3) isChecksumName(name string) bool {
+	return s3.WriteChecksumSidecar && strings.HasSuffix(name, checksumSuffix)
+}
+
+// writeChecksum stores the hex encoded SHA-256 digest of the plaintext
+// value of key next to it.
+func (s3 *S3) writeChecksum(ctx context.Context, key string, value []byte) error {
+	sum := sha256.Sum256(value)
+	digest := []byte(hex.EncodeToString(sum[:]))
+	_, err := s3.Client.PutObject(ctx, s3.Bucket, s3.objChecksumName(key), bytes.NewReader(digest), int64(len(digest)), minio.PutObjectOptions{
+		ContentType:          "text/plain",
+		ServerSideEncryption: s3.serverSideEncryption(),
+	})
+	return err
+}
+
+// removeChecksum removes the checksum sidecar of key.
+func (s3 *S3) removeChecksum(ctx context.Context, key string) error {
+	return s3.Client.RemoveObject(ctx, s3.Bucket, s3.objChecksumName(key), minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestWriteChecksumSidecar(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	s3Storage.iowrap = sb
+	s3Storage.WriteChecksumSidecar = true
+
+	testKey := "certificates/acme/example.com/example.com.crt"
+	value := []byte("certificate data")
+	if err := s3Storage.Store(ctx, testKey, value); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := fake.object("test-bucket", s3Storage.objName(testKey)+".sha256")
+	if sidecar == nil {
+		t.Fatalf("Expected checksum sidecar, have %v", fake.keys("test-bucket"))
+	}
+	sum := sha256.Sum256(value)
+	if string(sidecar.data) != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected checksum of the plaintext value, got %s", sidecar.data)
+	}
+
+	keys, err := s3Storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{testKey}) {
+		t.Errorf("Expected sidecars to be excluded from listing, got %v", keys)
+	}
+
+	if err := s3Storage.Store(ctx, testKey+".sha256", []byte("forged")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected storing a checksum name to be rejected, got %v", err)
+	}
+
+	if err := s3Storage.Delete(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.keys("test-bucket"); len(keys) != 0 {
+		t.Errorf("Expected value and sidecar to be removed, have %v", keys)
+	}
+}
@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// CredentialCheckInterval is the interval at which the remaining validity
+// of the credentials is checked if CredentialExpiryWarn is set.
+var CredentialCheckInterval = 1 * time.Minute
+
+// watchCredentials checks the credentials right away and then every
+// CredentialCheckInterval until Cleanup is called.
+func (s3 *S3) watchCredentials() {
+	s3.credStop = make(chan struct{})
+	s3.checkCredentials()
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(CredentialCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s3.checkCredentials()
+			}
+		}
+	}(s3.credStop)
+}
+
+// stopCredentials ends the background check started by watchCredentials.
+func (s3 *S3) stopCredentials() {
+	if s3.credStop != nil {
+		close(s3.credStop)
+		s3.credStop = nil
+	}
+}
+
+// checkCredentials logs the remaining validity of the credentials of all
+// clients and warns if they expire within CredentialExpiryWarn.
+func (s3 *S3) checkCredentials() {
+	s3.checkClientCredentials("storage", s3.Client)
+	if s3.lockCli != nil {
+		s3.checkClientCredentials("lock", s3.lockCli)
+	}
+	if s3.fallbackCli != nil {
+		s3.checkClientCredentials("fallback", s3.fallbackCli)
+	}
+}
+
+func (s3 *S3) checkClientCredentials(name string, cli *minio.Client) {
+	v, err := cli.GetCreds()
+	if err != nil {
+		s3.Logger.Warn("retrieving credentials failed", zap.String("client", name), zap.Error(err))
+		return
+	}
+	if v.Expiration.IsZero() {
+		s3.Logger.Debug("credentials do not expire", zap.String("client", name))
+		return
+	}
+
+	remaining := time.Until(v.Expiration)
+	s3.Logger.Debug("credential validity",
+		zap.String("client", name),
+		zap.Time("expires_at", v.Expiration),
+		zap.Duration("remaining", remaining),
+	)
+	if remaining < time.Duration(s3.CredentialExpiryWarn) {
+		s3.Logger.Warn("credentials expire soon",
+			zap.String("client", name),
+			zap.Time("expires_at", v.Expiration),
+			zap.Duration("remaining", remaining),
+		)
+	}
+}
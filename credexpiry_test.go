@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// expiringProvider returns temporary credentials expiring at expiration.
+type expiringProvider struct {
+	expiration time.Time
+}
+
+func (p *expiringProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithCredContext(nil)
+}
+
+func (p *expiringProvider) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	return credentials.Value{
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		SessionToken:    "token",
+		Expiration:      p.expiration,
+	}, nil
+}
+
+func (p *expiringProvider) IsExpired() bool {
+	return time.Now().After(p.expiration)
+}
+
+func newExpiringClient(t *testing.T, expiration time.Time) *minio.Client {
+	client, err := minio.New("127.0.0.1:9000", &minio.Options{
+		Creds: credentials.New(&expiringProvider{expiration: expiration}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCredentialExpiryWarn(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Time
+		warns      bool
+	}{
+		{name: "imminent", expiration: time.Now().Add(2 * time.Minute), warns: true},
+		{name: "distant", expiration: time.Now().Add(time.Hour), warns: false},
+		{name: "none", warns: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			s3Storage := &S3{
+				Logger:               zap.New(core),
+				Client:               newExpiringClient(t, tt.expiration),
+				CredentialExpiryWarn: caddy.Duration(10 * time.Minute),
+			}
+			s3Storage.checkCredentials()
+
+			if warned := logs.FilterMessage("credentials expire soon").Len() > 0; warned != tt.warns {
+				t.Errorf("Expected warning %v, got %v", tt.warns, warned)
+			}
+			if logs.FilterLevelExact(zapcore.DebugLevel).Len() == 0 {
+				t.Error("Expected credential validity to be logged at debug level")
+			}
+		})
+	}
+}
+
+func TestCredentialExpiryFallback(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	s3Storage := &S3{
+		Logger:               zap.New(core),
+		Client:               newExpiringClient(t, time.Now().Add(time.Hour)),
+		fallbackCli:          newExpiringClient(t, time.Now().Add(2*time.Minute)),
+		CredentialExpiryWarn: caddy.Duration(10 * time.Minute),
+	}
+	s3Storage.checkCredentials()
+
+	warnings := logs.FilterMessage("credentials expire soon").All()
+	if len(warnings) != 1 || warnings[0].ContextMap()["client"] != "fallback" {
+		t.Errorf("Expected a warning for the fallback client, got %v", warnings)
+	}
+}
+
+func TestWatchCredentials(t *testing.T) {
+	defer func(interval time.Duration) { CredentialCheckInterval = interval }(CredentialCheckInterval)
+	CredentialCheckInterval = 10 * time.Millisecond
+
+	core, logs := observer.New(zap.WarnLevel)
+	s3Storage := &S3{
+		Logger:               zap.New(core),
+		Client:               newExpiringClient(t, time.Now().Add(time.Minute)),
+		CredentialExpiryWarn: caddy.Duration(10 * time.Minute),
+	}
+	s3Storage.watchCredentials()
+
+	deadline := time.Now().Add(time.Second)
+	for logs.FilterMessage("credentials expire soon").Len() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s3Storage.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logs.FilterMessage("credentials expire soon").Len(); n < 3 {
+		t.Errorf("Expected repeated warnings from the background check, got %d", n)
+	}
+}
@@ -0,0 +1,59 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ContextKey is the type of the context keys whose values are sent along
+// with every S3 request as configured in ContextHeaders, e.g.
+//
+//	ctx = context.WithValue(ctx, s3.ContextKey("request_id"), id)
+type ContextKey string
+
+// validateContextHeaders rejects header names that are invalid or would
+// interfere with request signing.
+func (s3 *S3) validateContextHeaders() error {
+	for key, name := range s3.ContextHeaders {
+		lower := strings.ToLower(name)
+		if name == "" || strings.ContainsFunc(name, func(r rune) bool { return !isTokenChar(r) }) {
+			return fmt.Errorf("invalid header name %q for context key %q", name, key)
+		}
+		// S3 requires every x-amz- header to be signed, which is not
+		// possible for headers added after minio signed the request.
+		if strings.HasPrefix(lower, "x-amz-") || lower == "authorization" || lower == "host" {
+			return fmt.Errorf("header %q for context key %q is reserved", name, key)
+		}
+	}
+	return nil
+}
+
+// isTokenChar reports whether r may appear in an HTTP header name.
+func isTokenChar(r rune) bool {
+	return r < 0x7f && (r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+}
+
+// contextHeaderTransport sets request headers from the context values
+// named in headers, which maps context keys to header names.
+type contextHeaderTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *contextHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	cloned := false
+	for key, name := range t.headers {
+		v, ok := r.Context().Value(ContextKey(key)).(string)
+		if !ok || v == "" {
+			continue
+		}
+		// A RoundTripper must not modify the request it was given.
+		if !cloned {
+			r = r.Clone(r.Context())
+			cloned = true
+		}
+		r.Header.Set(name, v)
+	}
+	return t.base.RoundTrip(r)
+}
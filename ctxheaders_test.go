@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestContextHeaders(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	caddyCtx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := map[string]http.Header{}
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		seen[r.Method] = r.Header.Clone()
+		mu.Unlock()
+		return false
+	})
+
+	s3Storage := &S3{
+		Host:          fake.host(),
+		Bucket:        "test-bucket",
+		AccessKey:     "test",
+		SecretKey:     "test",
+		InsecureHosts: []string{"127.0.0.1"},
+		ContextHeaders: map[string]string{
+			"request_id": "X-Request-Id",
+			"tenant":     "X-Tenant",
+		},
+	}
+	if err := s3Storage.Provision(caddyCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(t.Context(), ContextKey("request_id"), "req-123")
+	ctx = context.WithValue(ctx, ContextKey("tenant"), "acme")
+	if err := s3Storage.Store(ctx, "test-key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(context.WithValue(t.Context(), ContextKey("request_id"), "req-456"), "test-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if h := seen[http.MethodPut]; h.Get("X-Request-Id") != "req-123" || h.Get("X-Tenant") != "acme" {
+		t.Errorf("Expected context headers on store, got %v", h)
+	}
+	if h := seen[http.MethodGet]; h.Get("X-Request-Id") != "req-456" || h.Get("X-Tenant") != "" {
+		t.Errorf("Expected only the request ID on load, got %v", h)
+	}
+
+	for _, name := range []string{"X-Amz-Meta-Request", "Authorization", "Bad Header", ""} {
+		s3Storage := &S3{ContextHeaders: map[string]string{"request_id": name}}
+		if err := s3Storage.validateContextHeaders(); err == nil {
+			t.Errorf("Expected header %q to be rejected", name)
+		}
+	}
+}
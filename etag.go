@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrChecksumMismatch is returned by Load if VerifyETag is set and the
+// downloaded bytes do not match the ETag of the object.
+var ErrChecksumMismatch = errors.New("object checksum mismatch")
+
+// verifyETag compares the MD5 of data with the ETag of oi if the ETag is
+// known to be the MD5 of the object content.
+func verifyETag(oi minio.ObjectInfo, data []byte) error {
+	etag := strings.Trim(oi.ETag, `"`)
+	if len(etag) != md5.Size*2 || strings.Contains(etag, "-") {
+		// Multipart uploads have ETags of the form <md5 of md5s>-<parts>.
+		return nil
+	}
+	switch oi.Metadata.Get("X-Amz-Server-Side-Encryption") {
+	case "aws:kms", "aws:kms:dsse":
+		return nil
+	}
+	if oi.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return nil
+	}
+
+	sum := md5.Sum(data)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(etag) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
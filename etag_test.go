@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyETag(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.VerifyETag = true
+
+	testKey := "certificates/example.com/example.com.crt"
+	err := s3Storage.Store(ctx, testKey, []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatalf("Expected intact object to verify, got %v", err)
+	}
+	if string(data) != "test-data" {
+		t.Errorf("Expected test-data, got %s", data)
+	}
+
+	obj := fake.object("test-bucket", s3Storage.objName(testKey))
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, testKey) {
+			return false
+		}
+		// Serve the original ETag with bytes corrupted in transit.
+		corrupted := []byte("test-dat4")
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(corrupted)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(corrupted)
+		return true
+	})
+
+	_, err = s3Storage.Load(ctx, testKey)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch for corrupted object, got %v", err)
+	}
+
+	s3Storage.VerifyETag = false
+	data, err = s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test-dat4" {
+		t.Errorf("Expected unverified load to return the corrupted bytes, got %s", data)
+	}
+}
@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// queueSuffix is appended to the lock file name to form the prefix below
+// which contenders for a fair lock place their tokens.
+const queueSuffix = ".queue/"
+
+func (s3 *S3) objQueueName(key string) string {
+	return s3.objLockName(key) + queueSuffix
+}
+
+// isQueueName reports whether an object name is a fair locking token.
+func isQueueName(name string) bool {
+	return strings.Contains(name, ".lock"+queueSuffix)
+}
+
+// fairLock acquires the lock on key in FIFO order. The contender adds a
+// token named after its arrival time to the queue of the lock and only
+// tries to acquire the lock once its token is the oldest one. Tokens older
+// than LockExpiration are considered abandoned by crashed contenders and
+// skipped, so a waiting contender refreshes its own token while it waits.
+// Waiting fails once LockTimeout has passed.
+func (s3 *S3) fairLock(ctx context.Context, key string) error {
+	startedAt := time.Now()
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	token := s3.objQueueName(key) + fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(nonce))
+
+	if err := s3.putQueueToken(ctx, key, token); err != nil {
+		return err
+	}
+	refreshedAt := time.Now()
+	defer func() {
+		err := s3.lockClient().RemoveObject(context.WithoutCancel(ctx), s3.Bucket, token, minio.RemoveObjectOptions{})
+		if err != nil {
+			s3.Logger.Warn("removing lock queue token failed", s3.logKey(s3.objName(key)), zap.Error(err))
+		}
+	}()
+
+	for {
+		head, err := s3.queueHead(ctx, key, token)
+		if err != nil {
+			return err
+		}
+		if head == token {
+			err = s3.acquireLock(ctx, key)
+			if !errors.Is(err, errLockHeld) {
+				return err
+			}
+		} else {
+			err = errLockHeld
+		}
+		if time.Since(startedAt) >= s3.lockTimeout() {
+			holder := s3.describeLock(ctx, key)
+			s3.Logger.Warn("timeout while acquiring lock",
+				s3.logKey(s3.objLockName(key)),
+				zap.String("holder", holder),
+			)
+			return fmt.Errorf("timeout while acquiring lock, %s: %w", holder, err)
+		}
+		if time.Since(refreshedAt) >= s3.lockExpiration()/2 {
+			if err := s3.putQueueToken(ctx, key, token); err != nil {
+				return err
+			}
+			refreshedAt = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s3.lockPollInterval()):
+		}
+	}
+}
+
+// putQueueToken writes the queue token for the lock on key like the lock
+// file itself, refreshing its modification time if it exists already.
+func (s3 *S3) putQueueToken(ctx context.Context, key, token string) error {
+	_, err := s3.lockClient().PutObject(ctx, s3.Bucket, token, bytes.NewReader(nil), 0, s3.putOptions(key+".lock"))
+	if err != nil {
+		return fmt.Errorf("queueing for lock: %w", err)
+	}
+	return nil
+}
+
+// queueHead returns the oldest live token in the queue of key. The token
+// own of the caller always counts as live.
+func (s3 *S3) queueHead(ctx context.Context, key, own string) (string, error) {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	var head string
+	for obj := range s3.lockClient().ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+		Prefix: s3.objQueueName(key),
+	}) {
+		if obj.Err != nil {
+			return "", fmt.Errorf("listing lock queue: %w", obj.Err)
+		}
+		if obj.Key != own && time.Since(obj.LastModified) > s3.lockExpiration() {
+			continue
+		}
+		if head == "" || obj.Key < head {
+			head = obj.Key
+		}
+	}
+	return head, nil
+}
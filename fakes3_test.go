@@ -0,0 +1,489 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+// fakeS3 is a minimal in-memory S3 endpoint for tests that need to
+// inject latency or failures. It implements just enough of the API for
+// the calls made by this package.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	// notifications holds the notification configuration XML per bucket.
+	notifications map[string][]byte
+
+	// intercept is called before a request is served. If it returns
+	// true, it has written the response itself.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+	// pageSize limits the number of keys per listing page if set.
+	pageSize int
+	// region is reported as the bucket location if set. Requests other than
+	// the location lookup must then be signed for it.
+	region string
+
+	srv *httptest.Server
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+	header   http.Header
+}
+
+func newFakeS3(t *testing.T, buckets ...string) *fakeS3 {
+	f := &fakeS3{buckets: map[string]map[string]*fakeObject{}, notifications: map[string][]byte{}}
+	for _, b := range buckets {
+		f.buckets[b] = map[string]*fakeObject{}
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeS3) host() string {
+	u, _ := url.Parse(f.srv.URL)
+	return u.Host
+}
+
+func (f *fakeS3) setIntercept(fn func(w http.ResponseWriter, r *http.Request) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.intercept = fn
+}
+
+// object returns a copy of the stored object or nil.
+func (f *fakeS3) object(bucket, name string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.buckets[bucket][name]
+	if !ok {
+		return nil
+	}
+	cp := *obj
+	return &cp
+}
+
+func (f *fakeS3) putObject(bucket, name string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buckets[bucket][name] = &fakeObject{data: data, modified: modified, header: http.Header{}}
+}
+
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	intercept := f.intercept
+	f.mu.Unlock()
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+
+	if f.region != "" && !q.Has("location") {
+		_, scope, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+		if parts := strings.Split(scope, "/"); len(parts) < 3 || parts[2] != f.region {
+			writeFakeError(w, http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed; the region is wrong; expecting '"+f.region+"'")
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if name == "" {
+		f.serveBucket(w, r, bucket, q)
+		return
+	}
+
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+
+	if q.Has("tagging") {
+		f.serveTagging(w, r, objects, name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			f.copyObject(w, src, objects, name)
+			return
+		}
+		data, err := readFakeBody(r)
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && objects[name] != nil {
+			writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (objects[name] == nil || objects[name].etag() != m) {
+			writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		obj := &fakeObject{data: data, modified: time.Now(), header: http.Header{}}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") || strings.HasPrefix(k, "X-Amz-Server-Side-Encryption") || k == "Content-Type" || k == "Content-Encoding" || k == "X-Amz-Tagging" || k == "X-Amz-Storage-Class" {
+				obj.header[k] = v
+			}
+		}
+		objects[name] = obj
+		w.Header().Set("ETag", obj.etag())
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[name]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		for k, v := range obj.header {
+			if k != "X-Amz-Tagging" {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+	objects, ok := f.buckets[bucket]
+	switch {
+	case r.Method == http.MethodPut && !q.Has("notification"):
+		if ok {
+			writeFakeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+			return
+		}
+		f.buckets[bucket] = map[string]*fakeObject{}
+		w.WriteHeader(http.StatusOK)
+	case !ok:
+		writeFakeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case q.Has("location"):
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</LocationConstraint>`, f.region)
+	case q.Has("notification"):
+		f.serveNotification(w, r, bucket)
+	case q.Get("list-type") == "2":
+		f.listObjects(w, bucket, objects, q)
+	case r.Method == http.MethodPost && q.Has("delete"):
+		f.deleteObjects(w, r, objects)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+func (f *fakeS3) serveNotification(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg, ok := f.notifications[bucket]
+		if !ok {
+			cfg = []byte(`<NotificationConfiguration></NotificationConfiguration>`)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(cfg)
+	case http.MethodPut:
+		data, err := readFakeBody(r)
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		f.notifications[bucket] = data
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// notification returns the notification configuration of bucket.
+func (f *fakeS3) notification(bucket string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.notifications[bucket])
+}
+
+type fakeTagging struct {
+	XMLName xml.Name  `xml:"Tagging"`
+	Tags    []fakeTag `xml:"TagSet>Tag"`
+}
+
+type fakeTag struct {
+	Key   string
+	Value string
+}
+
+func (f *fakeS3) serveTagging(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, name string) {
+	obj, ok := objects[name]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var res fakeTagging
+		values, _ := url.ParseQuery(obj.header.Get("X-Amz-Tagging"))
+		for k := range values {
+			res.Tags = append(res.Tags, fakeTag{Key: k, Value: values.Get(k)})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(res)
+	case http.MethodPut:
+		var req fakeTagging
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		values := url.Values{}
+		for _, tag := range req.Tags {
+			values.Set(tag.Key, tag.Value)
+		}
+		obj.header.Set("X-Amz-Tagging", values.Encode())
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+type fakeDelete struct {
+	Objects []fakeDeleted `xml:"Object"`
+}
+
+type fakeDeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []fakeDeleted
+}
+
+type fakeDeleted struct {
+	Key string
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject) {
+	var req fakeDelete
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var res fakeDeleteResult
+	for _, obj := range req.Objects {
+		delete(objects, obj.Key)
+		res.Deleted = append(res.Deleted, obj)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeListEntry
+	CommonPrefixes        []fakeListPrefix
+}
+
+type fakeListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type fakeListPrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) listObjects(w http.ResponseWriter, bucket string, objects map[string]*fakeObject, q url.Values) {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	after := q.Get("continuation-token")
+	if after == "" {
+		after = q.Get("start-after")
+	}
+	maxKeys := 1000
+	if mk, err := strconv.Atoi(q.Get("max-keys")); err == nil && mk > 0 {
+		maxKeys = mk
+	}
+	if f.pageSize > 0 {
+		maxKeys = min(maxKeys, f.pageSize)
+	}
+
+	var names []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	res := fakeListResult{Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	seen := map[string]bool{}
+	for _, k := range names {
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp := k[:len(prefix)+i+len(delimiter)]
+				if !seen[cp] {
+					seen[cp] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, fakeListPrefix{cp})
+					res.KeyCount++
+				}
+				res.NextContinuationToken = k
+				continue
+			}
+		}
+		obj := objects[k]
+		res.Contents = append(res.Contents, fakeListEntry{
+			Key:          k,
+			LastModified: obj.modified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.etag(),
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+		res.KeyCount++
+		res.NextContinuationToken = k
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+// copyObject serves a server-side copy of src, given as "bucket/name".
+func (f *fakeS3) copyObject(w http.ResponseWriter, src string, objects map[string]*fakeObject, name string) {
+	src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"))
+	srcBucket, srcName, _ := strings.Cut(src, "/")
+	orig, ok := f.buckets[srcBucket][srcName]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	obj := &fakeObject{data: bytes.Clone(orig.data), modified: time.Now(), header: orig.header.Clone()}
+	objects[name] = obj
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>`,
+		obj.etag(), obj.modified.UTC().Format("2006-01-02T15:04:05.000Z"))
+}
+
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readFakeBody reads a request body, decoding the aws-chunked framing
+// minio uses for streaming signatures over plain HTTP.
+func readFakeBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return body, err
+	}
+
+	var out []byte
+	for len(body) > 0 {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return nil, fmt.Errorf("malformed chunk header")
+		}
+		size, _, _ := strings.Cut(string(body[:i]), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		body = body[i+2:]
+		if n == 0 {
+			break
+		}
+		if int64(len(body)) < n+2 {
+			return nil, fmt.Errorf("short chunk")
+		}
+		out = append(out, body[:n]...)
+		body = body[n+2:]
+	}
+	return out, nil
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, msg)
+}
+
+// newFakeStorage returns an S3 storage talking to f over plain HTTP.
+func newFakeStorage(t *testing.T, f *fakeS3) *S3 {
+	client, err := minio.New(f.host(), &minio.Options{
+		Creds:  credentials.NewStaticV4("test", "test", ""),
+		Secure: false,
+		// Leave retries to the storage under test.
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &S3{
+		Logger: zap.NewNop(),
+		Client: client,
+		Host:   f.host(),
+		Bucket: "test-bucket",
+		Prefix: "test",
+		iowrap: &CleartextIO{},
+	}
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+// healthKey is the sentinel object used by HealthCheck. It is kept in the
+// bucket so that later checks can detect a changed encryption key.
+const healthKey = ".health-check"
+
+var healthPayload = []byte("certmagic-s3 health check")
+
+// ErrUnavailable is returned by HealthCheck if the bucket cannot be read
+// from or written to.
+var ErrUnavailable = errors.New("storage unavailable")
+
+// HealthCheck verifies that the storage is usable end to end. It first
+// checks that an existing sentinel object still decrypts with the current
+// configuration, then writes, reads back and decrypts a fresh one. Errors
+// wrap ErrUnavailable or, if the sentinel object cannot be decrypted with
+// the configured encryption key, ErrDecryptionFailed. With ReadOnly, only
+// the existing sentinel object is checked.
+func (s3 *S3) HealthCheck(ctx context.Context) error {
+	err := s3.verifySentinel(ctx)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s3.ReadOnly {
+		return nil
+	}
+
+	if err := s3.writeSentinel(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return s3.verifySentinel(ctx)
+}
+
+// writeSentinel writes the sentinel object directly, bypassing the
+// checksums, mirrors and quota of Store.
+func (s3 *S3) writeSentinel(ctx context.Context) error {
+	ctx, cancel := s3.writeContext(ctx)
+	defer cancel()
+
+	body, err := io.ReadAll(s3.iowrap.ByteReader(healthPayload))
+	if err != nil {
+		return err
+	}
+	_, err = s3.Client.PutObject(ctx, s3.Bucket, s3.objName(healthKey), bytes.NewReader(body), int64(len(body)), s3.putOptions(healthKey))
+	return err
+}
+
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// Ping checks that the bucket is reachable and exists with a single
+// request, giving up after HealthCheckTimeout. Unlike HealthCheck it does
+// not write to the bucket, so it is cheap enough for readiness probes.
+func (s3 *S3) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cmp.Or(s3.HealthCheckTimeout, caddy.Duration(defaultHealthCheckTimeout))))
+	defer cancel()
+
+	if err := s3.checkBucket(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return nil
+}
+
+func (s3 *S3) verifySentinel(ctx context.Context) error {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	obj, err := s3.Client.GetObject(ctx, s3.Bucket, s3.objName(healthKey), minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer obj.Close()
+
+	raw, err := io.ReadAll(obj)
+	if err != nil {
+		if s3.notExist(err) {
+			return fs.ErrNotExist
+		}
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	buf, err := io.ReadAll(s3.iowrap.WrapReader(bytes.NewReader(raw)))
+	if errors.Is(err, ErrDecryptionFailed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	if !bytes.Equal(buf, healthPayload) {
+		return fmt.Errorf("%w: unexpected sentinel content", ErrDecryptionFailed)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+
+	newEncrypted := func(key string) *S3 {
+		s3Storage := newFakeStorage(t, fake)
+		sb := &SecretBoxIO{}
+		copy(sb.SecretKey[:], key)
+		s3Storage.iowrap = sb
+		return s3Storage
+	}
+
+	good := newEncrypted("12345678123456781234567812345678")
+	err := good.HealthCheck(ctx)
+	if err != nil {
+		t.Fatalf("Expected health check to pass, got %v", err)
+	}
+
+	// The sentinel must not show up as certmagic data.
+	keys, err := good.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Expected sentinel to be hidden from listing, got %v", keys)
+	}
+
+	mismatched := newEncrypted("87654321876543218765432187654321")
+	err = mismatched.HealthCheck(ctx)
+	if !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected decryption error for mismatched key, got %v", err)
+	}
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		return true
+	})
+	err = good.HealthCheck(ctx)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected unavailable error, got %v", err)
+	}
+}
+
+func TestHealthCheckWritesDirectly(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.WriteChecksumSidecar = true
+	s3Storage.ReadOnlyPrefixes = []string{"/test"}
+
+	if err := s3Storage.HealthCheck(t.Context()); err != nil {
+		t.Fatalf("Expected health check to pass below a read-only prefix, got %v", err)
+	}
+	if keys := fake.keys("test-bucket"); len(keys) != 1 || keys[0] != s3Storage.objName(healthKey) {
+		t.Errorf("Expected only the sentinel to be written, got %v", keys)
+	}
+}
+
+func TestHealthCheckTreat403AsNotExist(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ReadOnly = true
+	s3Storage.Treat403AsNotExist = true
+
+	// Without s3:ListBucket, S3 denies reading a missing sentinel.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		return true
+	})
+	if err := s3Storage.HealthCheck(t.Context()); err != nil {
+		t.Errorf("Expected missing sentinel to be accepted, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	if err := s3Storage.Ping(ctx); err != nil {
+		t.Fatalf("Expected ping to pass, got %v", err)
+	}
+	if keys := fake.keys("test-bucket"); len(keys) != 0 {
+		t.Errorf("Expected ping not to write, got %v", keys)
+	}
+
+	missing := newFakeStorage(t, fake)
+	missing.Bucket = "missing-bucket"
+	err := missing.Ping(ctx)
+	if !errors.Is(err, ErrUnavailable) || !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected missing bucket to be unavailable, got %v", err)
+	}
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		<-r.Context().Done()
+		return true
+	})
+	s3Storage.HealthCheckTimeout = caddy.Duration(100 * time.Millisecond)
+	start := time.Now()
+	err = s3Storage.Ping(ctx)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected hanging endpoint to be unavailable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected ping to give up after its timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,111 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// heartbeat renews a lock held by this instance in the background.
+type heartbeat struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// lockHeartbeat returns the interval at which held locks are renewed, or
+// zero if they are not.
+func (s3 *S3) lockHeartbeat() time.Duration {
+	switch {
+	case s3.LockHeartbeat < 0:
+		return 0
+	case s3.LockHeartbeat > 0:
+		return time.Duration(s3.LockHeartbeat)
+	}
+	return s3.lockExpiration() / 3
+}
+
+// startHeartbeat renews the lock on key every heartbeat interval until
+// stopHeartbeat is called for it, ctx is done or the lock turns out to be
+// no longer held by this instance.
+func (s3 *S3) startHeartbeat(ctx context.Context, key string) {
+	interval := s3.lockHeartbeat()
+	if interval <= 0 {
+		return
+	}
+	s3.stopHeartbeat(key)
+
+	ctx, cancel := context.WithCancel(ctx)
+	hb := &heartbeat{cancel: cancel, done: make(chan struct{})}
+	s3.locksMu.Lock()
+	if s3.heartbeats == nil {
+		s3.heartbeats = make(map[string]*heartbeat)
+	}
+	s3.heartbeats[key] = hb
+	s3.locksMu.Unlock()
+
+	go func() {
+		defer close(hb.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			err := s3.renewLock(ctx, key)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			s3.Logger.Warn("renewing lock failed", s3.logKey(s3.objLockName(key)), zap.Error(err))
+			if errors.Is(err, ErrLockNotHeld) || s3.notExist(err) || minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+				return
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops renewing the lock on key and waits for a renewal in
+// progress to finish, so that it cannot recreate a lock file removed
+// afterwards.
+func (s3 *S3) stopHeartbeat(key string) {
+	s3.locksMu.Lock()
+	hb := s3.heartbeats[key]
+	delete(s3.heartbeats, key)
+	s3.locksMu.Unlock()
+	if hb != nil {
+		hb.cancel()
+		<-hb.done
+	}
+}
+
+// stopHeartbeats stops renewing all locks.
+func (s3 *S3) stopHeartbeats() {
+	s3.locksMu.Lock()
+	keys := make([]string, 0, len(s3.heartbeats))
+	for key := range s3.heartbeats {
+		keys = append(keys, key)
+	}
+	s3.locksMu.Unlock()
+	for _, key := range keys {
+		s3.stopHeartbeat(key)
+	}
+}
+
+// renewLock rewrites the lock file of key with the current time if it is
+// still the one written by this instance.
+func (s3 *S3) renewLock(ctx context.Context, key string) error {
+	data, etag, err := s3.readLockFile(ctx, key)
+	if err != nil {
+		return err
+	}
+	lf, err := parseLockFile(data)
+	acquiredAt, ok := s3.heldLock(key)
+	if err != nil || !ok || lf.Owner != s3.LockOwnerID || !lf.AcquiredAt.Equal(acquiredAt) {
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, s3.objLockName(key))
+	}
+	return s3.putLockFile(ctx, key, etag)
+}
@@ -1,9 +1,14 @@
 package s3
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/nacl/secretbox"
@@ -43,6 +48,10 @@ func (ci *CleartextIO) ByteReader(buf []byte) Reader {
 	return Reader{bytes.NewReader(buf), int64(len(buf)), nil}
 }
 
+// ErrDecryptionFailed is returned when reading a value that was not
+// encrypted with the configured key.
+var ErrDecryptionFailed = errors.New("decryption failed")
+
 type SecretBoxIO struct {
 	SecretKey [32]byte
 }
@@ -75,7 +84,7 @@ func (sb *SecretBoxIO) WrapReader(r io.Reader) io.Reader {
 	buf, _ := io.ReadAll(r)
 	bout, ok := secretbox.Open(nil, buf, &nonce, &sb.SecretKey)
 	if !ok {
-		return Reader{nil, 0, errors.New("decryption failed")}
+		return Reader{nil, 0, ErrDecryptionFailed}
 	}
 	return bytes.NewReader(bout)
 }
@@ -87,3 +96,142 @@ func (sb *SecretBoxIO) ByteReader(msg []byte) Reader {
 	out = secretbox.Seal(out, msg, &nonce, &sb.SecretKey)
 	return Reader{bytes.NewReader(out), int64(len(out)), err}
 }
+
+// AESGCMIO encrypts values with AES-256-GCM. Every value gets a random
+// nonce, which is stored in front of the ciphertext.
+type AESGCMIO struct {
+	SecretKey [32]byte
+}
+
+func (ag *AESGCMIO) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(ag.SecretKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ag *AESGCMIO) WrapReader(r io.Reader) io.Reader {
+	aead, err := ag.aead()
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if len(buf) < aead.NonceSize() {
+		return Reader{nil, 0, ErrDecryptionFailed}
+	}
+	nonce, ciphertext := buf[:aead.NonceSize()], buf[aead.NonceSize():]
+	bout, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return Reader{nil, 0, ErrDecryptionFailed}
+	}
+	return bytes.NewReader(bout)
+}
+
+func (ag *AESGCMIO) ByteReader(msg []byte) Reader {
+	aead, err := ag.aead()
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return Reader{nil, 0, err}
+	}
+	out := aead.Seal(nonce, nonce, msg, nil)
+	return Reader{bytes.NewReader(out), int64(len(out)), nil}
+}
+
+// GzipIO compresses values larger than MinSize before handing them to the
+// wrapped IO, so compression is applied before any encryption. Every value
+// is prefixed with gzipMarker and a flag byte recording whether it is
+// compressed. Objects without the marker were written before compression
+// was enabled and are returned as they are.
+type GzipIO struct {
+	IO      IO
+	MinSize int
+}
+
+// gzipMarker starts every value written by GzipIO. It is followed by
+// gzipCompressed or gzipUncompressed.
+var gzipMarker = []byte("\x00cmgz")
+
+const (
+	gzipUncompressed byte = 0
+	gzipCompressed   byte = 1
+)
+
+func (gi *GzipIO) WrapReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(gi.IO.WrapReader(r))
+	head, _ := br.Peek(len(gzipMarker) + 1)
+	if len(head) <= len(gzipMarker) || !bytes.HasPrefix(head, gzipMarker) {
+		return br
+	}
+	flag := head[len(gzipMarker)]
+	if _, err := br.Discard(len(head)); err != nil {
+		return Reader{nil, 0, err}
+	}
+	switch flag {
+	case gzipUncompressed:
+		return br
+	case gzipCompressed:
+	default:
+		return Reader{nil, 0, fmt.Errorf("unknown compression flag %d", flag)}
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	return zr
+}
+
+func (gi *GzipIO) ByteReader(buf []byte) Reader {
+	if len(buf) <= gi.MinSize {
+		return gi.IO.ByteReader(markGzip(gzipUncompressed, buf))
+	}
+
+	zbuf, err := gzipCompress(buf)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+
+	// Store the value as-is if compression did not pay off.
+	if len(zbuf) >= len(buf) {
+		return gi.IO.ByteReader(markGzip(gzipUncompressed, buf))
+	}
+	return gi.IO.ByteReader(markGzip(gzipCompressed, zbuf))
+}
+
+// markGzip prefixes buf with gzipMarker and flag.
+func markGzip(flag byte, buf []byte) []byte {
+	out := make([]byte, 0, len(gzipMarker)+1+len(buf))
+	out = append(out, gzipMarker...)
+	out = append(out, flag)
+	return append(out, buf...)
+}
+
+func gzipCompress(buf []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	if _, err := zw.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func gzipDecompress(buf []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
@@ -2,8 +2,13 @@ package s3
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -51,3 +56,229 @@ func TestIOWrap(t *testing.T) {
 		t.Errorf("Buffer should be empty, got: %v", buf)
 	}
 }
+
+func TestAESGCM(t *testing.T) {
+	ag := &AESGCMIO{}
+	copy(ag.SecretKey[:], "12345678123456781234567812345678")
+
+	msg := []byte("This is a very important message that shall be encrypted...")
+	first, err := io.ReadAll(ag.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("encrypting failed: %v", err)
+	}
+	second, err := io.ReadAll(ag.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("encrypting failed: %v", err)
+	}
+	if bytes.Equal(first[:12], second[:12]) {
+		t.Error("Expected a random nonce per value")
+	}
+	if bytes.Contains(first, msg) {
+		t.Error("Expected value to be encrypted")
+	}
+
+	buf, err := io.ReadAll(ag.WrapReader(bytes.NewReader(first)))
+	if err != nil {
+		t.Fatalf("decrypting failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("did not decrypt, got: %s", buf)
+	}
+
+	other := &AESGCMIO{}
+	if _, err := io.ReadAll(other.WrapReader(bytes.NewReader(first))); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected decryption with another key to fail, got %v", err)
+	}
+	if _, err := io.ReadAll(ag.WrapReader(bytes.NewReader(nil))); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected decrypting an empty value to fail, got %v", err)
+	}
+}
+
+func TestGzipThreshold(t *testing.T) {
+	gi := GzipIO{IO: &CleartextIO{}, MinSize: 64}
+
+	small := []byte("tiny value")
+	large := bytes.Repeat([]byte("a very compressible certificate line\n"), 100)
+
+	for _, tt := range []struct {
+		name       string
+		msg        []byte
+		compressed bool
+	}{
+		{name: "small", msg: small, compressed: false},
+		{name: "large", msg: large, compressed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, err := io.ReadAll(gi.ByteReader(tt.msg))
+			if err != nil {
+				t.Fatalf("compressing failed: %v", err)
+			}
+
+			if got := bytes.HasPrefix(stored, markGzip(gzipCompressed, nil)); got != tt.compressed {
+				t.Errorf("expected compressed %v, got %v", tt.compressed, got)
+			}
+			if !tt.compressed && !bytes.Equal(stored, markGzip(gzipUncompressed, tt.msg)) {
+				t.Errorf("expected raw value to be stored, got: %s", stored)
+			}
+
+			buf, err := io.ReadAll(gi.WrapReader(bytes.NewReader(stored)))
+			if err != nil {
+				t.Fatalf("decompressing failed: %v", err)
+			}
+			if !bytes.Equal(buf, tt.msg) {
+				t.Errorf("round trip mismatch, got: %s", buf)
+			}
+		})
+	}
+}
+
+func TestGzipUncompressedLookalike(t *testing.T) {
+	gi := GzipIO{IO: &CleartextIO{}, MinSize: 64}
+
+	// Written before compression was enabled, starting like a gzip stream.
+	stored := []byte{0x1f, 0x8b, 'n', 'o', 't', ' ', 'g', 'z', 'i', 'p'}
+	buf, err := io.ReadAll(gi.WrapReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+	if !bytes.Equal(buf, stored) {
+		t.Errorf("expected value to be returned unchanged, got %v", buf)
+	}
+}
+
+func TestGzipStoresGzipData(t *testing.T) {
+	gi := GzipIO{IO: &CleartextIO{}, MinSize: 64}
+
+	// A small gzip stream is stored as-is and must not be decompressed on
+	// load.
+	msg, err := gzipCompress([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(gi.ByteReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(gi.WrapReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected gzip data to be returned unchanged, got %q", buf)
+	}
+
+	// Values written before compression was enabled are returned as they
+	// are, even if they look like gzip data.
+	buf, err = io.ReadAll(gi.WrapReader(bytes.NewReader(msg)))
+	if err != nil {
+		t.Fatalf("loading unmarked value failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected unmarked value to be returned unchanged, got %q", buf)
+	}
+}
+
+func TestGzipEncrypted(t *testing.T) {
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	gi := GzipIO{IO: sb}
+
+	msg := bytes.Repeat([]byte("compress before encrypting "), 50)
+	stored, err := io.ReadAll(gi.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("storing failed: %v", err)
+	}
+
+	buf, err := io.ReadAll(gi.WrapReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("round trip mismatch, got: %s", buf)
+	}
+}
+
+func TestCompressConfigKeys(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.CompressConfigKeys = true
+	s3Storage.setupConfigIO()
+
+	value := bytes.Repeat([]byte(`{"apps":{"http":{"servers":{}}}}`), 50)
+	for _, key := range []string{
+		"config/autosave.json",
+		"autosave.json",
+		"certificates/acme/example.com/example.com.crt",
+		"certificates/acme/example.com/example.com.key",
+	} {
+		if err := s3Storage.Store(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		obj := fake.object("test-bucket", s3Storage.objName(key))
+		compressed := bytes.HasPrefix(obj.data, markGzip(gzipCompressed, nil))
+		if expected := keyType(key) == "config"; compressed != expected {
+			t.Errorf("%s: expected compressed %v, got %v", key, expected, compressed)
+		}
+
+		buf, err := s3Storage.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, value) {
+			t.Errorf("%s: round trip mismatch", key)
+		}
+	}
+
+	// Objects stored before the option was enabled are read as well.
+	legacy := "config/legacy.json"
+	fake.putObject("test-bucket", s3Storage.objName(legacy), value, time.Now())
+	if buf, err := s3Storage.Load(ctx, legacy); err != nil || !bytes.Equal(buf, value) {
+		t.Errorf("Expected uncompressed config to be read, got %v", err)
+	}
+}
+
+func TestCleartextFallbackOnDecryptError(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	s3Storage.iowrap = sb
+	core, logs := observer.New(zap.ErrorLevel)
+	s3Storage.Logger = zap.New(core)
+
+	if err := s3Storage.Store(ctx, "encrypted", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	legacy := []byte("-----BEGIN CERTIFICATE-----")
+	fake.putObject("test-bucket", s3Storage.objName("legacy"), legacy, time.Now())
+
+	if _, err := s3Storage.Load(ctx, "legacy"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected decryption to fail without the fallback, got %v", err)
+	}
+
+	s3Storage.AllowCleartextFallbackOnDecryptError = true
+	data, err := s3Storage.Load(ctx, "encrypted")
+	if err != nil || string(data) != "secret" {
+		t.Errorf("Expected encrypted value to be decrypted, got %q, %v", data, err)
+	}
+	if n := logs.Len(); n != 0 {
+		t.Errorf("Expected no fallback for a value that decrypts, got %d log entries", n)
+	}
+
+	data, err = s3Storage.Load(ctx, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacy) {
+		t.Errorf("Expected raw object, got %q", data)
+	}
+	entries := logs.FilterMessage("decryption failed, returning the raw object as cleartext fallback").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one fallback error log, got %d", len(entries))
+	}
+	if key := entries[0].ContextMap()["key"]; key != s3Storage.objName("legacy") {
+		t.Errorf("Expected fallback log for %s, got %v", s3Storage.objName("legacy"), key)
+	}
+}
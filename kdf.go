@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// defaultEncryptionKeySalt is the salt used to derive the encryption key
+// from a passphrase if no EncryptionKeySalt is configured.
+const defaultEncryptionKeySalt = "certmagic-s3"
+
+// secretKey returns the 32-byte key used to encrypt values. Without
+// EncryptionKeyDerivation the EncryptionKey is used as-is and must have
+// exactly 32 bytes, otherwise it is derived from the EncryptionKey as a
+// passphrase.
+func (s3 *S3) secretKey() ([32]byte, error) {
+	var key [32]byte
+
+	salt := []byte(defaultEncryptionKeySalt)
+	if s3.EncryptionKeySalt != "" {
+		salt = []byte(s3.EncryptionKeySalt)
+	}
+
+	switch s3.EncryptionKeyDerivation {
+	case "", "none":
+		if len(s3.EncryptionKey) != 32 {
+			return key, errors.New("encryption key must have exactly 32 bytes")
+		}
+		copy(key[:], s3.EncryptionKey)
+	case "argon2id":
+		if s3.EncryptionKey == "" {
+			return key, errors.New("encryption key must not be empty")
+		}
+		// The parameters recommended by RFC 9106 for memory-constrained
+		// environments.
+		copy(key[:], argon2.IDKey([]byte(s3.EncryptionKey), salt, 3, 64*1024, 4, 32))
+	case "scrypt":
+		if s3.EncryptionKey == "" {
+			return key, errors.New("encryption key must not be empty")
+		}
+		derived, err := scrypt.Key([]byte(s3.EncryptionKey), salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], derived)
+	default:
+		return key, fmt.Errorf("unsupported encryption key derivation %q", s3.EncryptionKeyDerivation)
+	}
+	return key, nil
+}
@@ -0,0 +1,46 @@
+package s3
+
+import "testing"
+
+func TestSecretKey(t *testing.T) {
+	if _, err := (&S3{EncryptionKey: "too short"}).secretKey(); err == nil {
+		t.Error("Expected error for a short key without derivation")
+	}
+	key, err := (&S3{EncryptionKey: "12345678123456781234567812345678"}).secretKey()
+	if err != nil || string(key[:]) != "12345678123456781234567812345678" {
+		t.Errorf("Expected the key to be used as-is, got %q, %v", key, err)
+	}
+
+	for _, kdf := range []string{"argon2id", "scrypt"} {
+		derive := func(passphrase, salt string) [32]byte {
+			t.Helper()
+			key, err := (&S3{
+				EncryptionKey:           passphrase,
+				EncryptionKeyDerivation: kdf,
+				EncryptionKeySalt:       salt,
+			}).secretKey()
+			if err != nil {
+				t.Fatalf("%s: %v", kdf, err)
+			}
+			return key
+		}
+
+		key := derive("correct horse battery staple", "")
+		if key != derive("correct horse battery staple", defaultEncryptionKeySalt) {
+			t.Errorf("%s: expected the default salt to be used", kdf)
+		}
+		if key == derive("correct horse battery staple", "other salt") {
+			t.Errorf("%s: expected another salt to derive another key", kdf)
+		}
+		if key == derive("another passphrase", "") {
+			t.Errorf("%s: expected another passphrase to derive another key", kdf)
+		}
+		if _, err := (&S3{EncryptionKeyDerivation: kdf}).secretKey(); err == nil {
+			t.Errorf("%s: expected error for an empty passphrase", kdf)
+		}
+	}
+
+	if _, err := (&S3{EncryptionKey: "passphrase", EncryptionKeyDerivation: "pbkdf2"}).secretKey(); err == nil {
+		t.Error("Expected error for an unsupported derivation")
+	}
+}
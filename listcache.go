@@ -0,0 +1,79 @@
+package s3
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listCache holds List results for ListCacheTTL. Writes through the storage
+// invalidate the entries whose prefix covers the written key, and the
+// generation makes sure a List racing with such a write does not cache
+// its result.
+type listCache struct {
+	mu         sync.Mutex
+	entries    map[listCacheKey]listCacheEntry
+	generation uint64
+}
+
+type listCacheKey struct {
+	prefix    string
+	recursive bool
+}
+
+type listCacheEntry struct {
+	keys    []string
+	expires time.Time
+}
+
+func (lc *listCache) get(prefix string, recursive bool) ([]string, uint64, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	e, ok := lc.entries[listCacheKey{normalizeKey(prefix), recursive}]
+	if !ok || time.Now().After(e.expires) {
+		return nil, lc.generation, false
+	}
+	return slices.Clone(e.keys), lc.generation, true
+}
+
+// put caches keys unless the cache was invalidated since generation.
+func (lc *listCache) put(prefix string, recursive bool, keys []string, generation uint64, ttl time.Duration) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if generation != lc.generation {
+		return
+	}
+	if lc.entries == nil {
+		lc.entries = make(map[listCacheKey]listCacheEntry)
+	}
+	lc.entries[listCacheKey{normalizeKey(prefix), recursive}] = listCacheEntry{
+		keys:    slices.Clone(keys),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// invalidate drops the entries listing key.
+func (lc *listCache) invalidate(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.generation++
+	key = normalizeKey(key)
+	for k := range lc.entries {
+		if strings.HasPrefix(key, k.prefix) {
+			delete(lc.entries, k)
+		}
+	}
+}
+
+// invalidateAll drops all entries.
+func (lc *listCache) invalidateAll() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.generation++
+	clear(lc.entries)
+}
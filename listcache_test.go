@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestListCache(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ListCacheTTL = caddy.Duration(200 * time.Millisecond)
+
+	var lists atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("list-type") == "2" {
+			lists.Add(1)
+		}
+		return false
+	})
+
+	if err := s3Storage.Store(ctx, "certificates/a.crt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s3Storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s3Storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lists.Load(); got != 1 {
+		t.Errorf("Expected second list to be served from cache, got %d list requests", got)
+	}
+	if !slices.Equal(first, second) {
+		t.Errorf("Expected cached result %v, got %v", first, second)
+	}
+
+	// A store below the prefix invalidates the cached result.
+	if err := s3Storage.Store(ctx, "certificates/b.crt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s3Storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lists.Load(); got != 2 {
+		t.Errorf("Expected list after store to miss the cache, got %d list requests", got)
+	}
+	if !slices.Contains(keys, "certificates/b.crt") {
+		t.Errorf("Expected stored key in list, got %v", keys)
+	}
+
+	// So does a delete.
+	if err := s3Storage.Delete(ctx, "certificates/b.crt"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s3Storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(keys, "certificates/b.crt") {
+		t.Errorf("Expected deleted key to be gone from list, got %v", keys)
+	}
+	if got := lists.Load(); got != 3 {
+		t.Errorf("Expected list after delete to miss the cache, got %d list requests", got)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, err := s3Storage.List(ctx, "certificates", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := lists.Load(); got != 4 {
+		t.Errorf("Expected list after TTL expiry to miss the cache, got %d list requests", got)
+	}
+}
+
+func TestListCacheDisabled(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	var lists atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("list-type") == "2" {
+			lists.Add(1)
+		}
+		return false
+	})
+
+	for range 2 {
+		if _, err := s3Storage.List(ctx, "", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lists.Load(); got != 2 {
+		t.Errorf("Expected every list to reach the bucket, got %d list requests", got)
+	}
+}
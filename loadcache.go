@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"bytes"
+	"container/list"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is the number of values kept by the Load cache if
+// CacheSize is not set.
+const defaultCacheSize = 1000
+
+// loadCache holds the values returned by Load for CacheTTL, evicting the
+// least recently used values beyond CacheSize. Like the listCache, the
+// generation keeps a Load racing with a write from caching its result.
+type loadCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        list.List
+	generation uint64
+}
+
+type loadCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (lc *loadCache) get(key string) ([]byte, uint64, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	key = normalizeKey(key)
+	el, ok := lc.entries[key]
+	if !ok {
+		return nil, lc.generation, false
+	}
+	e := el.Value.(*loadCacheEntry)
+	if time.Now().After(e.expires) {
+		lc.lru.Remove(el)
+		delete(lc.entries, key)
+		return nil, lc.generation, false
+	}
+	lc.lru.MoveToFront(el)
+	return bytes.Clone(e.value), lc.generation, true
+}
+
+// put caches value unless the cache was invalidated since generation.
+func (lc *loadCache) put(key string, value []byte, generation uint64, ttl time.Duration, size int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if generation != lc.generation {
+		return
+	}
+	if lc.entries == nil {
+		lc.entries = make(map[string]*list.Element)
+	}
+	key = normalizeKey(key)
+	if el, ok := lc.entries[key]; ok {
+		lc.lru.Remove(el)
+	}
+	lc.entries[key] = lc.lru.PushFront(&loadCacheEntry{
+		key:     key,
+		value:   bytes.Clone(value),
+		expires: time.Now().Add(ttl),
+	})
+	for lc.lru.Len() > size {
+		oldest := lc.lru.Back()
+		lc.lru.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*loadCacheEntry).key)
+	}
+}
+
+// invalidate drops the value of key and, since key may name a directory,
+// the values below it.
+func (lc *loadCache) invalidate(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.generation++
+	key = normalizeKey(key)
+	dir := strings.TrimSuffix(key, "/") + "/"
+	for k, el := range lc.entries {
+		if k == key || strings.HasPrefix(k, dir) {
+			lc.lru.Remove(el)
+			delete(lc.entries, k)
+		}
+	}
+}
+
+// invalidateAll drops all values.
+func (lc *loadCache) invalidateAll() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.generation++
+	lc.entries = nil
+	lc.lru.Init()
+}
+
+// cacheable reports whether the value of key may be cached by Load. Only
+// certificates and their keys are cached by default, since they change
+// rarely and are read by every instance.
+func (s3 *S3) cacheable(key string) bool {
+	if s3.CacheTTL <= 0 || isLockName(key) {
+		return false
+	}
+	if len(s3.CacheKeys) == 0 {
+		t := keyType(key)
+		return t == "certificate" || t == "key"
+	}
+	for _, pattern := range s3.CacheKeys {
+		if ok, _ := path.Match(pattern, normalizeKey(key)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package s3
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestLoadCache(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.CacheTTL = caddy.Duration(200 * time.Millisecond)
+
+	var gets atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && !r.URL.Query().Has("location") && r.URL.Query().Get("list-type") == "" {
+			gets.Add(1)
+		}
+		return false
+	})
+
+	certKey := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, certKey, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	load := func(key, expected string) {
+		t.Helper()
+		data, err := s3Storage.Load(ctx, key)
+		if err != nil || string(data) != expected {
+			t.Fatalf("Expected %q, got %q, %v", expected, data, err)
+		}
+	}
+
+	load(certKey, "cert")
+	load(certKey, "cert")
+	if got := gets.Load(); got != 1 {
+		t.Errorf("Expected second load to be served from cache, got %d requests", got)
+	}
+
+	// A store invalidates the cached value.
+	if err := s3Storage.Store(ctx, certKey, []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+	load(certKey, "renewed")
+	if got := gets.Load(); got != 2 {
+		t.Errorf("Expected load after store to miss the cache, got %d requests", got)
+	}
+
+	// Other keys are not cached by default.
+	if err := s3Storage.Store(ctx, "acme/users/admin.json", []byte("account")); err != nil {
+		t.Fatal(err)
+	}
+	load("acme/users/admin.json", "account")
+	load("acme/users/admin.json", "account")
+	if got := gets.Load(); got != 4 {
+		t.Errorf("Expected other keys not to be cached, got %d requests", got)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	load(certKey, "renewed")
+	if got := gets.Load(); got != 5 {
+		t.Errorf("Expected load after TTL expiry to miss the cache, got %d requests", got)
+	}
+
+	// Deleting a directory drops the cached values below it.
+	if err := s3Storage.Delete(ctx, "certificates/example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, certKey); err == nil {
+		t.Error("Expected deleted key not to be served from cache")
+	}
+}
+
+func TestLoadCacheKeysAndSize(t *testing.T) {
+	s3Storage := &S3{
+		CacheTTL:  caddy.Duration(time.Minute),
+		CacheKeys: []string{"acme/users/*"},
+	}
+	if !s3Storage.cacheable("acme/users/admin") || s3Storage.cacheable("certificates/example.com/example.com.crt") {
+		t.Error("Expected only keys matching cache_keys to be cached")
+	}
+	if s3Storage.cacheable("acme/users/admin.lock") {
+		t.Error("Expected lock files never to be cached")
+	}
+
+	var lc loadCache
+	for _, key := range []string{"a", "b", "c"} {
+		_, generation, _ := lc.get(key)
+		lc.put(key, []byte(key), generation, time.Minute, 2)
+		if key == "b" {
+			// Using a makes b the least recently used value.
+			lc.get("a")
+		}
+	}
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := lc.get(key); ok != expected {
+			t.Errorf("Expected %s cached to be %v", key, expected)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+var (
+	// LockExpiration is the age after which a lock is considered stale and
+	// may be taken over by another instance.
+	LockExpiration = 2 * time.Minute
+	// LockPollInterval is how often a held lock is checked again.
+	LockPollInterval = 1 * time.Second
+	// LockTimeout is how long Lock waits for a held lock before giving up.
+	LockTimeout = 15 * time.Second
+)
+
+func (s3 *S3) lockTimeout() time.Duration {
+	if s3.LockTimeout > 0 {
+		return time.Duration(s3.LockTimeout)
+	}
+	return LockTimeout
+}
+
+func (s3 *S3) lockPollInterval() time.Duration {
+	if s3.LockPollInterval > 0 {
+		return time.Duration(s3.LockPollInterval)
+	}
+	return LockPollInterval
+}
+
+func (s3 *S3) lockExpiration() time.Duration {
+	if s3.LockExpiration > 0 {
+		return time.Duration(s3.LockExpiration)
+	}
+	return LockExpiration
+}
+
+// errLockHeld is returned if a lock is held by a lock that is still valid.
+var errLockHeld = errors.New("lock already exists and is still valid")
+
+// errInvalidLock is returned by getLockFile if the lock file content cannot
+// be decrypted.
+var errInvalidLock = errors.New("invalid lock file content")
+
+// lockFile is the content of a lock file. Lock files written by earlier
+// versions only contain the RFC 3339 timestamp and have no owner.
+type lockFile struct {
+	Owner      string    `json:"owner"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// parseLockFile parses the content of a lock file in either format.
+func parseLockFile(data string) (lockFile, error) {
+	if !strings.HasPrefix(data, "{") {
+		lt, err := time.Parse(time.RFC3339, data)
+		return lockFile{AcquiredAt: lt}, err
+	}
+
+	var lf lockFile
+	if err := json.Unmarshal([]byte(data), &lf); err != nil {
+		return lockFile{}, err
+	}
+	if lf.AcquiredAt.IsZero() {
+		return lockFile{}, errors.New("lock file without acquisition time")
+	}
+	return lf, nil
+}
+
+// defaultLockOwnerID returns the hostname with a random suffix, which
+// tells apart several instances running on the same host.
+func defaultLockOwnerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "certmagic-s3"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+func (s3 *S3) Lock(ctx context.Context, key string) (err error) {
+	defer s3.observe("lock", time.Now(), &err)
+	ctx, span := s3.startSpan(ctx, "lock", key)
+	defer endSpan(span, &err)
+	s3.Logger.Debug("acquiring lock", s3.logKey(s3.objName(key)))
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	if err := s3.checkNameLength(s3.objLockName(key)); err != nil {
+		return err
+	}
+	if s3.ReadOnly {
+		return nil
+	}
+	defer s3.inflight.track()()
+
+	if s3.FairLocking {
+		err = s3.fairLock(ctx, key)
+	} else {
+		err = s3.waitLock(ctx, key)
+	}
+	if err == nil {
+		s3.startHeartbeat(ctx, key)
+	}
+	return err
+}
+
+// waitLock acquires the lock on key, checking again every poll interval
+// while it is held by a valid lock until the lock timeout has passed.
+func (s3 *S3) waitLock(ctx context.Context, key string) error {
+	startedAt := time.Now()
+	for {
+		err := s3.acquireLock(ctx, key)
+		if !errors.Is(err, errLockHeld) {
+			return err
+		}
+		if time.Since(startedAt) >= s3.lockTimeout() {
+			holder := s3.describeLock(ctx, key)
+			s3.Logger.Warn("timeout while acquiring lock",
+				s3.logKey(s3.objLockName(key)),
+				zap.String("holder", holder),
+			)
+			return fmt.Errorf("timeout while acquiring lock, %s: %w", holder, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s3.lockPollInterval()):
+		}
+	}
+}
+
+// acquireLock writes the lock file for key unless it is held by a valid
+// lock, in which case errLockHeld is returned.
+func (s3 *S3) acquireLock(ctx context.Context, key string) error {
+	var startedAt = time.Now()
+
+	// The lock file is only created if it does not exist yet, or replaced if
+	// it is still the stale lock that was read, so that of several instances
+	// racing for the same lock only one succeeds. Unless the initial read is
+	// skipped, the lock is known to be free or stale when it is written.
+	var (
+		stale lockFile
+		etag  string
+	)
+	if !s3.SkipInitialLockRead {
+		var err error
+		if stale, etag, err = s3.checkLockFile(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// Apart from a rejected conditional write, failing to write the lock is
+	// not caused by contention, so transient errors are retried with backoff
+	// until the lock timeout, while any other error is returned right away.
+	for attempt := 0; ; attempt++ {
+		err := s3.putLockFile(ctx, key, etag)
+		if err == nil {
+			if !stale.AcquiredAt.IsZero() {
+				s3.lockStolen(key, stale)
+			}
+			return nil
+		}
+		if !s3.UnconditionalLocks && minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			// Another instance created or replaced the lock in the meantime,
+			// which is only taken over once it is stale as well.
+			if stale, etag, err = s3.checkLockFile(ctx, key); err != nil {
+				return err
+			}
+			if startedAt.Add(s3.lockTimeout()).Before(time.Now()) {
+				return errLockHeld
+			}
+			continue
+		}
+		if !s3.retryable(ctx, err) {
+			return fmt.Errorf("writing lock file: %w", err)
+		}
+		if startedAt.Add(s3.lockTimeout()).Before(time.Now()) {
+			holder := s3.describeLock(ctx, key)
+			s3.Logger.Warn("timeout while acquiring lock",
+				s3.logKey(s3.objLockName(key)),
+				zap.String("holder", holder),
+			)
+			return fmt.Errorf("timeout while acquiring lock, %s: %w", holder, err)
+		}
+
+		s3.Logger.Warn("retrying after transient error", zap.String("operation", "lock"), s3.logKey(s3.objName(key)), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(attempt, s3.lockPollInterval(), s3.JitterMode)):
+		}
+	}
+}
+
+// checkLockFile returns an error if key is locked by a lock that is still
+// valid. If the lock is stale, its content and the ETag of the lock file
+// are returned.
+func (s3 *S3) checkLockFile(ctx context.Context, key string) (lockFile, string, error) {
+	data, etag, err := s3.readLockFile(ctx, key)
+	if s3.notExist(err) {
+		return lockFile{}, "", nil
+	}
+	if err != nil && !errors.Is(err, errInvalidLock) {
+		return lockFile{}, "", fmt.Errorf("reading lock file: %w", err)
+	}
+
+	// Crashed writers may leave empty or truncated lock files behind, which
+	// would otherwise block the key forever.
+	lf, err := parseLockFile(data)
+	if err != nil {
+		s3.Logger.Warn("reclaiming invalid lock",
+			s3.logKey(s3.objLockName(key)),
+			zap.Int("size", len(data)),
+		)
+		return lockFile{}, etag, nil
+	}
+	if lf.AcquiredAt.Add(s3.lockExpiration()).After(time.Now()) {
+		return lockFile{}, "", errLockHeld
+	}
+	return lf, etag, nil
+}
+
+// describeLock reads the current lock file of key for diagnostics. The
+// lock may have been released in the meantime.
+func (s3 *S3) describeLock(ctx context.Context, key string) string {
+	data, err := s3.getLockFile(ctx, key)
+	if err != nil {
+		if s3.notExist(err) {
+			return "lock file not present"
+		}
+		return fmt.Sprintf("lock file unreadable: %v", err)
+	}
+	lf, err := parseLockFile(data)
+	if err != nil {
+		return "invalid lock file content"
+	}
+	var owner string
+	if lf.Owner != "" {
+		owner = " by " + lf.Owner
+	}
+	return fmt.Sprintf("lock held%s since %s (%s ago)", owner, lf.AcquiredAt.Format(time.RFC3339), time.Since(lf.AcquiredAt).Round(time.Second))
+}
+
+// lockStolen reports that the stale lock prev on key has been replaced,
+// since this may point to a crashed instance or clock skew between
+// instances.
+func (s3 *S3) lockStolen(key string, prev lockFile) {
+	age := time.Since(prev.AcquiredAt)
+	s3.Logger.Warn("replaced stale lock",
+		s3.logKey(s3.objLockName(key)),
+		zap.String("previous_owner", prev.Owner),
+		zap.Time("acquired_at", prev.AcquiredAt),
+		zap.Duration("age", age),
+	)
+
+	if s3.emit != nil {
+		s3.emit("lock_stolen", map[string]any{
+			"key":            key,
+			"previous_owner": prev.Owner,
+			"acquired_at":    prev.AcquiredAt,
+			"age":            age,
+		})
+	}
+}
+
+func (s3 *S3) getLockFile(ctx context.Context, key string) (string, error) {
+	data, _, err := s3.readLockFile(ctx, key)
+	return data, err
+}
+
+// readLockFile returns the content of the lock file for key along with its
+// ETag. The ETag is also returned if the content cannot be decrypted.
+func (s3 *S3) readLockFile(ctx context.Context, key string) (string, string, error) {
+	return s3.readLockObject(ctx, s3.objLockName(key))
+}
+
+// readLockObject is readLockFile for the lock file name.
+func (s3 *S3) readLockObject(ctx context.Context, name string) (string, string, error) {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	obj, err := s3.lockClient().GetObject(ctx, s3.Bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	defer obj.Close()
+	raw, err := io.ReadAll(obj)
+	if err != nil {
+		return "", "", err
+	}
+	oi, err := obj.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	buf, err := io.ReadAll(s3.lockIO().WrapReader(bytes.NewReader(raw)))
+	if err != nil {
+		return "", oi.ETag, fmt.Errorf("%w: %w", errInvalidLock, err)
+	}
+
+	return string(buf), oi.ETag, nil
+}
+
+// putLockFile writes the lock file for key. Unless UnconditionalLocks is
+// set, the write fails with 412 Precondition Failed if the lock file exists
+// and, if etag is set, does not have that ETag anymore.
+func (s3 *S3) putLockFile(ctx context.Context, key, etag string) error {
+	ctx, cancel := s3.writeContext(ctx)
+	defer cancel()
+
+	if err := s3.lazyCreateBucket(ctx); err != nil {
+		return err
+	}
+
+	opts := s3.putOptions(key + ".lock")
+	switch {
+	case s3.UnconditionalLocks:
+	case etag != "":
+		opts.SetMatchETag(etag)
+	default:
+		opts.SetMatchETagExcept("*")
+	}
+
+	acquiredAt := time.Now().Truncate(time.Second)
+	content, err := json.Marshal(lockFile{Owner: s3.LockOwnerID, AcquiredAt: acquiredAt})
+	if err != nil {
+		return err
+	}
+	r := s3.lockIO().ByteReader(content)
+	_, err = s3.lockClient().PutObject(ctx, s3.Bucket, s3.objLockName(key), r, r.Len(), opts)
+	s3.listCache.invalidate(key + ".lock")
+	if err == nil {
+		s3.setHeldLock(key, acquiredAt)
+	}
+	return err
+}
+
+// lockIO returns the IO used for lock file contents, which are only
+// encrypted if EncryptLocks is set.
+func (s3 *S3) lockIO() IO {
+	if s3.EncryptLocks {
+		return s3.iowrap
+	}
+	return &CleartextIO{}
+}
+
+// ErrLockNotHeld is returned by Unlock if the lock cannot be shown to be
+// held by this instance. ForceUnlock removes such locks anyway.
+var ErrLockNotHeld = errors.New("lock is not held by this instance")
+
+func (s3 *S3) Unlock(ctx context.Context, key string) (err error) {
+	return s3.unlockName(ctx, key, s3.objLockName(key))
+}
+
+// unlockName releases the lock on key held in the lock file name, which
+// differs from the one of key once MigratePrefix switched the prefix.
+func (s3 *S3) unlockName(ctx context.Context, key, name string) (err error) {
+	ctx, span := s3.startSpan(ctx, "unlock", key)
+	defer endSpan(span, &err)
+	return s3.unlock(ctx, key, name, false)
+}
+
+// ForceUnlock removes the lock on key even if it is held by another
+// instance or older than MaxLockAge.
+func (s3 *S3) ForceUnlock(ctx context.Context, key string) error {
+	return s3.unlock(ctx, key, s3.objLockName(key), true)
+}
+
+func (s3 *S3) unlock(ctx context.Context, key, name string, force bool) error {
+	s3.Logger.Debug("releasing lock", s3.logKey(s3.objName(key)))
+	if s3.ReadOnly {
+		// Lock did not write a lock file that would have to be removed.
+		if force {
+			return fmt.Errorf("%w: %s", ErrReadOnly, key)
+		}
+		return nil
+	}
+	defer s3.inflight.track()()
+	s3.stopHeartbeat(key)
+
+	// Prüfe ob die Lock-Datei existiert und gültig ist
+	data, _, err := s3.readLockObject(ctx, name)
+	if err != nil && (!force || s3.notExist(err)) {
+		return fmt.Errorf("lock file does not exist")
+	}
+
+	// Validiere den Lock-Datei-Inhalt. Forced unlocks also remove empty or
+	// otherwise unreadable lock files.
+	lf, err := parseLockFile(data)
+	if err != nil && !force {
+		return fmt.Errorf("invalid lock file content")
+	}
+
+	// A lock file that differs from the one written by this instance has
+	// been taken over by another instance after ours went stale.
+	if !force {
+		if lf.Owner != s3.LockOwnerID {
+			return fmt.Errorf("%w: %s is held by %q", ErrLockNotHeld, name, lf.Owner)
+		}
+		acquiredAt, ok := s3.heldLock(key)
+		if !ok || !lf.AcquiredAt.Equal(acquiredAt) {
+			return fmt.Errorf("%w: %s acquired at %s", ErrLockNotHeld, name, lf.AcquiredAt.Format(time.RFC3339))
+		}
+		if s3.MaxLockAge > 0 && time.Since(lf.AcquiredAt) > time.Duration(s3.MaxLockAge) {
+			return fmt.Errorf("%w: %s is older than %s", ErrLockNotHeld, name, time.Duration(s3.MaxLockAge))
+		}
+	}
+
+	// Lösche die Lock-Datei
+	ctx, cancel := s3.writeContext(ctx)
+	defer cancel()
+	err = s3.lockClient().RemoveObject(ctx, s3.Bucket, name, minio.RemoveObjectOptions{})
+	s3.listCache.invalidate(key + ".lock")
+	if err == nil {
+		s3.releaseHeldLock(key)
+	}
+	return err
+}
+
+// LockInfo describes a lock file found by ListLocks.
+type LockInfo struct {
+	Key        string    `json:"key"`
+	AcquiredAt time.Time `json:"acquired_at,omitzero"`
+	// Owner is the LockOwnerID of the instance holding the lock, if known.
+	Owner string `json:"owner,omitempty"`
+	// Expired is set once the lock may be taken over by another instance.
+	Expired bool `json:"expired"`
+	// Invalid is set for lock files with unreadable content, which are
+	// treated as free.
+	Invalid bool `json:"invalid,omitempty"`
+}
+
+// ListLocks returns the lock files below the storage prefix with the time
+// they were acquired. Locks released while they are listed are skipped.
+func (s3 *S3) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	keys, err := s3.list(ctx, "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []LockInfo
+	for _, name := range keys {
+		key, ok := strings.CutSuffix(name, ".lock")
+		if !ok {
+			continue
+		}
+		data, err := s3.getLockFile(ctx, key)
+		if s3.notExist(err) {
+			continue
+		}
+		li := LockInfo{Key: key}
+		if lf, perr := parseLockFile(data); err == nil && perr == nil {
+			li.AcquiredAt = lf.AcquiredAt
+			li.Owner = lf.Owner
+			li.Expired = lf.AcquiredAt.Add(s3.lockExpiration()).Before(time.Now())
+		} else {
+			li.Invalid = true
+			li.Expired = true
+		}
+		locks = append(locks, li)
+	}
+	return locks, nil
+}
+
+// heldLock returns the time this instance last wrote the lock on key.
+func (s3 *S3) heldLock(key string) (time.Time, bool) {
+	s3.locksMu.Lock()
+	defer s3.locksMu.Unlock()
+	acquiredAt, ok := s3.locks[key]
+	return acquiredAt, ok
+}
+
+func (s3 *S3) setHeldLock(key string, acquiredAt time.Time) {
+	s3.locksMu.Lock()
+	defer s3.locksMu.Unlock()
+	if s3.locks == nil {
+		s3.locks = make(map[string]time.Time)
+	}
+	s3.locks[key] = acquiredAt
+}
+
+func (s3 *S3) releaseHeldLock(key string) {
+	s3.locksMu.Lock()
+	defer s3.locksMu.Unlock()
+	delete(s3.locks, key)
+}
+
+func (s3 *S3) objLockName(key string) string {
+	return s3.objName(key) + ".lock"
+}
+
+// isLockName reports whether a key or object name refers to a lock file.
+func isLockName(name string) bool {
+	return strings.HasSuffix(name, ".lock")
+}
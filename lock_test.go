@@ -0,0 +1,975 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestEncryptedLocks(t *testing.T) {
+	defer func(timeout, poll time.Duration) {
+		LockTimeout, LockPollInterval = timeout, poll
+	}(LockTimeout, LockPollInterval)
+	LockTimeout = 100 * time.Millisecond
+	LockPollInterval = 20 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	s3Storage.iowrap = sb
+	s3Storage.EncryptLocks = true
+
+	testKey := "encrypted-lock"
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("test-bucket", s3Storage.objLockName(testKey))
+	if obj == nil {
+		t.Fatal("Expected lock file to exist")
+	}
+	if _, err := parseLockFile(string(obj.data)); err == nil {
+		t.Error("Expected lock file content to be encrypted")
+	}
+
+	err = s3Storage.Lock(ctx, testKey)
+	if err == nil {
+		t.Error("Expected error when trying to create lock that already exists")
+	}
+
+	err = s3Storage.Unlock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", s3Storage.objLockName(testKey)) != nil {
+		t.Error("Lock file should not exist after unlock")
+	}
+}
+
+func TestLockRetriesTransientPutFailures(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	testKey := "flaky-lock"
+	var puts atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, ".lock") && puts.Add(1) <= 2 {
+			writeFakeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate.")
+			return true
+		}
+		return false
+	})
+
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatalf("Expected lock to be acquired after transient failures, got %v", err)
+	}
+	if got := puts.Load(); got != 3 {
+		t.Errorf("Expected 3 lock put attempts, got %d", got)
+	}
+	if fake.object("test-bucket", s3Storage.objLockName(testKey)) == nil {
+		t.Error("Expected lock file to exist")
+	}
+}
+
+func TestLockFailsOnPermanentPutError(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	var puts atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+			return true
+		}
+		return false
+	})
+
+	err := s3Storage.Lock(ctx, "forbidden-lock")
+	if err == nil {
+		t.Fatal("Expected lock to fail")
+	}
+	if got := puts.Load(); got != 1 {
+		t.Errorf("Expected a single lock put attempt, got %d", got)
+	}
+}
+
+func TestSkipInitialLockRead(t *testing.T) {
+	defer func(timeout, poll time.Duration) {
+		LockTimeout, LockPollInterval = timeout, poll
+	}(LockTimeout, LockPollInterval)
+	LockTimeout = 100 * time.Millisecond
+	LockPollInterval = 20 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.SkipInitialLockRead = true
+
+	var gets atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, ".lock") {
+			gets.Add(1)
+		}
+		return false
+	})
+
+	testKey := "skip-read-lock"
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gets.Load(); got != 0 {
+		t.Errorf("Expected no lock file reads, got %d", got)
+	}
+
+	// A held lock must still be detected through the conditional write.
+	err = s3Storage.Lock(ctx, testKey)
+	if err == nil {
+		t.Error("Expected error when trying to create lock that already exists")
+	}
+
+	// A stale lock is replaced.
+	staleKey := "stale-lock"
+	stale := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	fake.putObject("test-bucket", s3Storage.objLockName(staleKey), []byte(stale), time.Now().Add(-time.Hour))
+	err = s3Storage.Lock(ctx, staleKey)
+	if err != nil {
+		t.Fatalf("Expected stale lock to be replaced, got %v", err)
+	}
+	if obj := fake.object("test-bucket", s3Storage.objLockName(staleKey)); obj == nil || string(obj.data) == stale {
+		t.Error("Expected stale lock file to be rewritten")
+	}
+}
+
+func TestLockStolenEvent(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	core, logs := observer.New(zap.WarnLevel)
+	s3Storage.Logger = zap.New(core)
+
+	var events []map[string]any
+	s3Storage.emit = func(name string, data map[string]any) {
+		if name == "lock_stolen" {
+			events = append(events, data)
+		}
+	}
+
+	testKey := "stale-lock"
+	acquiredAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	prev, _ := json.Marshal(lockFile{Owner: "crashed-instance", AcquiredAt: acquiredAt})
+	fake.putObject("test-bucket", s3Storage.objLockName(testKey), prev, acquiredAt)
+
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected one lock_stolen event, got %d", len(events))
+	}
+	if events[0]["key"] != testKey {
+		t.Errorf("Expected event for key %s, got %v", testKey, events[0]["key"])
+	}
+	if got := events[0]["acquired_at"].(time.Time); !got.Equal(acquiredAt) {
+		t.Errorf("Expected previous acquisition time %v, got %v", acquiredAt, got)
+	}
+	if got := events[0]["previous_owner"]; got != "crashed-instance" {
+		t.Errorf("Expected previous owner crashed-instance, got %v", got)
+	}
+	if got := events[0]["age"].(time.Duration); got < time.Hour {
+		t.Errorf("Expected age of at least an hour, got %v", got)
+	}
+
+	entries := logs.FilterMessage("replaced stale lock").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one stale lock warning, got %d", len(entries))
+	}
+	if fields := entries[0].ContextMap(); fields["key"] != s3Storage.objLockName(testKey) || fields["previous_owner"] != "crashed-instance" {
+		t.Errorf("Unexpected log fields: %v", fields)
+	}
+
+	// Acquiring a free lock must not report a steal.
+	err = s3Storage.Lock(ctx, "free-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("Expected no event for a free lock, got %d events", len(events))
+	}
+}
+
+func TestUnlockRequiresHeldLock(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	other := newFakeStorage(t, fake)
+
+	testKey := "held-lock"
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.Unlock(ctx, testKey)
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected ErrLockNotHeld when unlocking from another instance, got %v", err)
+	}
+
+	// Simulate another instance taking over the lock after it went stale.
+	replaced := time.Now().Add(time.Minute).Format(time.RFC3339)
+	fake.putObject("test-bucket", s3Storage.objLockName(testKey), []byte(replaced), time.Now())
+
+	err = s3Storage.Unlock(ctx, testKey)
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected ErrLockNotHeld for a replaced lock, got %v", err)
+	}
+	if fake.object("test-bucket", s3Storage.objLockName(testKey)) == nil {
+		t.Fatal("Expected replaced lock file to be kept")
+	}
+
+	err = s3Storage.ForceUnlock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", s3Storage.objLockName(testKey)) != nil {
+		t.Error("Lock file should not exist after forced unlock")
+	}
+}
+
+func TestMaxLockAge(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MaxLockAge = caddy.Duration(time.Nanosecond)
+
+	testKey := "old-lock"
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3Storage.Unlock(ctx, testKey)
+	if !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected ErrLockNotHeld for a lock older than max_lock_age, got %v", err)
+	}
+
+	err = s3Storage.ForceUnlock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3Storage.MaxLockAge = caddy.Duration(time.Hour)
+	err = s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s3Storage.Unlock(ctx, testKey)
+	if err != nil {
+		t.Errorf("Expected unlock within max_lock_age to succeed, got %v", err)
+	}
+}
+
+func TestLoadLockObject(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	testKey := "certificates/example.com"
+	err := s3Storage.Lock(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s3Storage.Load(ctx, testKey+".lock")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist when loading a lock file, got %v", err)
+	}
+	if data != nil {
+		t.Errorf("Expected no data for a lock file, got %q", data)
+	}
+}
+
+func TestLockCredentials(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	lockClient, err := minio.New(fake.host(), &minio.Options{
+		Creds:      credentials.NewStaticV4("lock-key", "lock-secret", ""),
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Storage.lockCli = lockClient
+
+	var mu sync.Mutex
+	used := map[string]string{}
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		_, cred, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+		accessKey, _, _ := strings.Cut(cred, "/")
+		mu.Lock()
+		used[r.Method+" "+path.Base(r.URL.Path)] = accessKey
+		mu.Unlock()
+		return false
+	})
+
+	testKey := "example.com"
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Store(ctx, testKey, []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Unlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"GET example.com.lock":    "lock-key",
+		"PUT example.com.lock":    "lock-key",
+		"DELETE example.com.lock": "lock-key",
+		"PUT example.com":         "test",
+		"GET example.com":         "test",
+	}
+	for req, accessKey := range expected {
+		if used[req] != accessKey {
+			t.Errorf("Expected %s to use %q, got %q", req, accessKey, used[req])
+		}
+	}
+}
+
+func TestZeroByteLock(t *testing.T) {
+	for _, skipRead := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip_initial_lock_read=%v", skipRead), func(t *testing.T) {
+			ctx := t.Context()
+			fake := newFakeS3(t, "test-bucket")
+			s3Storage := newFakeStorage(t, fake)
+			s3Storage.SkipInitialLockRead = skipRead
+
+			testKey := "crashed-lock"
+			fake.putObject("test-bucket", s3Storage.objLockName(testKey), nil, time.Now())
+
+			err := s3Storage.Lock(ctx, testKey)
+			if err != nil {
+				t.Fatalf("Expected zero-byte lock to be reclaimed, got %v", err)
+			}
+			obj := fake.object("test-bucket", s3Storage.objLockName(testKey))
+			if obj == nil || len(obj.data) == 0 {
+				t.Fatal("Expected lock file to be rewritten")
+			}
+			if err := s3Storage.Unlock(ctx, testKey); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestForceUnlockInvalidLock(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	s3Storage.iowrap = sb
+	s3Storage.EncryptLocks = true
+
+	for _, data := range [][]byte{nil, []byte("garbage")} {
+		testKey := "invalid-lock"
+		fake.putObject("test-bucket", s3Storage.objLockName(testKey), data, time.Now())
+
+		if err := s3Storage.Unlock(ctx, testKey); err == nil {
+			t.Errorf("Expected unlock of invalid lock %q to fail", data)
+		}
+		if err := s3Storage.ForceUnlock(ctx, testKey); err != nil {
+			t.Errorf("Expected forced unlock of invalid lock %q to succeed, got %v", data, err)
+		}
+		if fake.object("test-bucket", s3Storage.objLockName(testKey)) != nil {
+			t.Errorf("Expected invalid lock %q to be removed", data)
+		}
+	}
+
+	if err := s3Storage.ForceUnlock(ctx, "missing-lock"); err == nil {
+		t.Error("Expected forced unlock of missing lock to fail")
+	}
+}
+
+func TestLockTimeoutDescribesHolder(t *testing.T) {
+	defer func(timeout, poll time.Duration) {
+		LockTimeout, LockPollInterval = timeout, poll
+	}(LockTimeout, LockPollInterval)
+	LockTimeout = 300 * time.Millisecond
+	LockPollInterval = 50 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	core, logs := observer.New(zap.WarnLevel)
+	s3Storage.Logger = zap.New(core)
+
+	testKey := "blocked-lock"
+	heldSince := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fake.putObject("test-bucket", s3Storage.objLockName(testKey), []byte(heldSince.Format(time.RFC3339)), heldSince)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, ".lock") {
+			writeFakeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate.")
+			return true
+		}
+		return false
+	})
+
+	err := s3Storage.Lock(ctx, testKey)
+	if err == nil {
+		t.Fatal("Expected lock to time out")
+	}
+	if !strings.Contains(err.Error(), heldSince.Format(time.RFC3339)) {
+		t.Errorf("Expected timeout error to name the lock holder, got %v", err)
+	}
+
+	entries := logs.FilterMessage("timeout while acquiring lock").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one timeout log entry, got %d", len(entries))
+	}
+	if holder := entries[0].ContextMap()["holder"]; !strings.Contains(holder.(string), heldSince.Format(time.RFC3339)) {
+		t.Errorf("Expected holder in log, got %v", holder)
+	}
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".lock") && r.Method == http.MethodGet {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return true
+		}
+		return false
+	})
+	if got := s3Storage.describeLock(ctx, testKey); got != "lock file not present" {
+		t.Errorf("Expected vanished lock to be described, got %q", got)
+	}
+}
+
+func TestFairLockingQueueTokenOptions(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.FairLocking = true
+	s3Storage.ServerSideEncryption = "AES256"
+	s3Storage.LockStorageClass = "REDUCED_REDUNDANCY"
+
+	var (
+		mu     sync.Mutex
+		tokens []http.Header
+	)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && isQueueName(strings.TrimPrefix(r.URL.Path, "/test-bucket/")) {
+			mu.Lock()
+			tokens = append(tokens, r.Header.Clone())
+			mu.Unlock()
+		}
+		return false
+	})
+	if err := s3Storage.Lock(ctx, "queued-lock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Unlock(ctx, "queued-lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) == 0 {
+		t.Fatal("Expected a queue token to be written")
+	}
+	if got := tokens[0].Get("X-Amz-Server-Side-Encryption"); got != "AES256" {
+		t.Errorf("Expected queue token to be encrypted, got %q", got)
+	}
+	if got := tokens[0].Get("X-Amz-Storage-Class"); got != "REDUCED_REDUNDANCY" {
+		t.Errorf("Expected queue token to use the lock storage class, got %q", got)
+	}
+}
+
+func TestFairLocking(t *testing.T) {
+	defer func(poll time.Duration) { LockPollInterval = poll }(LockPollInterval)
+	LockPollInterval = 20 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	newContender := func() *S3 {
+		s3Storage := newFakeStorage(t, fake)
+		s3Storage.FairLocking = true
+		return s3Storage
+	}
+
+	testKey := "contended-lock"
+	holder := newContender()
+	if err := holder.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := range 4 {
+		contender := newContender()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := contender.Lock(ctx, testKey); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			time.Sleep(30 * time.Millisecond)
+			if err := contender.Unlock(ctx, testKey); err != nil {
+				t.Error(err)
+			}
+		}()
+		// Give each contender time to queue up before the next arrives.
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	if err := holder.Unlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if !slices.Equal(order, []int{0, 1, 2, 3}) {
+		t.Errorf("Expected contenders to acquire the lock in arrival order, got %v", order)
+	}
+	for _, name := range fake.keys("test-bucket") {
+		if isQueueName(name) {
+			t.Errorf("Expected queue token %s to be removed", name)
+		}
+	}
+}
+
+// TestFairLockLongWait covers a waiter queued behind a lock kept alive by
+// heartbeats for longer than LockExpiration.
+func TestFairLockLongWait(t *testing.T) {
+	defer func(poll time.Duration) { LockPollInterval = poll }(LockPollInterval)
+	LockPollInterval = 20 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	newContender := func(timeout time.Duration) *S3 {
+		s3Storage := newFakeStorage(t, fake)
+		s3Storage.FairLocking = true
+		s3Storage.LockExpiration = caddy.Duration(2 * time.Second)
+		s3Storage.LockTimeout = caddy.Duration(timeout)
+		return s3Storage
+	}
+
+	testKey := "contended-lock"
+	holder := newContender(time.Second)
+	if err := holder.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := newContender(200*time.Millisecond).Lock(ctx, testKey)
+	if err == nil || !strings.Contains(err.Error(), "timeout while acquiring lock") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected waiting to stop after the lock timeout, took %s", elapsed)
+	}
+
+	waiter := newContender(10 * time.Second)
+	done := make(chan error, 1)
+	go func() { done <- waiter.Lock(ctx, testKey) }()
+	time.Sleep(3 * time.Second)
+	if err := holder.Unlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected waiter to acquire the lock after it was released")
+	}
+	if err := waiter.Unlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUnlockAfterFailedStore covers certmagic's lock, store, unlock
+// sequence when the store fails in between.
+func TestUnlockAfterFailedStore(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	testKey := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	lock := fake.object("test-bucket", s3Storage.objLockName(testKey))
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && !strings.HasSuffix(r.URL.Path, ".lock") {
+			writeFakeError(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+			return true
+		}
+		return false
+	})
+	if err := s3Storage.Store(ctx, testKey, []byte("test-data")); err == nil {
+		t.Fatal("Expected store to fail")
+	}
+	fake.setIntercept(nil)
+
+	if err := s3Storage.Store(ctx, testKey+".lock", []byte("test-data")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected storing a lock name to be rejected, got %v", err)
+	}
+	if err := s3Storage.Delete(ctx, testKey+".lock"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected deleting a lock name to be rejected, got %v", err)
+	}
+	if obj := fake.object("test-bucket", s3Storage.objLockName(testKey)); obj == nil || !bytes.Equal(obj.data, lock.data) {
+		t.Fatal("Expected lock file to be unchanged by the failed store")
+	}
+
+	if err := s3Storage.Unlock(ctx, testKey); err != nil {
+		t.Fatalf("Expected unlock after failed store to succeed, got %v", err)
+	}
+	if fake.object("test-bucket", s3Storage.objLockName(testKey)) != nil {
+		t.Error("Lock file should not exist after unlock")
+	}
+	if fake.object("test-bucket", s3Storage.objName(testKey)) != nil {
+		t.Error("Expected no value after failed store")
+	}
+}
+
+func TestConditionalLockWrite(t *testing.T) {
+	defer func(timeout, poll time.Duration) {
+		LockTimeout, LockPollInterval = timeout, poll
+	}(LockTimeout, LockPollInterval)
+	LockTimeout = 100 * time.Millisecond
+	LockPollInterval = 20 * time.Millisecond
+
+	for _, tc := range []struct {
+		name          string
+		unconditional bool
+		stale         bool
+	}{
+		{name: "free"},
+		{name: "stale", stale: true},
+		{name: "unconditional", unconditional: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+			fake := newFakeS3(t, "test-bucket")
+			s3Storage := newFakeStorage(t, fake)
+			s3Storage.UnconditionalLocks = tc.unconditional
+
+			testKey := "raced-lock"
+			lockName := s3Storage.objLockName(testKey)
+			if tc.stale {
+				stale := time.Now().Add(-time.Hour)
+				fake.putObject("test-bucket", lockName, []byte(stale.Format(time.RFC3339)), stale)
+			}
+
+			// Another instance acquires the lock between the read and the
+			// write of this one.
+			winner := []byte(time.Now().Add(time.Minute).Format(time.RFC3339))
+			var conditions []string
+			fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, ".lock") {
+					conditions = append(conditions, r.Header.Get("If-None-Match")+r.Header.Get("If-Match"))
+					if len(conditions) == 1 {
+						fake.putObject("test-bucket", lockName, winner, time.Now())
+					}
+				}
+				return false
+			})
+
+			err := s3Storage.Lock(ctx, testKey)
+			obj := fake.object("test-bucket", lockName)
+			if tc.unconditional {
+				if err != nil {
+					t.Fatalf("Expected unconditional lock to overwrite the lock, got %v", err)
+				}
+				if bytes.Equal(obj.data, winner) {
+					t.Error("Expected lock file to be overwritten")
+				}
+				if !slices.Equal(conditions, []string{""}) {
+					t.Errorf("Expected no preconditions, got %q", conditions)
+				}
+				return
+			}
+
+			if !errors.Is(err, errLockHeld) {
+				t.Fatalf("Expected lock to be held by the other instance, got %v", err)
+			}
+			if !bytes.Equal(obj.data, winner) {
+				t.Errorf("Expected lock of the other instance to be kept, got %q", obj.data)
+			}
+			if len(conditions) != 1 || conditions[0] == "" {
+				t.Errorf("Expected a single conditional write, got %q", conditions)
+			}
+			if tc.stale == (conditions[0] == "*") {
+				t.Errorf("Expected If-Match for a stale lock and If-None-Match otherwise, got %q", conditions[0])
+			}
+		})
+	}
+}
+
+func TestLockExpiration(t *testing.T) {
+	defer func(expiration, timeout, poll time.Duration) {
+		LockExpiration, LockTimeout, LockPollInterval = expiration, timeout, poll
+	}(LockExpiration, LockTimeout, LockPollInterval)
+	LockExpiration = time.Minute
+	LockTimeout = 200 * time.Millisecond
+	LockPollInterval = 20 * time.Millisecond
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	// A lock older than LockTimeout, but not LockExpiration, is still held.
+	heldKey := "held-lock"
+	held := time.Now().Add(-30 * time.Second).Truncate(time.Second)
+	fake.putObject("test-bucket", s3Storage.objLockName(heldKey), []byte(held.Format(time.RFC3339)), held)
+	started := time.Now()
+	err := s3Storage.Lock(ctx, heldKey)
+	if !errors.Is(err, errLockHeld) {
+		t.Fatalf("Expected held lock to time out, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < LockTimeout {
+		t.Errorf("Expected Lock to wait for %v, gave up after %v", LockTimeout, elapsed)
+	}
+	if obj := fake.object("test-bucket", s3Storage.objLockName(heldKey)); string(obj.data) != held.Format(time.RFC3339) {
+		t.Errorf("Expected held lock to be kept, got %q", obj.data)
+	}
+
+	// A lock older than LockExpiration is stolen.
+	staleKey := "stale-lock"
+	stale := time.Now().Add(-2 * LockExpiration).Truncate(time.Second)
+	fake.putObject("test-bucket", s3Storage.objLockName(staleKey), []byte(stale.Format(time.RFC3339)), stale)
+	if err := s3Storage.Lock(ctx, staleKey); err != nil {
+		t.Fatalf("Expected stale lock to be stolen, got %v", err)
+	}
+	if err := s3Storage.Unlock(ctx, staleKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock released while waiting is acquired.
+	other := newFakeStorage(t, fake)
+	if err := other.Lock(ctx, heldKey+"-released"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(3 * LockPollInterval)
+		if err := other.Unlock(ctx, heldKey+"-released"); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := s3Storage.Lock(ctx, heldKey+"-released"); err != nil {
+		t.Errorf("Expected lock to be acquired once released, got %v", err)
+	}
+}
+
+func TestLockOwner(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	first := newFakeStorage(t, fake)
+	first.LockOwnerID = "first"
+	second := newFakeStorage(t, fake)
+	second.LockOwnerID = "second"
+
+	testKey := "owned-lock"
+	if err := first.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	var lf lockFile
+	if err := json.Unmarshal(fake.object("test-bucket", first.objLockName(testKey)).data, &lf); err != nil {
+		t.Fatal(err)
+	}
+	if lf.Owner != "first" || time.Since(lf.AcquiredAt) > time.Minute {
+		t.Errorf("Unexpected lock file content %+v", lf)
+	}
+	if holder := second.describeLock(ctx, testKey); !strings.Contains(holder, "by first") {
+		t.Errorf("Expected holder to be described, got %q", holder)
+	}
+
+	// Even with the same acquisition time, only the owner releases a lock.
+	second.setHeldLock(testKey, lf.AcquiredAt)
+	if err := second.Unlock(ctx, testKey); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Expected ErrLockNotHeld for another owner, got %v", err)
+	}
+	if err := second.ForceUnlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock files without an owner are still understood.
+	acquiredAt := time.Now().Truncate(time.Second)
+	fake.putObject("test-bucket", first.objLockName(testKey), []byte(acquiredAt.Format(time.RFC3339)), acquiredAt)
+	locks, err := first.ListLocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 || !locks[0].AcquiredAt.Equal(acquiredAt) || locks[0].Owner != "" || locks[0].Invalid {
+		t.Errorf("Unexpected locks %+v", locks)
+	}
+}
+
+func TestLockTimingOptions(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+
+	d := caddyfile.NewTestDispenser(`s3 {
+		lock_timeout 300ms
+		lock_poll_interval 50ms
+		lock_expiration 1h
+	}`)
+	parsed := new(S3)
+	if err := parsed.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.lockTimeout() != 300*time.Millisecond || parsed.lockPollInterval() != 50*time.Millisecond || parsed.lockExpiration() != time.Hour {
+		t.Fatalf("Unexpected lock timing %s, %s, %s", parsed.lockTimeout(), parsed.lockPollInterval(), parsed.lockExpiration())
+	}
+
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.LockTimeout = parsed.LockTimeout
+	s3Storage.LockPollInterval = parsed.LockPollInterval
+	s3Storage.LockExpiration = parsed.LockExpiration
+
+	// A lock older than the default expiration is still valid for this
+	// instance, so Lock has to wait for it and give up after its timeout.
+	testKey := "timing-lock"
+	heldSince := time.Now().Add(-10 * time.Minute)
+	fake.putObject("test-bucket", s3Storage.objLockName(testKey), []byte(heldSince.Format(time.RFC3339)), heldSince)
+	start := time.Now()
+	if err := s3Storage.Lock(ctx, testKey); err == nil {
+		t.Fatal("Expected lock to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the instance timeout to apply, waited %s", elapsed)
+	}
+	if LockTimeout != 15*time.Second || LockPollInterval != time.Second || LockExpiration != 2*time.Minute {
+		t.Error("Expected package defaults to be unchanged")
+	}
+
+	cctx, cancel := caddy.NewContext(caddy.Context{Context: ctx})
+	defer cancel()
+	invalid := &S3{
+		Host:             fake.host(),
+		Bucket:           "test-bucket",
+		AccessKey:        "test",
+		SecretKey:        "test",
+		InsecureHosts:    []string{"127.0.0.1"},
+		LockTimeout:      caddy.Duration(time.Second),
+		LockPollInterval: caddy.Duration(time.Second),
+	}
+	if err := invalid.Provision(cctx); err == nil || !strings.Contains(err.Error(), "lock_poll_interval") {
+		t.Errorf("Expected poll interval to be validated, got %v", err)
+	}
+
+	invalid.LockTimeout, invalid.LockPollInterval = 0, 0
+	invalid.CleanupLocksAge = caddy.Duration(time.Minute)
+	if err := invalid.Provision(cctx); err == nil || !strings.Contains(err.Error(), "cleanup_locks_age") {
+		t.Errorf("Expected cleanup age below the lock expiration to be rejected, got %v", err)
+	}
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.LockOwnerID = "heartbeat-test"
+	s3Storage.LockHeartbeat = caddy.Duration(100 * time.Millisecond)
+
+	testKey := "heartbeat-lock"
+	readLock := func() (lockFile, bool) {
+		obj := fake.object("test-bucket", s3Storage.objLockName(testKey))
+		if obj == nil {
+			return lockFile{}, false
+		}
+		lf, err := parseLockFile(string(obj.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lf, true
+	}
+
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := readLock()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		lf, ok := readLock()
+		if !ok {
+			t.Fatal("Expected lock file to be kept")
+		}
+		if lf.AcquiredAt.After(first.AcquiredAt) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected lock to be renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := s3Storage.Unlock(ctx, testKey); err != nil {
+		t.Fatalf("Expected renewed lock to be released, got %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := readLock(); ok {
+		t.Error("Expected released lock not to be recreated")
+	}
+
+	// A lock taken over by another instance is no longer renewed.
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	s3Storage.locksMu.Lock()
+	hb := s3Storage.heartbeats[testKey]
+	s3Storage.locksMu.Unlock()
+	other, _ := json.Marshal(lockFile{Owner: "other", AcquiredAt: time.Now().Truncate(time.Second)})
+	fake.putObject("test-bucket", s3Storage.objLockName(testKey), other, time.Now())
+	select {
+	case <-hb.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected heartbeat to stop")
+	}
+	if lf, _ := readLock(); lf.Owner != "other" {
+		t.Errorf("Expected lock of the other instance to be kept, got %+v", lf)
+	}
+
+	s3Storage.LockHeartbeat = caddy.Duration(-1)
+	if got := s3Storage.lockHeartbeat(); got != 0 {
+		t.Errorf("Expected negative lock_heartbeat to disable renewal, got %s", got)
+	}
+}
@@ -0,0 +1,259 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// DeleteOlderThan removes all objects below prefix that were last modified
+// more than age ago and returns the number of objects deleted. Lock files,
+// objects below read-only prefixes and objects maintained by the storage
+// itself are never removed.
+func (s3 *S3) DeleteOlderThan(ctx context.Context, prefix string, age time.Duration) (int, error) {
+	if s3.ReadOnly {
+		return 0, fmt.Errorf("%w: %s", ErrReadOnly, prefix)
+	}
+	defer s3.inflight.track()()
+	defer s3.holdMigration()()
+
+	cutoff := time.Now().Add(-age)
+	deleted, err := s3.removeObjects(ctx, s3.Client, s3.Bucket, prefix, func(obj minio.ObjectInfo) bool {
+		return obj.LastModified.Before(cutoff)
+	})
+	s3.listCache.invalidateAll()
+	s3.loadCache.invalidateAll()
+	s3.Logger.Info("deleted old objects", zap.String("prefix", s3.redact(s3.objName(prefix))), zap.Int("deleted", deleted))
+	return deleted, err
+}
+
+// DeleteAll removes all objects below prefix and returns the number of
+// objects deleted. Like DeleteOlderThan, it keeps lock files, objects below
+// read-only prefixes and objects maintained by the storage itself. Objects
+// that cannot be deleted do not stop the deletion of the others, their
+// errors are returned joined.
+func (s3 *S3) DeleteAll(ctx context.Context, prefix string) (int, error) {
+	if strings.Trim(prefix, "/") == "" {
+		return 0, fmt.Errorf("%w: refusing to delete the whole storage", ErrInvalidKey)
+	}
+	if err := s3.checkKey(prefix); err != nil {
+		return 0, err
+	}
+	if err := s3.checkWritable(prefix); err != nil {
+		return 0, err
+	}
+	defer s3.inflight.track()()
+	defer s3.holdMigration()()
+
+	deleted, err := s3.removeObjects(ctx, s3.Client, s3.Bucket, prefix, nil)
+	s3.listCache.invalidateAll()
+	s3.loadCache.invalidateAll()
+	s3.Logger.Info("deleted all objects", zap.String("prefix", s3.redact(s3.objName(prefix))), zap.Int("deleted", deleted))
+	return deleted, err
+}
+
+// removeObjects deletes the objects below prefix in bucket of client that
+// match, or all of them if match is nil, using multi-object deletes of up
+// to 1000 objects each. Objects that DeleteOlderThan and DeleteAll keep are skipped.
+func (s3 *S3) removeObjects(ctx context.Context, client *minio.Client, bucket, prefix string, match func(minio.ObjectInfo) bool) (int, error) {
+	matched := make(chan minio.ObjectInfo)
+	listed := make(chan struct{})
+	var (
+		queued  int
+		listErr error
+	)
+
+	go func() {
+		defer close(listed)
+		defer close(matched)
+		for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+			Prefix:    s3.objName(prefix),
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			if s3.isInternal(obj.Key) || s3.readOnly(obj.Key) || isLockName(obj.Key) || (match != nil && !match(obj)) {
+				continue
+			}
+			select {
+			case matched <- obj:
+				queued++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var errs []error
+	for rerr := range client.RemoveObjects(ctx, bucket, matched, minio.RemoveObjectsOptions{}) {
+		errs = append(errs, fmt.Errorf("deleting %s: %w", rerr.ObjectName, rerr.Err))
+	}
+	<-listed
+
+	deleted := queued - len(errs)
+	if listErr != nil {
+		errs = append(errs, fmt.Errorf("listing objects: %w", listErr))
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// ListDomains returns the sorted names of all domains with a certificate
+// stored below the certificates scope. Wildcard names are returned with
+// their leading asterisk restored.
+func (s3 *S3) ListDomains(ctx context.Context) ([]string, error) {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	base := s3.objName("certificates/")
+	seen := make(map[string]struct{})
+	for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+		Prefix:    base,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("listing certificates: %w", obj.Err)
+		}
+
+		key, err := s3.logicalKey(obj.Key, s3.storagePrefix("certificates/"))
+		if err != nil {
+			continue
+		}
+
+		// certmagic stores certificates as <issuer>/<domain>/<domain>.crt
+		parts := strings.Split(strings.TrimPrefix(key, "certificates/"), "/")
+		if len(parts) != 3 || parts[2] != parts[1]+".crt" {
+			continue
+		}
+		domain := parts[1]
+		if rest, ok := strings.CutPrefix(domain, "wildcard_"); ok {
+			domain = "*" + rest
+		}
+		seen[domain] = struct{}{}
+	}
+
+	return slices.Sorted(maps.Keys(seen)), nil
+}
+
+// Replicate copies all objects below the storage prefix and the scope
+// prefixes server-side to the same names in dstBucket and returns the
+// number of objects copied. Up to StoreConcurrency copies run at a time.
+// Copies are written with the encryption, tags and storage class that Store
+// would use. Lock files, internal objects and objects that are not values
+// of this storage are not replicated.
+func (s3 *S3) Replicate(ctx context.Context, dstBucket string) (int, error) {
+	if s3.ReadOnly {
+		return 0, fmt.Errorf("%w: replicating to %s", ErrReadOnly, dstBucket)
+	}
+	defer s3.inflight.track()()
+
+	workers := s3.StoreConcurrency
+	if workers <= 0 {
+		workers = defaultStoreConcurrency
+	}
+
+	var (
+		mu     sync.Mutex
+		copied int
+		errs   []error
+		wg     sync.WaitGroup
+	)
+	sem := make(chan struct{}, workers)
+	for _, t := range s3.listTargets("") {
+		for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+			Prefix:    t.name,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("listing objects: %w", obj.Err))
+				mu.Unlock()
+				break
+			}
+			if isLockName(obj.Key) || s3.isInternal(obj.Key) {
+				continue
+			}
+			// Checksum sidecars are written with the options of their value.
+			name := obj.Key
+			if s3.isChecksumName(name) {
+				name = strings.TrimSuffix(name, checksumSuffix)
+			}
+			key, err := s3.logicalKey(name, t.strip)
+			if err != nil {
+				continue
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				_, err := s3.Client.CopyObject(ctx,
+					s3.copyOptions(key, dstBucket, obj.Key),
+					minio.CopySrcOptions{Bucket: s3.Bucket, Object: obj.Key},
+				)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("copying %s: %w", obj.Key, err))
+					return
+				}
+				copied++
+			}()
+		}
+	}
+	wg.Wait()
+
+	s3.Logger.Info("replicated objects", zap.String("prefix", s3.objName("")), zap.String("destination", dstBucket), zap.Int("copied", copied))
+	return copied, errors.Join(errs...)
+}
+
+func (s3 *S3) cleanupLocksAge() time.Duration {
+	if s3.CleanupLocksAge > 0 {
+		return time.Duration(s3.CleanupLocksAge)
+	}
+	return s3.lockExpiration()
+}
+
+// cleanupLocks removes lock files that were last written more than age
+// ago and returns the number of lock files removed.
+func (s3 *S3) cleanupLocks(ctx context.Context, age time.Duration) (int, error) {
+	cutoff := time.Now().Add(-age)
+
+	var stale []string
+	for _, t := range s3.listTargets("") {
+		for obj := range s3.lockClient().ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+			Prefix:    t.name,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				return 0, fmt.Errorf("listing lock files: %w", obj.Err)
+			}
+			if isLockName(obj.Key) && obj.LastModified.Before(cutoff) {
+				stale = append(stale, obj.Key)
+			}
+		}
+	}
+
+	var errs []error
+	for _, name := range stale {
+		s3.Logger.Warn("removing stale lock", s3.logKey(name))
+		err := s3.lockClient().RemoveObject(ctx, s3.Bucket, name, minio.RemoveObjectOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", name, err))
+		}
+	}
+	s3.listCache.invalidateAll()
+	return len(stale) - len(errs), errors.Join(errs...)
+}
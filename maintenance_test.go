@@ -0,0 +1,328 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDeleteOlderThan(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	old := time.Now().Add(-48 * time.Hour)
+	fresh := time.Now().Add(-time.Minute)
+
+	fake.putObject("test-bucket", "test/certificates/old.example.com/old.example.com.crt", []byte("old"), old)
+	fake.putObject("test-bucket", "test/certificates/old.example.com/old.example.com.key", []byte("old"), old)
+	fake.putObject("test-bucket", "test/certificates/new.example.com/new.example.com.crt", []byte("new"), fresh)
+	fake.putObject("test-bucket", "test/certificates/old.example.com.lock", []byte("lock"), old)
+	fake.putObject("test-bucket", "test/"+healthKey, []byte("sentinel"), old)
+	fake.putObject("test-bucket", "other/certificates/old.example.com/old.example.com.crt", []byte("old"), old)
+
+	deleted, err := s3Storage.DeleteOlderThan(ctx, "", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 objects to be deleted, got %d", deleted)
+	}
+
+	expected := []string{
+		"other/certificates/old.example.com/old.example.com.crt",
+		"test/" + healthKey,
+		"test/certificates/new.example.com/new.example.com.crt",
+		"test/certificates/old.example.com.lock",
+	}
+	if keys := fake.keys("test-bucket"); !slices.Equal(keys, expected) {
+		t.Errorf("Expected remaining objects %v, got %v", expected, keys)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	now := time.Now()
+	for i := range 1200 {
+		fake.putObject("test-bucket", fmt.Sprintf("test/certificates/issuer/%d.example.com/%d.example.com.crt", i, i), []byte("cert"), now)
+	}
+	fake.putObject("test-bucket", "test/certificates/issuer.lock", []byte("lock"), now)
+	fake.putObject("test-bucket", "test/certificates/issuer/held.example.com.lock", []byte("lock"), now)
+	fake.putObject("test-bucket", "test/certificates/other/other.example.com.crt", []byte("cert"), now)
+
+	var requests atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPost && r.URL.Query().Has("delete") {
+			requests.Add(1)
+		}
+		return false
+	})
+
+	deleted, err := s3Storage.DeleteAll(ctx, "certificates/issuer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1200 {
+		t.Errorf("Expected 1200 objects to be deleted, got %d", deleted)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Expected deletes to be batched into 2 requests, got %d", got)
+	}
+	expected := []string{
+		"test/certificates/issuer.lock",
+		"test/certificates/issuer/held.example.com.lock",
+		"test/certificates/other/other.example.com.crt",
+	}
+	if keys := fake.keys("test-bucket"); !slices.Equal(keys, expected) {
+		t.Errorf("Expected remaining objects %v, got %v", expected, keys)
+	}
+
+	if _, err := s3Storage.DeleteAll(ctx, "/"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for deleting everything, got %v", err)
+	}
+
+	// Delete removes the contents of a directory in bulk as well.
+	fake.setIntercept(nil)
+	if err := s3Storage.Delete(ctx, "certificates/other"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", "test/certificates/other/other.example.com.crt") != nil {
+		t.Error("Expected directory contents to be deleted")
+	}
+}
+
+func TestDeleteDirectory(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.CacheTTL = caddy.Duration(time.Minute)
+
+	crt := "certificates/issuer/example.com/example.com.crt"
+	for _, key := range []string{crt, "certificates/issuer/example.com/example.com.key"} {
+		if err := s3Storage.Store(ctx, key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lists atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("list-type") == "2" {
+			lists.Add(1)
+		}
+		return false
+	})
+	if err := s3Storage.Delete(ctx, "certificates/issuer/example.com/example.com.key"); err != nil {
+		t.Fatal(err)
+	}
+	if n := lists.Load(); n != 0 {
+		t.Errorf("Expected deleting a single key not to list, got %d lists", n)
+	}
+
+	// Cached values below a deleted directory are dropped.
+	if _, err := s3Storage.Load(ctx, crt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Delete(ctx, "certificates/issuer"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", s3Storage.objName(crt)) != nil {
+		t.Error("Expected directory contents to be deleted")
+	}
+	if _, err := s3Storage.Load(ctx, crt); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected deleted value not to be loaded from the cache, got %v", err)
+	}
+}
+
+func TestDeleteAllPartialFailure(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	fake.putObject("test-bucket", "test/certificates/issuer/a.crt", []byte("a"), time.Now())
+	fake.putObject("test-bucket", "test/certificates/issuer/b.crt", []byte("b"), time.Now())
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || !r.URL.Query().Has("delete") {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<DeleteResult>`+
+			`<Deleted><Key>test/certificates/issuer/a.crt</Key></Deleted>`+
+			`<Error><Key>test/certificates/issuer/b.crt</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`+
+			`</DeleteResult>`)
+		return true
+	})
+
+	deleted, err := s3Storage.DeleteAll(ctx, "certificates/issuer")
+	if err == nil || !strings.Contains(err.Error(), "test/certificates/issuer/b.crt") {
+		t.Errorf("Expected error for the object that was not deleted, got %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 object to be deleted, got %d", deleted)
+	}
+}
+
+func TestListDomains(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	for _, key := range []string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.json",
+		"certificates/acme.zerossl.com-v2-dv90/example.com/example.com.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.org/wildcard_.example.org.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/api.example.net/api.example.net.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/keyonly.example.com/keyonly.example.com.key",
+		"acme/acme-v02.api.letsencrypt.org-directory/users/admin@example.com/admin.json",
+	} {
+		if err := s3Storage.Store(ctx, key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	domains, err := s3Storage.ListDomains(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"*.example.org", "api.example.net", "example.com"}
+	if !slices.Equal(domains, expected) {
+		t.Errorf("Expected domains %v, got %v", expected, domains)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket", "replica-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StoreConcurrency = 3
+	s3Storage.ScopePrefixes = map[string]string{"ocsp": "ocsp-cache"}
+
+	keys := []string{"ocsp/example.com-ocsp"}
+	for i := range 10 {
+		keys = append(keys, fmt.Sprintf("certificates/acme/host%d.example.com/host%d.example.com.crt", i, i))
+	}
+	for _, key := range keys {
+		if err := s3Storage.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s3Storage.Lock(ctx, "certificates/acme/host0.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	fake.putObject("test-bucket", "other/unrelated.txt", []byte("other"), time.Now())
+
+	copied, err := s3Storage.Replicate(ctx, "replica-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != len(keys) {
+		t.Errorf("Expected %d objects to be copied, got %d", len(keys), copied)
+	}
+
+	var expected []string
+	for _, key := range keys {
+		name := s3Storage.objName(key)
+		expected = append(expected, name)
+		if obj := fake.object("replica-bucket", name); obj == nil || string(obj.data) != key {
+			t.Errorf("Expected %s to be replicated", name)
+		}
+	}
+	slices.Sort(expected)
+	if got := fake.keys("replica-bucket"); !slices.Equal(got, expected) {
+		t.Errorf("Expected replica objects %v, got %v", expected, got)
+	}
+}
+
+func TestCleanupLocksOnStart(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	expired := time.Now().Add(-time.Hour)
+	fake.putObject("test-bucket", "test/certificates/expired.example.com.lock", []byte(expired.Format(time.RFC3339)), expired)
+	fake.putObject("test-bucket", "test/certificates/fresh.example.com.lock", []byte(time.Now().Format(time.RFC3339)), time.Now())
+	fake.putObject("test-bucket", "test/certificates/expired.example.com/expired.example.com.crt", []byte("cert"), expired)
+
+	s3Storage := &S3{
+		Host:                fake.host(),
+		Bucket:              "test-bucket",
+		AccessKey:           "test",
+		SecretKey:           "test",
+		Prefix:              "test",
+		InsecureHosts:       []string{"127.0.0.1"},
+		CleanupLocksOnStart: true,
+		CleanupLocksAge:     caddy.Duration(10 * time.Minute),
+	}
+	err := s3Storage.Provision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"test/certificates/expired.example.com/expired.example.com.crt",
+		"test/certificates/fresh.example.com.lock",
+	}
+	if keys := fake.keys("test-bucket"); !slices.Equal(keys, expected) {
+		t.Errorf("Expected remaining objects %v, got %v", expected, keys)
+	}
+}
+
+func TestReplicateCopyOptions(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket", "replica-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ServerSideEncryption = "aws:kms"
+	s3Storage.EncryptionKey = "12345678123456781234567812345678"
+	s3Storage.StoreOriginalKey = true
+	s3Storage.ObfuscateKeys = true
+
+	key := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, key, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	fake.putObject("test-bucket", s3Storage.objName(healthKey), []byte("ok"), time.Now())
+
+	var (
+		mu     sync.Mutex
+		copies = map[string]http.Header{}
+	)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			mu.Lock()
+			copies[strings.TrimPrefix(r.URL.Path, "/replica-bucket/")] = r.Header.Clone()
+			mu.Unlock()
+		}
+		return false
+	})
+	copied, err := s3Storage.Replicate(ctx, "replica-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 1 || len(copies) != 1 {
+		t.Fatalf("Expected only the value to be copied, got %d copies", copied)
+	}
+	h, ok := copies[s3Storage.objName(key)]
+	if !ok {
+		t.Fatalf("Expected %s to be copied, got %v", s3Storage.objName(key), slices.Collect(maps.Keys(copies)))
+	}
+	if got := h.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+		t.Errorf("Expected copy to use SSE-KMS, got %q", got)
+	}
+	if got := h.Get("X-Amz-Meta-Certmagic-Key"); got != key {
+		t.Errorf("Expected copy to carry the logical key, got %q", got)
+	}
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricLabelName matches valid Prometheus label names.
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricLabels returns the labels attached to every metric of this
+// storage: MetricLabels, plus MetricPrefixLabel set to the storage prefix.
+func (s3 *S3) metricLabels() map[string]string {
+	labels := maps.Clone(s3.MetricLabels)
+	if s3.MetricPrefixLabel != "" {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[s3.MetricPrefixLabel] = strings.Trim(s3.keyPrefix(""), "/")
+	}
+	return labels
+}
+
+// storageMetrics are the Prometheus metrics of the storage operations. They
+// are labeled by operation and status only, never by key, to keep the
+// number of series bounded.
+type storageMetrics struct {
+	operations *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+}
+
+// registerMetrics registers the operation metrics with reg. Storages with
+// the same metric labels share their metrics.
+func (s3 *S3) registerMetrics(reg prometheus.Registerer) error {
+	labels := prometheus.Labels(s3.metricLabels())
+	m := &storageMetrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "certmagic",
+			Subsystem:   "s3",
+			Name:        "operations_total",
+			Help:        "Number of storage operations by operation and status.",
+			ConstLabels: labels,
+		}, []string{"op", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "certmagic",
+			Subsystem:   "s3",
+			Name:        "operation_duration_seconds",
+			Help:        "Duration of storage operations by operation.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"op"}),
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if err := reg.Register(m.operations); errors.As(err, &are) {
+		m.operations = are.ExistingCollector.(*prometheus.CounterVec)
+	} else if err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+	if err := reg.Register(m.duration); errors.As(err, &are) {
+		m.duration = are.ExistingCollector.(*prometheus.HistogramVec)
+	} else if err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+	s3.metrics = m
+	return nil
+}
+
+// observe records an operation that started at startedAt and returned
+// *err. Missing keys are counted separately from failures.
+func (s3 *S3) observe(op string, startedAt time.Time, err *error) {
+	if s3.metrics == nil {
+		return
+	}
+
+	status := "success"
+	switch {
+	case *err == nil:
+	case errors.Is(*err, fs.ErrNotExist):
+		status = "not_found"
+	default:
+		status = "error"
+	}
+	s3.metrics.operations.WithLabelValues(op, status).Inc()
+	s3.metrics.duration.WithLabelValues(op).Observe(time.Since(startedAt).Seconds())
+}
+
+// validateMetricLabels returns an error for label names that Prometheus
+// would reject.
+func (s3 *S3) validateMetricLabels() error {
+	for name := range s3.MetricLabels {
+		if !metricLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid metric label %q", name)
+		}
+	}
+	if s3.MetricPrefixLabel == "" {
+		return nil
+	}
+	if !metricLabelName.MatchString(s3.MetricPrefixLabel) || strings.HasPrefix(s3.MetricPrefixLabel, "__") {
+		return fmt.Errorf("invalid metric_prefix_label %q", s3.MetricPrefixLabel)
+	}
+	if _, ok := s3.MetricLabels[s3.MetricPrefixLabel]; ok {
+		return fmt.Errorf("metric_prefix_label %q is also set in metric_labels", s3.MetricPrefixLabel)
+	}
+	return nil
+}
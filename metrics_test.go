@@ -0,0 +1,116 @@
+package s3
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMetricLabels(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`s3 {
+		prefix /certs
+		metric_labels {
+			cluster eu-1
+			env prod
+		}
+		metric_prefix_label prefix
+	}`)
+	s3Storage := new(S3)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.validateMetricLabels(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"cluster": "eu-1", "env": "prod", "prefix": "certs"}
+	if labels := s3Storage.metricLabels(); !maps.Equal(labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, labels)
+	}
+	if _, ok := s3Storage.MetricLabels["prefix"]; ok {
+		t.Error("Expected configured labels to be left unchanged")
+	}
+}
+
+func TestValidateMetricLabels(t *testing.T) {
+	tests := []struct {
+		labels      map[string]string
+		prefixLabel string
+		valid       bool
+	}{
+		{labels: map[string]string{"env": "prod"}, valid: true},
+		{labels: map[string]string{"env-name": "prod"}, valid: false},
+		{labels: map[string]string{"__env": "prod"}, valid: false},
+		{prefixLabel: "1prefix", valid: false},
+		{labels: map[string]string{"prefix": "certs"}, prefixLabel: "prefix", valid: false},
+	}
+	for _, tt := range tests {
+		s3Storage := &S3{MetricLabels: tt.labels, MetricPrefixLabel: tt.prefixLabel}
+		if err := s3Storage.validateMetricLabels(); (err == nil) != tt.valid {
+			t.Errorf("%v, %q: expected valid %v, got %v", tt.labels, tt.prefixLabel, tt.valid, err)
+		}
+	}
+}
+
+func TestOperationMetrics(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	s3Storage := &S3{
+		Host:          fake.host(),
+		Bucket:        "test-bucket",
+		AccessKey:     "test",
+		SecretKey:     "test",
+		Prefix:        "test",
+		InsecureHosts: []string{"127.0.0.1"},
+		MetricLabels:  map[string]string{"cluster": "eu-1"},
+	}
+	if err := s3Storage.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, "test-key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, "missing"); err == nil {
+		t.Fatal("Expected error for a missing key")
+	}
+
+	families, err := ctx.GetMetricsRegistry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]float64{}
+	var observations uint64
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch mf.GetName() {
+			case "certmagic_s3_operations_total":
+				if labels["cluster"] != "eu-1" {
+					t.Errorf("Expected metric labels to be attached, got %v", labels)
+				}
+				counts[labels["op"]+"/"+labels["status"]] = m.GetCounter().GetValue()
+			case "certmagic_s3_operation_duration_seconds":
+				observations += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	expected := map[string]float64{"store/success": 1, "load/success": 1, "load/not_found": 1}
+	if !maps.Equal(counts, expected) {
+		t.Errorf("Expected operation counts %v, got %v", expected, counts)
+	}
+	if observations != 3 {
+		t.Errorf("Expected 3 observed durations, got %d", observations)
+	}
+}
@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// migrateLockKey is locked while MigratePrefix copies objects, so that
+// migrations of the same prefix do not run concurrently.
+const migrateLockKey = ".prefix-migration"
+
+// MigratePrefix copies all objects below the storage prefix server-side to
+// newPrefix, verifies that every copy has the size and ETag of its source
+// and then switches the storage over to newPrefix. The old objects are
+// removed afterwards if DeleteAfterMigrate is set. Objects below scope
+// prefixes and lock files are not migrated. Writes of this instance wait
+// until the switch, other instances keep using the prefix they are
+// configured with.
+func (s3 *S3) MigratePrefix(ctx context.Context, newPrefix string) error {
+	dest := joinPrefix(newPrefix)
+	if dest == "" {
+		return fmt.Errorf("invalid new prefix %q", newPrefix)
+	}
+	cur := joinPrefix(s3.keyPrefix(""))
+	if dest == cur {
+		return errors.New("new prefix equals the current prefix")
+	}
+	// Copies below the listed prefix would be listed and copied again.
+	if strings.HasPrefix(dest, cur) || strings.HasPrefix(cur, dest) {
+		return fmt.Errorf("new prefix %q must not be nested with the current prefix", newPrefix)
+	}
+	if s3.ReadOnly {
+		return fmt.Errorf("%w: migrating to %s", ErrReadOnly, newPrefix)
+	}
+
+	defer s3.inflight.track()()
+
+	if err := s3.Lock(ctx, migrateLockKey); err != nil {
+		return fmt.Errorf("locking prefix: %w", err)
+	}
+	// The lock name depends on the prefix, so it is released by name once
+	// the storage has switched over.
+	lockName := s3.objLockName(migrateLockKey)
+	defer func() {
+		if err := s3.unlockName(context.WithoutCancel(ctx), migrateLockKey, lockName); err != nil {
+			s3.Logger.Error("releasing prefix migration lock failed", s3.logKey(lockName), zap.Error(err))
+		}
+	}()
+
+	s3.migrateMu.Lock()
+	defer s3.migrateMu.Unlock()
+
+	base := s3.objName("")
+
+	var copied []minio.ObjectInfo
+	for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+		Prefix:    base,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return fmt.Errorf("listing objects: %w", obj.Err)
+		}
+		if isLockName(obj.Key) {
+			continue
+		}
+		// Objects that the current configuration would not write to this
+		// name, such as those below scope prefixes, are not migrated.
+		key, err := s3.logicalKey(obj.Key, base)
+		if err != nil || s3.objName(key) != obj.Key {
+			continue
+		}
+		rel := strings.TrimPrefix(obj.Key, base)
+
+		_, err = s3.Client.CopyObject(ctx,
+			s3.copyOptions(key, s3.Bucket, dest+rel),
+			minio.CopySrcOptions{Bucket: s3.Bucket, Object: obj.Key},
+		)
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", obj.Key, err)
+		}
+		copied = append(copied, obj)
+	}
+
+	if err := s3.verifyMigration(ctx, base, dest, copied); err != nil {
+		return err
+	}
+
+	s3.prefixMu.Lock()
+	s3.Prefix = newPrefix
+	s3.prefixMu.Unlock()
+	s3.listCache.invalidateAll()
+	s3.loadCache.invalidateAll()
+	s3.Logger.Info("migrated prefix", zap.String("from", base), zap.String("to", dest), zap.Int("copied", len(copied)))
+
+	if !s3.DeleteAfterMigrate {
+		return nil
+	}
+
+	old := make(chan minio.ObjectInfo, len(copied))
+	for _, obj := range copied {
+		old <- obj
+	}
+	close(old)
+
+	var errs []error
+	for rerr := range s3.Client.RemoveObjects(ctx, s3.Bucket, old, minio.RemoveObjectsOptions{}) {
+		errs = append(errs, fmt.Errorf("deleting %s: %w", rerr.ObjectName, rerr.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// verifyMigration checks that every object copied from base exists below
+// dest with the same size and ETag. With server-side encryption, ETags
+// differ between copies and only the sizes are compared.
+func (s3 *S3) verifyMigration(ctx context.Context, base, dest string, copied []minio.ObjectInfo) error {
+	found := make(map[string]minio.ObjectInfo)
+	for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+		Prefix:    dest,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return fmt.Errorf("listing migrated objects: %w", obj.Err)
+		}
+		found[obj.Key] = obj
+	}
+
+	var verified int
+	for _, src := range copied {
+		name := dest + strings.TrimPrefix(src.Key, base)
+		dst, ok := found[name]
+		if !ok {
+			return fmt.Errorf("verifying migration: %s is missing", name)
+		}
+		if dst.Size != src.Size || (s3.serverSideEncryption() == nil && dst.ETag != src.ETag) {
+			return fmt.Errorf("verifying migration: %s does not match %s", name, src.Key)
+		}
+		verified++
+	}
+	if verified != len(copied) {
+		return fmt.Errorf("verifying migration: %d of %d objects copied", verified, len(copied))
+	}
+	return nil
+}
+
+// holdMigration delays MigratePrefix until the returned function is
+// called, so that writes are not lost while it switches the prefix.
+func (s3 *S3) holdMigration() func() {
+	s3.migrateMu.RLock()
+	return s3.migrateMu.RUnlock
+}
@@ -0,0 +1,277 @@
+package s3
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMigratePrefix(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.DeleteAfterMigrate = true
+
+	values := map[string]string{
+		"certificates/acme/example.com/example.com.crt":  "cert",
+		"certificates/acme/example.com/example.com.key":  "key",
+		"certificates/acme/example.com/example.com.json": "meta",
+		"acme/users/admin@example.com/account.json":      "account",
+	}
+	for key, value := range values {
+		if err := s3Storage.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.putObject("test-bucket", "other/unrelated.txt", []byte("other"), time.Now())
+
+	err := s3Storage.MigratePrefix(ctx, "migrated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3Storage.Prefix != "migrated" {
+		t.Errorf("Expected prefix to be switched, got %q", s3Storage.Prefix)
+	}
+	s3Storage.locksMu.Lock()
+	if hb := s3Storage.heartbeats[migrateLockKey]; hb != nil {
+		t.Error("Expected the heartbeat of the migration lock to be stopped")
+	}
+	s3Storage.locksMu.Unlock()
+
+	for key, value := range values {
+		if name := s3Storage.objName(key); !strings.HasPrefix(name, "migrated/") {
+			t.Errorf("Expected %s to resolve below the new prefix, got %s", key, name)
+		}
+		data, err := s3Storage.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", key, err)
+		}
+		if string(data) != value {
+			t.Errorf("Load(%q) = %s, want %s", key, data, value)
+		}
+	}
+
+	for _, name := range fake.keys("test-bucket") {
+		if strings.HasPrefix(name, "test/") {
+			t.Errorf("Expected old object %s to be deleted", name)
+		}
+	}
+	if fake.object("test-bucket", "other/unrelated.txt") == nil {
+		t.Error("Expected objects outside the prefix to be kept")
+	}
+}
+
+func TestMigratePrefixSamePrefix(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	if err := s3Storage.MigratePrefix(t.Context(), "/test/"); err == nil {
+		t.Error("Expected error when migrating to the current prefix")
+	}
+}
+
+func TestMigratePrefixNormalizesPrefix(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	testKey := "certificates/acme/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"", "/", "//"} {
+		if err := s3Storage.MigratePrefix(ctx, prefix); err == nil {
+			t.Errorf("Expected error for new prefix %q", prefix)
+		}
+	}
+
+	if err := s3Storage.MigratePrefix(ctx, "/new//"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", "new/"+testKey) == nil {
+		t.Errorf("Expected object to be copied to new/, got %v", fake.keys("test-bucket"))
+	}
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil || string(data) != "cert" {
+		t.Errorf("Expected to load the migrated object, got %q, %v", data, err)
+	}
+}
+
+func TestMigratePrefixObfuscatedKeys(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.EncryptionKey = "12345678123456781234567812345678"
+	s3Storage.ObfuscateKeys = true
+
+	testKey := "certificates/acme/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3Storage.MigratePrefix(ctx, "migrated"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", s3Storage.objName(testKey)) == nil {
+		t.Fatalf("Expected obfuscated object below the new prefix, got %v", fake.keys("test-bucket"))
+	}
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil || string(data) != "cert" {
+		t.Errorf("Expected to load the migrated object, got %q, %v", data, err)
+	}
+}
+
+func TestMigratePrefixConcurrentList(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.PrefixMarker = true
+
+	if err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s3Storage.MigratePrefix(ctx, "migrated"); err != nil {
+			t.Error(err)
+		}
+	}()
+	for {
+		if _, err := s3Storage.List(ctx, "", true); err != nil {
+			t.Fatal(err)
+		}
+		_ = s3Storage.storageID()
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestMigratePrefixNested(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.Prefix = "test/acme"
+
+	for _, prefix := range []string{"test/acme/v2", "test"} {
+		if err := s3Storage.MigratePrefix(t.Context(), prefix); err == nil {
+			t.Errorf("Expected error for nested prefix %q", prefix)
+		}
+	}
+}
+
+func TestMigratePrefixCopyOptions(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ServerSideEncryption = "aws:kms"
+	s3Storage.StorageClass = "STANDARD_IA"
+	s3Storage.Tags = map[string]string{"app": "caddy"}
+
+	if err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		copies []http.Header
+	)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			mu.Lock()
+			copies = append(copies, r.Header.Clone())
+			mu.Unlock()
+		}
+		return false
+	})
+	if err := s3Storage.MigratePrefix(ctx, "migrated"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(copies) != 1 {
+		t.Fatalf("Expected one copy, got %d", len(copies))
+	}
+	h := copies[0]
+	if got := h.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+		t.Errorf("Expected copy to use SSE-KMS, got %q", got)
+	}
+	if got := h.Get("X-Amz-Storage-Class"); got != "STANDARD_IA" {
+		t.Errorf("Expected copy to use the storage class, got %q", got)
+	}
+	if got := h.Get("X-Amz-Tagging"); got != "app=caddy" {
+		t.Errorf("Expected copy to be tagged, got %q", got)
+	}
+}
+
+func TestMigratePrefixHoldsWrites(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	if err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store starting while objects are copied must not be left behind
+	// below the old prefix.
+	stored := make(chan error, 1)
+	var once sync.Once
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			once.Do(func() {
+				go func() {
+					stored <- s3Storage.Store(ctx, "certificates/example.org/example.org.crt", []byte("late"))
+				}()
+				time.Sleep(50 * time.Millisecond)
+			})
+		}
+		return false
+	})
+	if err := s3Storage.MigratePrefix(ctx, "migrated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stored; err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s3Storage.Load(ctx, "certificates/example.org/example.org.crt")
+	if err != nil || string(data) != "late" {
+		t.Errorf("Expected the store during the migration to be kept, got %q, %v", data, err)
+	}
+}
+
+func TestMigratePrefixLockTakenOver(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	if err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance takes over the lock while objects are copied.
+	lockName := s3Storage.objLockName(migrateLockKey)
+	other, _ := json.Marshal(lockFile{Owner: "other", AcquiredAt: time.Now().Truncate(time.Second)})
+	var once sync.Once
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			once.Do(func() { fake.putObject("test-bucket", lockName, other, time.Now()) })
+		}
+		return false
+	})
+	if err := s3Storage.MigratePrefix(ctx, "migrated"); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object("test-bucket", lockName)
+	if obj == nil || string(obj.data) != string(other) {
+		t.Error("Expected the lock of the other instance to be kept")
+	}
+}
@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// NotificationConfig is a bucket event notification for the objects below
+// the storage prefix.
+type NotificationConfig struct {
+	// Arn is the SNS topic, SQS queue or Lambda function notified.
+	Arn string `json:"arn"`
+	// Events lists the S3 event types to notify about. Defaults to
+	// s3:ObjectCreated:* and s3:ObjectRemoved:*.
+	Events []string `json:"events"`
+}
+
+// validateNotifications checks the configured notifications.
+func (s3 *S3) validateNotifications() error {
+	if len(s3.NotificationConfigs) == 0 {
+		return nil
+	}
+	if s3.CreateBucket == "" || s3.CreateBucket == "none" {
+		return fmt.Errorf("notification_config requires create_bucket")
+	}
+	for _, nc := range s3.NotificationConfigs {
+		arn, err := notification.NewArnFromString(nc.Arn)
+		if err != nil {
+			return fmt.Errorf("notification_config %q: %w", nc.Arn, err)
+		}
+		switch arn.Service {
+		case "sns", "sqs", "lambda":
+		default:
+			return fmt.Errorf("notification_config %q: unsupported service %q", nc.Arn, arn.Service)
+		}
+	}
+	return nil
+}
+
+// configureNotifications adds the configured notifications to those of the
+// bucket. Notifications previously added for the same prefix and ARN are
+// replaced, all others are kept. It runs once per storage.
+func (s3 *S3) configureNotifications(ctx context.Context) error {
+	if len(s3.NotificationConfigs) == 0 {
+		return nil
+	}
+
+	s3.notifyMu.Lock()
+	defer s3.notifyMu.Unlock()
+	if s3.notified {
+		return nil
+	}
+
+	cfg, err := s3.Client.GetBucketNotification(ctx, s3.Bucket)
+	if err != nil {
+		return fmt.Errorf("getting bucket notifications: %w", err)
+	}
+
+	prefix := s3.objName("")
+	for _, nc := range s3.NotificationConfigs {
+		arn, err := notification.NewArnFromString(nc.Arn)
+		if err != nil {
+			return err
+		}
+		id := "certmagic-s3 " + prefix + " " + nc.Arn
+
+		cfg.TopicConfigs = slices.DeleteFunc(cfg.TopicConfigs, func(c notification.TopicConfig) bool { return c.ID == id })
+		cfg.QueueConfigs = slices.DeleteFunc(cfg.QueueConfigs, func(c notification.QueueConfig) bool { return c.ID == id })
+		cfg.LambdaConfigs = slices.DeleteFunc(cfg.LambdaConfigs, func(c notification.LambdaConfig) bool { return c.ID == id })
+
+		c := notification.NewConfig(arn)
+		c.ID = id
+		c.AddFilterPrefix(prefix)
+		if len(nc.Events) == 0 {
+			c.AddEvents(notification.ObjectCreatedAll, notification.ObjectRemovedAll)
+		}
+		for _, event := range nc.Events {
+			c.AddEvents(notification.EventType(event))
+		}
+
+		switch strings.ToLower(arn.Service) {
+		case "sns":
+			cfg.AddTopic(c)
+		case "sqs":
+			cfg.AddQueue(c)
+		case "lambda":
+			cfg.AddLambda(c)
+		}
+	}
+
+	err = s3.Client.SetBucketNotification(ctx, s3.Bucket, cfg)
+	if err != nil {
+		return fmt.Errorf("setting bucket notifications: %w", err)
+	}
+	s3.notified = true
+	return nil
+}
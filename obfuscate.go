@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// errInvalidObfuscatedName is returned for object names that were not
+// written with the current ObfuscateKeys configuration.
+var errInvalidObfuscatedName = errors.New("invalid obfuscated object name")
+
+// nameKeys derives the keys used to obfuscate key segments from the
+// encryption key, so that they are independent of the content encryption.
+func (s3 *S3) nameKeys() (nonceKey []byte, boxKey *[32]byte) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, []byte(s3.EncryptionKey))
+		mac.Write([]byte("certmagic-s3 object name " + purpose))
+		return mac.Sum(nil)
+	}
+	boxKey = new([32]byte)
+	copy(boxKey[:], derive("encryption"))
+	return derive("nonce"), boxKey
+}
+
+// obfuscateKey encrypts every segment of key. The nonce of a segment is
+// the HMAC of its plaintext, which makes the result deterministic, so the
+// same key always maps to the same object name, while it can still be
+// decrypted for List.
+func (s3 *S3) obfuscateKey(key string) string {
+	nonceKey, boxKey := s3.nameKeys()
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		if seg == "" {
+			continue
+		}
+		mac := hmac.New(sha256.New, nonceKey)
+		mac.Write([]byte(seg))
+		var nonce [24]byte
+		copy(nonce[:], mac.Sum(nil))
+		segments[i] = base64.RawURLEncoding.EncodeToString(secretbox.Seal(nonce[:], []byte(seg), &nonce, boxKey))
+	}
+	return strings.Join(segments, "/")
+}
+
+// deobfuscateKey reverses obfuscateKey. A ".lock" suffix appended to the
+// last segment for lock files is preserved.
+func (s3 *S3) deobfuscateKey(name string) (string, error) {
+	nonceKey, boxKey := s3.nameKeys()
+	segments := strings.Split(name, "/")
+	for i, seg := range segments {
+		if seg == "" {
+			continue
+		}
+		seg, lock := strings.CutSuffix(seg, ".lock")
+		raw, err := base64.RawURLEncoding.DecodeString(seg)
+		if err != nil || len(raw) < 24 {
+			return "", errInvalidObfuscatedName
+		}
+		var nonce [24]byte
+		copy(nonce[:], raw)
+		plain, ok := secretbox.Open(nil, raw[24:], &nonce, boxKey)
+		if !ok {
+			return "", errInvalidObfuscatedName
+		}
+		// The nonce doubles as a MAC of the plaintext.
+		mac := hmac.New(sha256.New, nonceKey)
+		mac.Write(plain)
+		if !hmac.Equal(mac.Sum(nil)[:24], nonce[:]) {
+			return "", errInvalidObfuscatedName
+		}
+		segments[i] = string(plain)
+		if lock {
+			segments[i] += ".lock"
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// logicalKey returns the key of the object name with the storage prefix
+// strip removed.
+func (s3 *S3) logicalKey(name, strip string) (string, error) {
+	key := strings.TrimPrefix(name, strip)
+	if !s3.ObfuscateKeys {
+		return key, nil
+	}
+	return s3.deobfuscateKey(key)
+}
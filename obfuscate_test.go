@@ -0,0 +1,116 @@
+package s3
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestObfuscateKeyRoundTrip(t *testing.T) {
+	s3Storage := &S3{EncryptionKey: "12345678123456781234567812345678", ObfuscateKeys: true}
+
+	for _, key := range []string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+		"certificates/acme/wildcard_.example.com/wildcard_.example.com.key",
+		"acme/acme/users/default/default.json",
+		"ocsp/example.com-1234",
+		"certificates/",
+	} {
+		name := s3Storage.obfuscateKey(key)
+		if strings.Contains(name, "example") || strings.Contains(name, "certificates") {
+			t.Errorf("%s: expected obfuscated name, got %s", key, name)
+		}
+		if again := s3Storage.obfuscateKey(key); again != name {
+			t.Errorf("%s: expected deterministic name, got %s and %s", key, name, again)
+		}
+		got, err := s3Storage.deobfuscateKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != key {
+			t.Errorf("Expected %s, got %s", key, got)
+		}
+
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+		got, err = s3Storage.deobfuscateKey(name + ".lock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != key+".lock" {
+			t.Errorf("Expected lock name %s.lock, got %s", key, got)
+		}
+	}
+
+	other := &S3{EncryptionKey: "87654321876543218765432187654321", ObfuscateKeys: true}
+	if _, err := other.deobfuscateKey(s3Storage.obfuscateKey("ocsp/example.com")); err == nil {
+		t.Error("Expected names obfuscated with another key to be rejected")
+	}
+	if _, err := s3Storage.deobfuscateKey("ocsp/example.com"); err == nil {
+		t.Error("Expected plain names to be rejected")
+	}
+}
+
+func TestObfuscateKeys(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.EncryptionKey = "12345678123456781234567812345678"
+	s3Storage.ObfuscateKeys = true
+
+	keys := []string{
+		"certificates/acme/example.com/example.com.crt",
+		"certificates/acme/example.com/example.com.key",
+		"certificates/acme/wildcard_.example.org/wildcard_.example.org.crt",
+	}
+	for _, key := range keys {
+		if err := s3Storage.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s3Storage.Lock(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	defer s3Storage.Unlock(ctx, keys[0])
+
+	for _, name := range fake.keys("test-bucket") {
+		if !strings.HasPrefix(name, "test/") || strings.Contains(name, "example") {
+			t.Errorf("Expected obfuscated object name below the prefix, got %s", name)
+		}
+	}
+
+	data, err := s3Storage.Load(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != keys[0] {
+		t.Errorf("Expected %s, got %s", keys[0], data)
+	}
+
+	listed, err := s3Storage.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(listed)
+	if expected := append(slices.Clone(keys), keys[0]+".lock"); !slices.Equal(listed, slices.Sorted(slices.Values(expected))) {
+		t.Errorf("Expected %v, got %v", expected, listed)
+	}
+
+	listed, err = s3Storage.List(ctx, "certificates/acme", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(listed)
+	if expected := []string{"certificates/acme/example.com", "certificates/acme/wildcard_.example.org"}; !slices.Equal(listed, expected) {
+		t.Errorf("Expected %v, got %v", expected, listed)
+	}
+
+	domains, err := s3Storage.ListDomains(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"*.example.org", "example.com"}; !slices.Equal(domains, expected) {
+		t.Errorf("Expected domains %v, got %v", expected, domains)
+	}
+}
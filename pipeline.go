@@ -0,0 +1,245 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Transform is a single stage of a PipelineIO. Encode is applied when a
+// value is stored and Decode reverses it when the value is loaded.
+type Transform interface {
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+// TransformFunc creates a pipeline stage from the storage configuration.
+type TransformFunc func(s3 *S3) (Transform, error)
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]TransformFunc{
+		"base64":    newBase64Transform,
+		"gzip":      newGzipTransform,
+		"secretbox": newSecretBoxTransform,
+		"aesgcm":    newAESGCMTransform,
+	}
+)
+
+// RegisterTransform makes a pipeline stage available under name so it can
+// be referenced in the pipeline option. It panics if name is already taken.
+func RegisterTransform(name string, fn TransformFunc) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+
+	if name == "" || len(name) > 255 {
+		panic("invalid transform name")
+	}
+	if _, ok := transforms[name]; ok {
+		panic(fmt.Sprintf("transform already registered: %s", name))
+	}
+	transforms[name] = fn
+}
+
+// pipelineMagic starts every object written by a PipelineIO. It is followed
+// by the number of stages and their length-prefixed names in the order
+// they were applied, so objects can be decoded regardless of the current
+// configuration.
+var pipelineMagic = []byte("CMS3P\x00")
+
+// PipelineIO applies an ordered chain of transforms to stored values.
+// Objects written without a pipeline header are read with Legacy.
+type PipelineIO struct {
+	Stages []string
+	Legacy IO
+
+	s3 *S3
+
+	// stages caches the transforms by name, as creating them may involve
+	// an expensive key derivation.
+	stagesMu sync.Mutex
+	stages   map[string]Transform
+}
+
+// newPipelineIO builds the pipeline configured in s3.Pipeline.
+func (s3 *S3) newPipelineIO(legacy IO) (*PipelineIO, error) {
+	if len(s3.Pipeline) > 255 {
+		return nil, errors.New("pipeline has too many stages")
+	}
+	p := &PipelineIO{Stages: s3.Pipeline, Legacy: legacy, s3: s3, stages: map[string]Transform{}}
+	for _, name := range p.Stages {
+		if _, err := p.stage(name); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// stage returns the transform registered as name, creating it on first use.
+// Stages recorded in the header of existing objects may differ from the
+// configured ones.
+func (p *PipelineIO) stage(name string) (Transform, error) {
+	p.stagesMu.Lock()
+	defer p.stagesMu.Unlock()
+	if t, ok := p.stages[name]; ok {
+		return t, nil
+	}
+
+	transformsMu.RLock()
+	fn, ok := transforms[name]
+	transformsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown pipeline stage %q", name)
+	}
+
+	t, err := fn(p.s3)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline stage %q: %w", name, err)
+	}
+	p.stages[name] = t
+	return t, nil
+}
+
+func (p *PipelineIO) WrapReader(r io.Reader) io.Reader {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if !bytes.HasPrefix(buf, pipelineMagic) {
+		return p.Legacy.WrapReader(bytes.NewReader(buf))
+	}
+
+	names, buf, err := parsePipelineHeader(buf[len(pipelineMagic):])
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		t, err := p.stage(names[i])
+		if err != nil {
+			return Reader{nil, 0, err}
+		}
+		buf, err = t.Decode(buf)
+		if err != nil {
+			return Reader{nil, 0, fmt.Errorf("pipeline stage %q: %w", names[i], err)}
+		}
+	}
+	return bytes.NewReader(buf)
+}
+
+func (p *PipelineIO) ByteReader(buf []byte) Reader {
+	for _, name := range p.Stages {
+		t, err := p.stage(name)
+		if err == nil {
+			buf, err = t.Encode(buf)
+		}
+		if err != nil {
+			return Reader{nil, 0, err}
+		}
+	}
+
+	out := bytes.NewBuffer(append([]byte(nil), pipelineMagic...))
+	out.WriteByte(byte(len(p.Stages)))
+	for _, name := range p.Stages {
+		out.WriteByte(byte(len(name)))
+		out.WriteString(name)
+	}
+	out.Write(buf)
+	return Reader{bytes.NewReader(out.Bytes()), int64(out.Len()), nil}
+}
+
+func parsePipelineHeader(buf []byte) ([]string, []byte, error) {
+	errMalformed := errors.New("malformed pipeline header")
+	if len(buf) < 1 {
+		return nil, nil, errMalformed
+	}
+
+	names := make([]string, buf[0])
+	buf = buf[1:]
+	for i := range names {
+		if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+			return nil, nil, errMalformed
+		}
+		names[i] = string(buf[1 : 1+buf[0]])
+		buf = buf[1+buf[0]:]
+	}
+	return names, buf, nil
+}
+
+type base64Transform struct{}
+
+func newBase64Transform(*S3) (Transform, error) {
+	return base64Transform{}, nil
+}
+
+func (base64Transform) Encode(buf []byte) ([]byte, error) {
+	return base64.StdEncoding.AppendEncode(nil, buf), nil
+}
+
+func (base64Transform) Decode(buf []byte) ([]byte, error) {
+	return base64.StdEncoding.AppendDecode(nil, buf)
+}
+
+// gzipTransform prefixes its output with a flag byte recording whether the
+// value was compressed, since the input of later stages may start with the
+// gzip magic bytes by chance.
+type gzipTransform struct {
+	minSize int
+}
+
+func newGzipTransform(s3 *S3) (Transform, error) {
+	return gzipTransform{minSize: s3.CompressionMinSize}, nil
+}
+
+func (gt gzipTransform) Encode(buf []byte) ([]byte, error) {
+	if len(buf) > gt.minSize {
+		zbuf, err := gzipCompress(buf)
+		if err != nil {
+			return nil, err
+		}
+		if len(zbuf) < len(buf) {
+			return append([]byte{1}, zbuf...), nil
+		}
+	}
+	return append([]byte{0}, buf...), nil
+}
+
+func (gt gzipTransform) Decode(buf []byte) ([]byte, error) {
+	if len(buf) < 1 {
+		return nil, errors.New("missing compression flag")
+	}
+	if buf[0] == 0 {
+		return buf[1:], nil
+	}
+	return gzipDecompress(buf[1:])
+}
+
+type ioTransform struct {
+	IO
+}
+
+func newSecretBoxTransform(s3 *S3) (Transform, error) {
+	key, err := s3.secretKey()
+	if err != nil {
+		return nil, err
+	}
+	return ioTransform{&SecretBoxIO{SecretKey: key}}, nil
+}
+
+func newAESGCMTransform(s3 *S3) (Transform, error) {
+	key, err := s3.secretKey()
+	if err != nil {
+		return nil, err
+	}
+	return ioTransform{&AESGCMIO{SecretKey: key}}, nil
+}
+
+func (t ioTransform) Encode(buf []byte) ([]byte, error) {
+	return io.ReadAll(t.ByteReader(buf))
+}
+
+func (t ioTransform) Decode(buf []byte) ([]byte, error) {
+	return io.ReadAll(t.WrapReader(bytes.NewReader(buf)))
+}
@@ -0,0 +1,136 @@
+package s3
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+type reverseTransform struct{}
+
+func (reverseTransform) Encode(buf []byte) ([]byte, error) {
+	out := slices.Clone(buf)
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (reverseTransform) Decode(buf []byte) ([]byte, error) {
+	return reverseTransform{}.Encode(buf)
+}
+
+var reverseTransforms atomic.Int32
+
+func init() {
+	RegisterTransform("test-reverse", func(*S3) (Transform, error) {
+		reverseTransforms.Add(1)
+		return reverseTransform{}, nil
+	})
+}
+
+func TestPipelineOrderings(t *testing.T) {
+	msg := bytes.Repeat([]byte("-----BEGIN CERTIFICATE-----\nMIIB\n"), 40)
+
+	for _, stages := range [][]string{
+		{},
+		{"base64", "gzip", "secretbox"},
+		{"secretbox", "gzip", "base64"},
+		{"gzip", "secretbox"},
+		{"secretbox", "gzip"},
+		{"test-reverse", "gzip", "test-reverse"},
+	} {
+		s3Storage := &S3{
+			EncryptionKey: "12345678123456781234567812345678",
+			Pipeline:      stages,
+		}
+		p, err := s3Storage.newPipelineIO(&CleartextIO{})
+		if err != nil {
+			t.Fatalf("%v: %v", stages, err)
+		}
+
+		stored, err := io.ReadAll(p.ByteReader(msg))
+		if err != nil {
+			t.Fatalf("%v: encoding failed: %v", stages, err)
+		}
+
+		// Reads must follow the header, not the current configuration.
+		s3Storage.Pipeline = []string{"base64"}
+		reader, err := s3Storage.newPipelineIO(&CleartextIO{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := io.ReadAll(reader.WrapReader(bytes.NewReader(stored)))
+		if err != nil {
+			t.Fatalf("%v: decoding failed: %v", stages, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("%v: round trip mismatch, got: %s", stages, buf)
+		}
+	}
+}
+
+func TestPipelineLegacyObjects(t *testing.T) {
+	s3Storage := &S3{
+		EncryptionKey: "12345678123456781234567812345678",
+		Pipeline:      []string{"gzip", "secretbox"},
+	}
+	legacy := &SecretBoxIO{}
+	copy(legacy.SecretKey[:], s3Storage.EncryptionKey)
+
+	p, err := s3Storage.newPipelineIO(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("stored before the pipeline was configured")
+	stored, err := io.ReadAll(legacy.ByteReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := io.ReadAll(p.WrapReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatalf("decoding legacy object failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("round trip mismatch, got: %s", buf)
+	}
+}
+
+func TestPipelineUnknownStage(t *testing.T) {
+	s3Storage := &S3{Pipeline: []string{"rot13"}}
+	_, err := s3Storage.newPipelineIO(&CleartextIO{})
+	if err == nil {
+		t.Error("Expected error for unknown pipeline stage")
+	}
+
+	s3Storage = &S3{Pipeline: []string{"secretbox"}}
+	_, err = s3Storage.newPipelineIO(&CleartextIO{})
+	if err == nil {
+		t.Error("Expected error for secretbox stage without encryption key")
+	}
+}
+
+func TestPipelineReusesStages(t *testing.T) {
+	s3Storage := &S3{Pipeline: []string{"test-reverse", "gzip"}}
+	p, err := s3Storage.newPipelineIO(&CleartextIO{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := reverseTransforms.Load()
+	for range 3 {
+		stored, err := io.ReadAll(p.ByteReader([]byte("value")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(p.WrapReader(bytes.NewReader(stored))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := reverseTransforms.Load() - before; n != 0 {
+		t.Errorf("Expected stages to be created once, got %d additional creations", n)
+	}
+}
@@ -0,0 +1,140 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrQuotaExceeded is returned by Store if the configured quota of the
+// storage is used up.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+const defaultQuotaRefresh = time.Minute
+
+// usage is a cached figure of the objects stored below the prefix. It is
+// refreshed by listing the bucket at most once per QuotaRefresh and updated
+// with every successful Store and Delete in between, so it is only an
+// estimate.
+type usage struct {
+	mu        sync.Mutex
+	objects   int64
+	bytes     int64
+	refreshed time.Time
+	measuring bool
+}
+
+// usageDelta is the change in usage caused by a single write.
+type usageDelta struct {
+	objects int64
+	bytes   int64
+}
+
+func (s3 *S3) quotaEnabled() bool {
+	return s3.MaxTotalObjects > 0 || s3.MaxTotalBytes > 0
+}
+
+// checkQuota returns ErrQuotaExceeded if storing size bytes under key would
+// exceed the configured quota. Otherwise it returns the change in usage to
+// account for with addUsage once the value is stored.
+func (s3 *S3) checkQuota(ctx context.Context, key string, size int) (usageDelta, error) {
+	if !s3.quotaEnabled() {
+		return usageDelta{}, nil
+	}
+	if err := s3.refreshUsage(ctx); err != nil {
+		return usageDelta{}, fmt.Errorf("measuring storage usage: %w", err)
+	}
+
+	// Replacing a value only changes the bytes used.
+	delta := usageDelta{objects: 1, bytes: int64(size)}
+	info, err := s3.Client.StatObject(ctx, s3.Bucket, s3.objName(key), minio.StatObjectOptions{})
+	if err == nil {
+		delta = usageDelta{bytes: int64(size) - info.Size}
+	} else if !s3.notExist(err) {
+		return usageDelta{}, err
+	}
+
+	s3.usage.mu.Lock()
+	defer s3.usage.mu.Unlock()
+
+	if s3.MaxTotalObjects > 0 && delta.objects > 0 && s3.usage.objects+delta.objects > s3.MaxTotalObjects {
+		return usageDelta{}, fmt.Errorf("%w: %d of %d objects used", ErrQuotaExceeded, s3.usage.objects, s3.MaxTotalObjects)
+	}
+	if s3.MaxTotalBytes > 0 && delta.bytes > 0 && s3.usage.bytes+delta.bytes > s3.MaxTotalBytes {
+		return usageDelta{}, fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, s3.usage.bytes, s3.MaxTotalBytes)
+	}
+	return delta, nil
+}
+
+// refreshUsage measures the usage if the cached figure is older than
+// QuotaRefresh. The bucket is listed without holding the lock, and only one
+// caller measures at a time while the others use the current estimate.
+func (s3 *S3) refreshUsage(ctx context.Context) error {
+	refresh := time.Duration(s3.QuotaRefresh)
+	if refresh <= 0 {
+		refresh = defaultQuotaRefresh
+	}
+
+	s3.usage.mu.Lock()
+	if s3.usage.measuring || time.Since(s3.usage.refreshed) <= refresh {
+		s3.usage.mu.Unlock()
+		return nil
+	}
+	s3.usage.measuring = true
+	s3.usage.mu.Unlock()
+
+	objects, bytes, err := s3.measureUsage(ctx)
+
+	s3.usage.mu.Lock()
+	defer s3.usage.mu.Unlock()
+	s3.usage.measuring = false
+	if err != nil {
+		return err
+	}
+	s3.usage.objects, s3.usage.bytes = objects, bytes
+	s3.usage.refreshed = time.Now()
+	return nil
+}
+
+// addUsage accounts for a successful write.
+func (s3 *S3) addUsage(delta usageDelta) {
+	if !s3.quotaEnabled() {
+		return
+	}
+
+	s3.usage.mu.Lock()
+	defer s3.usage.mu.Unlock()
+	s3.usage.objects += delta.objects
+	s3.usage.bytes += delta.bytes
+}
+
+// staleUsage makes the next Store measure the usage again, after writes
+// whose effect on it is unknown.
+func (s3 *S3) staleUsage() {
+	s3.usage.mu.Lock()
+	defer s3.usage.mu.Unlock()
+	s3.usage.refreshed = time.Time{}
+}
+
+func (s3 *S3) measureUsage(ctx context.Context) (objects, bytes int64, err error) {
+	for _, t := range s3.listTargets("") {
+		for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+			Prefix:    t.name,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				return 0, 0, obj.Err
+			}
+			if isLockName(obj.Key) || s3.isInternal(obj.Key) {
+				continue
+			}
+			objects++
+			bytes += obj.Size
+		}
+	}
+	return objects, bytes, nil
+}
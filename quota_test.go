@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestQuotaObjects(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MaxTotalObjects = 3
+	s3Storage.QuotaRefresh = caddy.Duration(time.Hour)
+
+	fake.putObject("test-bucket", "test/existing", []byte("data"), time.Now())
+
+	for i := range 2 {
+		err := s3Storage.Store(ctx, fmt.Sprintf("key-%d", i), []byte("data"))
+		if err != nil {
+			t.Fatalf("Expected store %d within quota to succeed, got %v", i, err)
+		}
+	}
+
+	err := s3Storage.Store(ctx, "one-too-many", []byte("data"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected quota error, got %v", err)
+	}
+	if fake.object("test-bucket", "test/one-too-many") != nil {
+		t.Error("Expected rejected object to not be written")
+	}
+}
+
+func TestQuotaBytes(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MaxTotalBytes = 20
+
+	fake.putObject("test-bucket", "test/existing", []byte("fifteen bytes!!"), time.Now())
+
+	err := s3Storage.Store(ctx, "small", []byte("12345"))
+	if err != nil {
+		t.Fatalf("Expected store within quota to succeed, got %v", err)
+	}
+
+	err = s3Storage.Store(ctx, "large", []byte("1"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected quota error, got %v", err)
+	}
+}
+
+func TestQuotaAccounting(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MaxTotalObjects = 2
+	s3Storage.QuotaRefresh = caddy.Duration(time.Hour)
+
+	// Lock files and internal objects do not count towards the quota.
+	fake.putObject("test-bucket", "test/locks/issue.lock", []byte("lock"), time.Now())
+	fake.putObject("test-bucket", s3Storage.objName(healthKey), []byte("ok"), time.Now())
+
+	for _, key := range []string{"a", "b"} {
+		if err := s3Storage.Store(ctx, key, []byte("data")); err != nil {
+			t.Fatalf("Expected store of %s within quota to succeed, got %v", key, err)
+		}
+	}
+
+	// Replacing a value does not add an object.
+	if err := s3Storage.Store(ctx, "a", []byte("new data")); err != nil {
+		t.Fatalf("Expected replacing a value to succeed, got %v", err)
+	}
+	if err := s3Storage.Store(ctx, "c", []byte("data")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected quota error, got %v", err)
+	}
+
+	// Deleting a value frees its object.
+	if err := s3Storage.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Store(ctx, "c", []byte("data")); err != nil {
+		t.Errorf("Expected store after delete to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// redact returns name, or with RedactKeys a short hash of it that still
+// allows to correlate log lines about the same object.
+func (s3 *S3) redact(name string) string {
+	if !s3.RedactKeys || name == "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// logKey returns the log field for the object name, redacted if
+// RedactKeys is set.
+func (s3 *S3) logKey(name string) zap.Field {
+	return zap.String("key", s3.redact(name))
+}
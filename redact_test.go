@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactKeys(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.RedactKeys = true
+	core, logs := observer.New(zap.DebugLevel)
+	s3Storage.Logger = zap.New(core)
+
+	testKey := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	s3Storage.Exists(ctx, testKey)
+	if _, err := s3Storage.Stat(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Unlock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Delete(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if logs.Len() < 7 {
+		t.Fatalf("Expected a message per operation, got %d", logs.Len())
+	}
+	keys := map[any]bool{}
+	for _, entry := range logs.All() {
+		for name, value := range entry.ContextMap() {
+			if s, ok := value.(string); ok && strings.Contains(s, "example.com") {
+				t.Errorf("Expected %s of %q to be redacted, got %q", name, entry.Message, s)
+			}
+		}
+		keys[entry.ContextMap()["key"]] = true
+	}
+	if !keys[s3Storage.redact(s3Storage.objName(testKey))] {
+		t.Errorf("Expected the hashed key to be logged, got %v", keys)
+	}
+
+	s3Storage.RedactKeys = false
+	if got := s3Storage.redact(s3Storage.objName(testKey)); got != s3Storage.objName(testKey) {
+		t.Errorf("Expected full key without redact_keys, got %q", got)
+	}
+}
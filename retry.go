@@ -0,0 +1,159 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// retryBaseDelay is the delay before the first retry of a failed request.
+const retryBaseDelay = 100 * time.Millisecond
+
+// isRetryable reports whether err is a transient failure that is worth
+// retrying, as opposed to a definite answer from S3 such as 403 or 404.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// isConnectionError reports whether err means that the endpoint could not
+// be reached at all, as opposed to an answer from S3.
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || minio.ToErrorResponse(err).StatusCode != 0 {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// withRetries calls fn until it succeeds or fails with an error that is
+// not retryable, at most MaxRetries more times, with exponential backoff
+// between the calls. op and name identify the call in log messages.
+func (s3 *S3) withRetries(ctx context.Context, op, name string, fn func() error) error {
+	retries := s3.MaxRetries
+	if retries <= 0 {
+		retries = defaultMaxRetries
+	}
+	maxDelay := time.Duration(s3.RetryMaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !s3.retryable(ctx, err) {
+			return err
+		}
+
+		s3.Logger.Warn("retrying after transient error", zap.String("operation", op), s3.logKey(name), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(attempt, maxDelay, s3.JitterMode)):
+		}
+	}
+}
+
+// retryable reports whether err, returned by a call made with the
+// caller's context ctx, is worth retrying. Once ctx is done, nothing is
+// retried. A deadline that expired while ctx is still live was set by
+// the operation timeouts of this module, which ends the operation unless
+// RetryOperationTimeout is set, in which case the call is retried within
+// the budget left by ctx. A RetryBudget attached to ctx is charged for
+// every retry and stops them once it is used up.
+func (s3 *S3) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var ok bool
+	if errors.Is(err, context.DeadlineExceeded) {
+		ok = s3.RetryOperationTimeout
+	} else {
+		ok = isRetryable(err)
+	}
+	if b, found := ctx.Value(retryBudgetKey{}).(*RetryBudget); ok && found {
+		return b.take()
+	}
+	return ok
+}
+
+// RetryBudget caps the retries of all storage operations made with a
+// context it is attached to, so that a burst of transient failures during
+// e.g. a certificate issuance, which performs many operations, cannot
+// block it for the sum of their retry limits.
+type RetryBudget struct {
+	left atomic.Int64
+}
+
+type retryBudgetKey struct{}
+
+// NewRetryBudget returns a budget that allows retries retries in total.
+func NewRetryBudget(retries int) *RetryBudget {
+	b := new(RetryBudget)
+	b.left.Store(int64(retries))
+	return b
+}
+
+// WithRetryBudget returns a copy of ctx that carries b.
+func WithRetryBudget(ctx context.Context, b *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, b)
+}
+
+// Remaining returns the number of retries left in the budget.
+func (b *RetryBudget) Remaining() int {
+	return int(max(b.left.Load(), 0))
+}
+
+// take charges a single retry, reporting false if the budget is used up.
+func (b *RetryBudget) take() bool {
+	return b.left.Add(-1) >= 0
+}
+
+// backoff returns the delay before retry attempt n, counted from zero. It
+// grows exponentially from retryBaseDelay and is capped at max. With jitter
+// "full" the delay is drawn from [0, d], with "equal" from [d/2, d].
+func backoff(n int, max time.Duration, jitter string) time.Duration {
+	d := retryBaseDelay
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+
+	switch jitter {
+	case "full":
+		return rand.N(d + 1)
+	case "equal":
+		return d/2 + rand.N(d-d/2+1)
+	}
+	return d
+}
@@ -0,0 +1,254 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestBackoffJitter(t *testing.T) {
+	const max = time.Second
+
+	tests := []struct {
+		jitter string
+		n      int
+		lo, hi time.Duration
+	}{
+		{"none", 0, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"none", 2, 400 * time.Millisecond, 400 * time.Millisecond},
+		{"none", 10, max, max},
+		{"", 1, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"full", 0, 0, 100 * time.Millisecond},
+		{"full", 2, 0, 400 * time.Millisecond},
+		{"full", 10, 0, max},
+		{"equal", 0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"equal", 2, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"equal", 10, max / 2, max},
+	}
+
+	for _, tt := range tests {
+		for range 100 {
+			d := backoff(tt.n, max, tt.jitter)
+			if d < tt.lo || d > tt.hi {
+				t.Fatalf("backoff(%d, %s, %q) = %s, want within [%s, %s]", tt.n, max, tt.jitter, d, tt.lo, tt.hi)
+			}
+		}
+	}
+}
+
+func TestRetryableTimeoutOrigin(t *testing.T) {
+	live := t.Context()
+	expired, cancel := context.WithTimeout(t.Context(), 0)
+	defer cancel()
+
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		err          error
+		retryTimeout bool
+		expected     bool
+	}{
+		{name: "operation timeout", ctx: live, err: context.DeadlineExceeded, expected: false},
+		{name: "operation timeout retried", ctx: live, err: context.DeadlineExceeded, retryTimeout: true, expected: true},
+		{name: "caller deadline", ctx: expired, err: context.DeadlineExceeded, retryTimeout: true, expected: false},
+		{name: "transient error", ctx: live, err: io.ErrUnexpectedEOF, expected: true},
+		{name: "transient error after caller deadline", ctx: expired, err: io.ErrUnexpectedEOF, expected: false},
+	}
+	for _, tt := range tests {
+		s3Storage := &S3{RetryOperationTimeout: tt.retryTimeout}
+		if got := s3Storage.retryable(tt.ctx, tt.err); got != tt.expected {
+			t.Errorf("%s: expected retryable %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestLockOperationTimeout(t *testing.T) {
+	defer func(interval time.Duration) { LockPollInterval = interval }(LockPollInterval)
+	LockPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		retry        bool
+		slowPuts     int32
+		callerBudget time.Duration
+		succeeds     bool
+	}{
+		{name: "aborts on operation timeout", slowPuts: 1, succeeds: false},
+		{name: "retries operation timeout", retry: true, slowPuts: 1, succeeds: true},
+		{name: "aborts on caller deadline", retry: true, slowPuts: 1000, callerBudget: 300 * time.Millisecond, succeeds: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3(t, "test-bucket")
+			s3Storage := newFakeStorage(t, fake)
+			s3Storage.WriteTimeout = caddy.Duration(50 * time.Millisecond)
+			s3Storage.RetryOperationTimeout = tt.retry
+
+			var puts atomic.Int32
+			fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method == http.MethodPut && puts.Add(1) <= tt.slowPuts {
+					select {
+					case <-time.After(200 * time.Millisecond):
+					case <-r.Context().Done():
+					}
+				}
+				return false
+			})
+
+			ctx := t.Context()
+			if tt.callerBudget > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.callerBudget)
+				defer cancel()
+			}
+			started := time.Now()
+			err := s3Storage.Lock(ctx, "key")
+			if (err == nil) != tt.succeeds {
+				t.Fatalf("Expected success %v, got %v", tt.succeeds, err)
+			}
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected deadline exceeded, got %v", err)
+			}
+			if !tt.retry && puts.Load() != 1 {
+				t.Errorf("Expected a single attempt, got %d", puts.Load())
+			}
+			if elapsed := time.Since(started); elapsed > LockTimeout {
+				t.Errorf("Expected lock to give up within the caller's budget, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	defer func(poll time.Duration) { LockPollInterval = poll }(LockPollInterval)
+	LockPollInterval = 10 * time.Millisecond
+
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ListRetryMaxDelay = caddy.Duration(10 * time.Millisecond)
+
+	var puts, lists atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.Method == http.MethodPut:
+			puts.Add(1)
+		case r.Method == http.MethodGet && r.URL.Query().Has("list-type"):
+			lists.Add(1)
+		default:
+			return false
+		}
+		writeFakeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate.")
+		return true
+	})
+
+	budget := NewRetryBudget(2)
+	ctx := WithRetryBudget(t.Context(), budget)
+
+	// The lock uses up the budget, so the listing is not retried at all,
+	// although each operation would retry more often on its own.
+	if err := s3Storage.Lock(ctx, "budget-lock"); err == nil {
+		t.Fatal("Expected lock to fail")
+	}
+	if _, err := s3Storage.List(ctx, "", true); err == nil {
+		t.Fatal("Expected list to fail")
+	}
+	if got := puts.Load(); got != 3 {
+		t.Errorf("Expected 3 lock put attempts, got %d", got)
+	}
+	if got := lists.Load(); got != 1 {
+		t.Errorf("Expected a single list attempt, got %d", got)
+	}
+	if got := budget.Remaining(); got != 0 {
+		t.Errorf("Expected budget to be used up, %d left", got)
+	}
+
+	// Without a budget, the listing is retried.
+	lists.Store(0)
+	if _, err := s3Storage.List(t.Context(), "", true); err == nil {
+		t.Fatal("Expected list to fail")
+	}
+	if got := lists.Load(); got != defaultListRetries+1 {
+		t.Errorf("Expected %d list attempts, got %d", defaultListRetries+1, got)
+	}
+}
+
+func TestStoreLoadRetries(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.RetryMaxDelay = caddy.Duration(10 * time.Millisecond)
+
+	var puts, gets atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Has("location") {
+			return false
+		}
+		var n int32
+		switch r.Method {
+		case http.MethodPut:
+			n = puts.Add(1)
+		case http.MethodGet:
+			n = gets.Add(1)
+		default:
+			return false
+		}
+		if n > 2 {
+			return false
+		}
+		switch status.Load() {
+		case http.StatusForbidden:
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		default:
+			writeFakeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate.")
+		}
+		return true
+	})
+
+	// Fails twice, then succeeds.
+	if err := s3Storage.Store(ctx, "retried-key", []byte("data")); err != nil {
+		t.Fatalf("Expected store to succeed after transient failures, got %v", err)
+	}
+	data, err := s3Storage.Load(ctx, "retried-key")
+	if err != nil {
+		t.Fatalf("Expected load to succeed after transient failures, got %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %q", data)
+	}
+	if puts.Load() != 3 || gets.Load() != 3 {
+		t.Errorf("Expected 3 put and get attempts, got %d and %d", puts.Load(), gets.Load())
+	}
+
+	// 4xx responses are not retried.
+	puts.Store(0)
+	gets.Store(0)
+	status.Store(http.StatusForbidden)
+	if err := s3Storage.Store(ctx, "retried-key", []byte("data")); err == nil {
+		t.Error("Expected store to fail")
+	}
+	if _, err := s3Storage.Load(ctx, "retried-key"); err == nil {
+		t.Error("Expected load to fail")
+	}
+	if puts.Load() != 1 || gets.Load() != 1 {
+		t.Errorf("Expected a single put and get attempt, got %d and %d", puts.Load(), gets.Load())
+	}
+
+	// Retries are limited by MaxRetries.
+	puts.Store(0)
+	status.Store(http.StatusServiceUnavailable)
+	s3Storage.MaxRetries = 1
+	if err := s3Storage.Store(ctx, "retried-key", []byte("data")); err == nil {
+		t.Error("Expected store to fail")
+	}
+	if got := puts.Load(); got != 2 {
+		t.Errorf("Expected 2 put attempts, got %d", got)
+	}
+}
@@ -2,24 +2,53 @@ package s3
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/certmagic"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type S3 struct {
 	Logger *zap.Logger
+	// LogLevel is the minimum level of the messages logged by this
+	// storage, such as "info" to leave out the per-operation debug
+	// messages. It can only raise the level of Caddy's logger.
+	LogLevel string `json:"log_level"`
+	// RedactKeys replaces object names in log messages with a hash, since
+	// they reveal the domains a server manages. Errors returned to CertMagic
+	// are not redacted. Cannot be combined with ClientTrace.
+	RedactKeys bool `json:"redact_keys"`
+
+	// Name makes the host, bucket, prefix and credentials of this storage
+	// available to other storages, which refer to it with Use. A storage
+	// must be provisioned before the storages using it, which is the case
+	// for the global storage and the storages of individual sites.
+	Name string `json:"name"`
+	// Use fills the host, bucket, prefix and credentials that are not set
+	// explicitly from the storage with the given Name.
+	Use string `json:"use"`
 
 	// S3
 	Client    *minio.Client
@@ -29,225 +58,1936 @@ type S3 struct {
 	SecretKey string `json:"secret_key"`
 	Prefix    string `json:"prefix"`
 
-	// EncryptionKey is optional. If you do not wish to encrypt your certficates and key inside the S3 bucket, leave it empty.
-	EncryptionKey string `json:"encryption_key"`
+	// Region is used to sign requests. If empty, it is looked up from the
+	// bucket location.
+	Region string `json:"region"`
+
+	// BucketLookup selects how the bucket is addressed: "path" puts it into
+	// the request path, "dns" into the hostname (virtual-hosted style), and
+	// "auto", the default, lets the client decide based on the endpoint.
+	// Some S3-compatible providers only support path-style addressing.
+	BucketLookup string `json:"bucket_lookup"`
+
+	// SessionToken is sent along with AccessKey and SecretKey when these
+	// are temporary credentials, for example from sts:AssumeRole.
+	SessionToken string `json:"session_token"`
+
+	// UseIAMRole takes the credentials from the environment instead of
+	// AccessKey and SecretKey, which is also done if both are empty. Tried
+	// in order are STS web identity (AWS_WEB_IDENTITY_TOKEN_FILE, as on
+	// EKS), the ECS container endpoint at 169.254.170.2
+	// (AWS_CONTAINER_CREDENTIALS_RELATIVE_URI) or
+	// AWS_CONTAINER_CREDENTIALS_FULL_URI, and the EC2 instance metadata
+	// service at 169.254.169.254. Provision fails if none of them returns
+	// credentials.
+	UseIAMRole bool `json:"use_iam_role"`
+
+	// Profile takes the credentials from the named profile of the AWS
+	// shared credentials file instead of AccessKey and SecretKey. The file
+	// is CredentialsFile, or AWS_SHARED_CREDENTIALS_FILE and
+	// ~/.aws/credentials if that is empty.
+	Profile         string `json:"profile"`
+	CredentialsFile string `json:"credentials_file"`
+
+	// StripBucketFromPrefix removes the bucket name from the start of Prefix
+	// instead of only warning about it.
+	StripBucketFromPrefix bool `json:"strip_bucket_from_prefix"`
+
+	// CredentialExpiryWarn enables a background check of the credentials
+	// that warns once they expire within this duration. Credentials without
+	// an expiry are only logged at debug level.
+	CredentialExpiryWarn caddy.Duration `json:"credential_expiry_warn"`
+
+	// LockAccessKey and LockSecretKey are used for lock files instead of
+	// AccessKey and SecretKey if set.
+	LockAccessKey string `json:"lock_access_key"`
+	LockSecretKey string `json:"lock_secret_key"`
+
+	// MirrorBucket is a second bucket every Store and Delete is applied to.
+	// Load falls back to it if an object is missing from Bucket. Lock files
+	// are not mirrored.
+	MirrorBucket string `json:"mirror_bucket"`
+	// MirrorRequired fails writes that could not be applied to the mirror
+	// bucket or the FallbackHost. By default such failures are only logged.
+	MirrorRequired bool `json:"mirror_required"`
+	// FallbackHost is a second, independent endpoint serving a bucket of
+	// the same name with the same credentials. Store and Delete are applied
+	// to it after Host, and Load reads from it if Host cannot be reached at
+	// all. Locks are only held on Host, so while it is down certificates
+	// can be loaded but not obtained or renewed. Writes that fail on the
+	// fallback are not repeated later, so it may lag behind Host.
+	FallbackHost string `json:"fallback_host"`
+
+	// CreateBucket creates the bucket if it is missing. With "provision" it
+	// is created when the storage is provisioned, with "lazy" on the first
+	// write. By default the bucket must already exist.
+	CreateBucket string `json:"create_bucket"`
+	// SkipBucketCheck skips checking that the bucket exists and is
+	// accessible when the storage is provisioned, for credentials that are
+	// not allowed s3:ListBucket.
+	SkipBucketCheck bool `json:"skip_bucket_check"`
+
+	// NotificationConfigs sets up bucket event notifications for the objects
+	// below the prefix when the bucket is ensured by CreateBucket.
+	NotificationConfigs []NotificationConfig `json:"notification_config"`
+	// SerializeBucketSetup lets instances provisioned at the same time take
+	// turns setting up the bucket, waiting at most BucketSetupTimeout
+	// (default 1m), so that it is only set up once.
+	SerializeBucketSetup bool           `json:"serialize_bucket_setup"`
+	BucketSetupTimeout   caddy.Duration `json:"bucket_setup_timeout"`
+
+	// Treat403AsNotExist reports objects as missing when the backend answers
+	// with 403 Forbidden, which some buckets do for missing objects if the
+	// credentials lack list permission. Off by default, since it can hide
+	// genuine permission problems.
+	Treat403AsNotExist bool `json:"treat_403_as_not_exist"`
+
+	// StrictKeyPrefix rejects keys with leading or repeated separators with
+	// ErrInvalidKey instead of normalizing them.
+	StrictKeyPrefix bool `json:"strict_key_prefix"`
+
+	// DeleteAfterMigrate makes MigratePrefix remove the objects below the
+	// old prefix once they have been copied and verified.
+	DeleteAfterMigrate bool `json:"delete_after_migrate"`
+
+	// ReadOnlyPrefixes lists object name prefixes, including the storage
+	// prefix, below which Store and Delete are rejected with ErrReadOnly.
+	// Reads and locks are not affected.
+	ReadOnlyPrefixes []string `json:"readonly_prefixes"`
+	// ReadOnly rejects all modifications of the bucket with ErrReadOnly,
+	// while Load, Exists, Stat and List work as usual. Lock and Unlock do
+	// nothing, so that a configuration can be tried against a production
+	// bucket without touching it.
+	ReadOnly bool `json:"read_only"`
+
+	// AllowKeys and DenyKeys are glob patterns as understood by path.Match,
+	// matched against the normalized key in Store, Load and Delete. If
+	// AllowKeys is set, keys must match one of its patterns. Keys matching
+	// a DenyKeys pattern are always rejected with ErrKeyNotAllowed.
+	AllowKeys []string `json:"allow_keys"`
+	DenyKeys  []string `json:"deny_keys"`
+
+	// ReadPrefixes lists historical prefixes that Load, Exists and Stat
+	// fall back to, in order, if a key is not found below its current
+	// prefix. Writes always go to the current prefix.
+	ReadPrefixes []string `json:"read_prefixes"`
+
+	// InsecureHosts lists hosts, with or without port, that are reached
+	// over plain HTTP. All other hosts require TLS.
+	InsecureHosts []string `json:"insecure_hosts"`
+
+	// Insecure reaches Host over plain HTTP regardless of InsecureHosts,
+	// for endpoints behind a load balancer that terminates TLS.
+	Insecure bool `json:"insecure"`
+
+	// DisableHTTP2 restricts connections to HTTP/1.1 for gateways that
+	// misbehave with HTTP/2.
+	DisableHTTP2 bool `json:"disable_http2"`
+	// KeepAlive sets the TCP keep-alive interval and how long idle
+	// connections are kept open. A negative value disables connection
+	// reuse. Zero keeps the client defaults.
+	KeepAlive caddy.Duration `json:"keep_alive"`
+
+	// MinTLSVersion is the minimum TLS version accepted from the S3 host,
+	// either "1.2" (default) or "1.3".
+	MinTLSVersion string `json:"min_tls_version"`
+	// ConnectTimeout limits how long establishing a connection, including
+	// the TLS handshake, may take. Zero keeps the client default of 30s.
+	ConnectTimeout caddy.Duration `json:"connect_timeout"`
+	// ProxyURL sends all requests through an HTTP proxy instead of the one
+	// configured in the environment, if any.
+	ProxyURL string `json:"proxy_url"`
+	// TLSClientCert and TLSClientKey are PEM files with a client
+	// certificate presented to hosts that require mutual TLS.
+	TLSClientCert string `json:"tls_client_cert"`
+	TLSClientKey  string `json:"tls_client_key"`
+
+	// ContextHeaders maps context keys to request headers. The string value
+	// stored under ContextKey(key) in the context of an operation is sent
+	// in the header, e.g. {"request_id": "X-Request-Id"}, to correlate S3
+	// requests with the caller. Headers starting with "X-Amz-" cannot be
+	// used, since they would have to be signed.
+	ContextHeaders map[string]string `json:"context_headers"`
+
+	// ClientTrace logs the HTTP requests and responses of the S3 client at
+	// debug level, with credentials masked.
+	ClientTrace bool `json:"client_trace"`
+
+	// MaxKeyLength is the maximum length of object names in bytes. It
+	// defaults to 1024, the limit of S3.
+	MaxKeyLength int `json:"max_key_length"`
+
+	// ScopePrefixes maps a certmagic scope, the first segment of a key such
+	// as "certificates", "acme" or "ocsp", to a prefix that replaces Prefix
+	// for all keys in that scope.
+	ScopePrefixes map[string]string `json:"scope_prefixes"`
+	// OCSPPrefix stores OCSP staples, which change far more often than
+	// certificates, below their own prefix so that a short lifecycle
+	// expiration can be applied to them. It is a shorthand for the "ocsp"
+	// entry of ScopePrefixes.
+	OCSPPrefix string `json:"ocsp_prefix"`
+
+	// MetricLabels are static labels, such as cluster or env, attached to
+	// the metrics of this storage. MetricPrefixLabel names an additional
+	// label set to the storage prefix, to break metrics down by prefix.
+	MetricLabels      map[string]string `json:"metric_labels"`
+	MetricPrefixLabel string            `json:"metric_prefix_label"`
+
+	// ObfuscateKeys encrypts every segment of the object names with a key
+	// derived from EncryptionKey, so that they do not reveal the domains
+	// certificates are stored for. The encryption is deterministic and can
+	// be reversed for List. Objects below ReadPrefixes are read by their
+	// plain names.
+	ObfuscateKeys bool `json:"obfuscate_keys"`
+
+	// PrefixMarker creates a zero-byte object named after the prefix so
+	// that S3 consoles show the storage as a folder.
+	PrefixMarker bool `json:"prefix_marker"`
+
+	// EncryptionKey is optional. If you do not wish to encrypt your certficates and key inside the S3 bucket, leave it empty.
+	EncryptionKey string `json:"encryption_key"`
+	// EncryptionAlgorithm selects how values are encrypted with the
+	// EncryptionKey, either "secretbox" (NaCl secretbox, the default) or
+	// "aesgcm" (AES-256-GCM). Objects are not marked with the algorithm,
+	// so it cannot be changed for existing objects.
+	EncryptionAlgorithm string `json:"encryption_algorithm"`
+	// EncryptionKeyDerivation derives the key from the EncryptionKey as a
+	// passphrase of any length, with "argon2id" or "scrypt". Without it the
+	// EncryptionKey must have exactly 32 bytes.
+	//
+	// The key is derived with EncryptionKeySalt, or a fixed salt if it is
+	// empty. The salt is not stored with the objects, so changing it or the
+	// derivation makes existing objects impossible to decrypt.
+	EncryptionKeyDerivation string `json:"encryption_key_derivation"`
+	EncryptionKeySalt       string `json:"encryption_key_salt"`
+	// AllowCleartextFallbackOnDecryptError is a break-glass option for
+	// recovering after a key loss or from objects that predate encryption.
+	// Load then returns the raw object if it cannot be decrypted, logging
+	// an error each time, instead of failing. Never enable it permanently.
+	AllowCleartextFallbackOnDecryptError bool `json:"allow_cleartext_fallback_on_decrypt_error"`
+	// EncryptLocks also encrypts the contents of lock files.
+	EncryptLocks bool `json:"encrypt_locks"`
+	// SkipInitialLockRead saves the read of an existing lock file at the
+	// start of Lock. The lock file is then written right away, and an
+	// existing lock is only detected by the conditional write failing.
+	SkipInitialLockRead bool `json:"skip_initial_lock_read"`
+	// UnconditionalLocks writes lock files without If-None-Match and
+	// If-Match preconditions, for backends that reject them. Two instances
+	// that read the lock at the same time may then both acquire it, so
+	// locking only guards against contention that is not simultaneous.
+	// Cannot be combined with SkipInitialLockRead.
+	UnconditionalLocks bool `json:"unconditional_locks"`
+	// EmitEvents emits a "lock_stolen" Caddy event whenever a stale lock is
+	// replaced, in addition to the warning that is always logged.
+	EmitEvents bool `json:"emit_events"`
+	// ExposeLocks lists the lock files of this storage at
+	// /s3-storage/locks of the Caddy admin API.
+	ExposeLocks bool `json:"expose_locks"`
+	// ExposeHealth reports the result of Ping for this storage at
+	// /s3-storage/health of the Caddy admin API, or of HealthCheck if the
+	// request sets deep=true.
+	ExposeHealth bool `json:"expose_health"`
+	// HealthCheckTimeout bounds Ping, including the bucket check during
+	// Provision, so that an unreachable endpoint fails fast. Defaults to
+	// five seconds.
+	HealthCheckTimeout caddy.Duration `json:"health_check_timeout"`
+	// FairLocking makes contenders for a lock queue up and acquire it in
+	// order of arrival instead of racing for it. Lock waits in the queue for
+	// up to LockTimeout.
+	FairLocking bool `json:"fair_locking"`
+
+	// CleanupLocksOnStart removes lock files older than CleanupLocksAge
+	// (default and minimum LockExpiration) when the storage is provisioned,
+	// clearing locks left behind by crashed instances.
+	CleanupLocksOnStart bool           `json:"cleanup_locks_on_start"`
+	CleanupLocksAge     caddy.Duration `json:"cleanup_locks_age"`
+
+	// MaxLockAge makes Unlock refuse to remove locks older than this, since
+	// other instances may already consider them stale. ForceUnlock removes
+	// them regardless. Zero disables the check.
+	MaxLockAge caddy.Duration `json:"max_lock_age"`
+	// LockTimeout, LockPollInterval and LockExpiration override the
+	// package-wide defaults of the same name for this instance.
+	LockTimeout      caddy.Duration `json:"lock_timeout"`
+	LockPollInterval caddy.Duration `json:"lock_poll_interval"`
+	LockExpiration   caddy.Duration `json:"lock_expiration"`
+	// LockHeartbeat is the interval at which the locks held by this
+	// instance are rewritten with the current time, so that they do not
+	// expire during long operations such as DNS challenges. Defaults to a
+	// third of LockExpiration, a negative value disables it.
+	LockHeartbeat caddy.Duration `json:"lock_heartbeat"`
+	// LockOwnerID identifies this instance in the lock files it writes, so
+	// that stuck locks can be traced back to their holder and only the
+	// holder can release them. Defaults to the hostname with a random
+	// suffix.
+	LockOwnerID string `json:"lock_owner_id"`
+
+	// TagByType tags every object with a "type" tag derived from its key
+	// (certificate, key, meta, lock, ocsp or other) for use in lifecycle
+	// rules and cost reports.
+	TagByType bool `json:"tag_by_type"`
+	// Tags are added to every object written, for lifecycle rules and cost
+	// allocation. LockTags are added to lock files only, overriding Tags,
+	// so that lifecycle rules can expire leftover locks independently.
+	Tags     map[string]string `json:"tags"`
+	LockTags map[string]string `json:"lock_tags"`
+	// StorageClass is the storage class of the objects written, for
+	// example STANDARD_IA. Lock files are written with LockStorageClass
+	// instead, since they are short-lived and read often. Both default to
+	// the bucket's default storage class. Archive classes are rejected,
+	// since their objects cannot be read without restoring them first.
+	StorageClass     string `json:"storage_class"`
+	LockStorageClass string `json:"lock_storage_class"`
+	// StoreOriginalKey records the certmagic key of every object in its
+	// "certmagic-key" user metadata, so objects can be mapped back to keys
+	// even if their names are derived from the key.
+	StoreOriginalKey bool `json:"store_original_key"`
+	// VerifyETag makes Load compare the MD5 of the downloaded bytes with
+	// the ETag of the object and fail with ErrChecksumMismatch if they
+	// differ. Objects whose ETag is not an MD5 of their content, such as
+	// multipart uploads or objects encrypted with SSE-KMS or SSE-C, are not
+	// verified.
+	VerifyETag bool `json:"verify_etag"`
+
+	// VerifyAfterStore makes Store read every object back after writing it
+	// and compare the decoded value, to catch writes that a backend
+	// acknowledged but did not persist.
+	VerifyAfterStore bool `json:"verify_after_store"`
+	// WriteChecksumSidecar stores the hex encoded SHA-256 digest of the
+	// plaintext value of every key in an object named after it with a
+	// ".sha256" suffix, for tools that verify objects without decrypting
+	// them. Sidecars are removed along with their key and not listed.
+	WriteChecksumSidecar bool `json:"write_checksum_sidecar"`
+
+	// DetectConcurrentStore makes Store write conditionally on the ETag the
+	// object had before, so that an interleaved write by another instance
+	// is detected and logged before it is overwritten. RejectConcurrentStore
+	// fails the later write with ErrStoreConflict instead.
+	DetectConcurrentStore bool `json:"detect_concurrent_store"`
+	RejectConcurrentStore bool `json:"reject_concurrent_store"`
+
+	// ServerSideEncryption requests server-side encryption of all objects,
+	// either "AES256" for SSE-S3 or "aws:kms" for SSE-KMS, independent of
+	// the client-side EncryptionKey. SSE-KMS uses the KMS key SSEKMSKeyID
+	// or the default key of the bucket, and SSEKMSBucketKey additionally
+	// enables an S3 Bucket Key to reduce KMS request costs.
+	ServerSideEncryption string `json:"server_side_encryption"`
+	SSEKMSKeyID          string `json:"sse_kms_key_id"`
+	SSEKMSBucketKey      bool   `json:"sse_kms_bucket_key"`
+
+	// Compression selects how values are compressed before they are
+	// encrypted and stored. Supported values are "none" (default) and "gzip".
+	Compression string `json:"compression"`
+	// CompressionMinSize is the size in bytes a value must exceed to be
+	// compressed. Smaller values are stored uncompressed.
+	CompressionMinSize int `json:"compression_min_size"`
+
+	// CompressConfigKeys gzip-compresses config blobs such as Caddy's
+	// autosave.json or keys below "config/" when they are routed through
+	// the storage, even if Compression is not enabled. Certificates, keys
+	// and all other values are stored as before.
+	CompressConfigKeys bool `json:"compress_config_keys"`
+
+	// Pipeline is an ordered list of transforms applied to values before
+	// they are stored, for example ["gzip", "secretbox"]. Each object records
+	// the stages it was written with, so reads do not depend on the current
+	// order. Objects without that record are read using the encryption and
+	// compression options above. Further stages can be added with
+	// RegisterTransform.
+	Pipeline []string `json:"pipeline"`
+
+	// ListCacheTTL caches the results of List for this long. Writes through
+	// this storage invalidate the affected results right away, writes by
+	// other instances become visible once the cached results expire.
+	ListCacheTTL caddy.Duration `json:"list_cache_ttl"`
+
+	// CacheTTL caches the values returned by Load for this long, keeping at
+	// most CacheSize values (default 1000). Only certificates and keys are
+	// cached, unless CacheKeys lists path.Match patterns of the keys to
+	// cache. Lock files are never cached. As with ListCacheTTL, writes by
+	// other instances become visible once the cached values expire.
+	CacheTTL  caddy.Duration `json:"cache_ttl"`
+	CacheSize int            `json:"cache_size"`
+	CacheKeys []string       `json:"cache_keys"`
+
+	// OperationTimeout bounds every S3 call that has no more specific
+	// timeout configured. Zero means no timeout.
+	OperationTimeout caddy.Duration `json:"operation_timeout"`
+	// ReadTimeout bounds Load, Exists, Stat and List calls.
+	ReadTimeout caddy.Duration `json:"read_timeout"`
+	// WriteTimeout bounds Store, Delete and lock file writes.
+	WriteTimeout caddy.Duration `json:"write_timeout"`
+	// RetryOperationTimeout retries calls that exceeded one of the timeouts
+	// above, where the operation retries transient errors, as long as the
+	// context of the caller has not expired. By default such a timeout ends
+	// the operation.
+	RetryOperationTimeout bool `json:"retry_operation_timeout"`
+
+	// JitterMode randomizes the delay between retries and lock polls so
+	// that contending instances spread out. Supported values are "none"
+	// (default), "full" and "equal".
+	JitterMode string `json:"jitter_mode"`
+
+	// MaxRetries is the number of times the PutObject of Store and the
+	// GetObject of Load are retried after a transient error such as a 5xx
+	// response or a connection reset, 3 by default. The delay between
+	// retries grows exponentially up to RetryMaxDelay, 5s by default.
+	MaxRetries    int            `json:"max_retries"`
+	RetryMaxDelay caddy.Duration `json:"retry_max_delay"`
+
+	// ListRetries is the number of times a listing throttled or interrupted
+	// by a transient error is resumed after the last key received. It
+	// defaults to 3, with the delay between attempts growing up to
+	// ListRetryMaxDelay, 5s by default.
+	ListRetries       int            `json:"list_retries"`
+	ListRetryMaxDelay caddy.Duration `json:"list_retry_max_delay"`
+
+	// MaxTotalObjects and MaxTotalBytes set a soft quota on the objects
+	// below the prefix. Store fails with ErrQuotaExceeded once it is used up.
+	// Usage is measured at most once per QuotaRefresh (default one minute)
+	// and estimated in between. Zero disables the respective limit.
+	MaxTotalObjects int64          `json:"max_total_objects"`
+	MaxTotalBytes   int64          `json:"max_total_bytes"`
+	QuotaRefresh    caddy.Duration `json:"quota_refresh"`
+
+	// ShutdownGrace is how long Cleanup waits for in-flight writes and
+	// lock operations to finish. Defaults to 5 seconds.
+	ShutdownGrace caddy.Duration `json:"shutdown_grace"`
+
+	// StoreConcurrency limits the number of concurrent uploads of
+	// StoreMany. Defaults to 8.
+	StoreConcurrency int `json:"store_concurrency"`
+
+	iowrap   IO
+	configIO IO
+	inflight inflight
+	usage    usage
+	emit     func(name string, data map[string]any)
+	metrics  *storageMetrics
+
+	// lockCli is the client for lock files if separate lock credentials
+	// are configured.
+	lockCli *minio.Client
+	// fallbackCli is the client for FallbackHost.
+	fallbackCli *minio.Client
+
+	listCache listCache
+	loadCache loadCache
+
+	// notifyMu guards notified, which is set once the bucket notifications
+	// have been configured.
+	notifyMu sync.Mutex
+	notified bool
+
+	// prefixMu guards Prefix while MigratePrefix switches it.
+	prefixMu sync.RWMutex
+	// migrateMu is held by MigratePrefix from listing the objects until the
+	// switch and shared by writes, so no write is lost in between.
+	migrateMu sync.RWMutex
+
+	// locks records when this instance wrote the locks it holds.
+	locksMu sync.Mutex
+	locks   map[string]time.Time
+	// heartbeats renew the locks this instance holds, see LockHeartbeat.
+	heartbeats map[string]*heartbeat
+
+	// credStop ends the credential check started if CredentialExpiryWarn
+	// is set.
+	credStop chan struct{}
+}
+
+func init() {
+	caddy.RegisterModule(new(S3))
+}
+
+func (s3 *S3) Provision(context caddy.Context) error {
+	s3.Logger = context.Logger(s3)
+	if s3.LogLevel != "" {
+		level, err := zapcore.ParseLevel(s3.LogLevel)
+		if err != nil {
+			return fmt.Errorf("invalid log_level %q: %v", s3.LogLevel, err)
+		}
+		if level > zapcore.LevelOf(s3.Logger.Core()) {
+			s3.Logger = s3.Logger.WithOptions(zap.IncreaseLevel(level))
+		}
+	}
+	if s3.RedactKeys && s3.ClientTrace {
+		return errors.New("redact_keys cannot be combined with client_trace")
+	}
+	if s3.ReadOnly {
+		switch {
+		case s3.CreateBucket == "provision":
+			return errors.New("read_only cannot be combined with create_bucket")
+		case s3.PrefixMarker:
+			return errors.New("read_only cannot be combined with prefix_marker")
+		case s3.CleanupLocksOnStart:
+			return errors.New("read_only cannot be combined with cleanup_locks_on_start")
+		}
+	}
+
+	if err := s3.resolveShared(); err != nil {
+		return err
+	}
+	if s3.Prefix == "" {
+		s3.Prefix = defaultPrefix
+	}
+	s3.checkBucketPrefix()
+	if err := s3.applyOCSPPrefix(); err != nil {
+		return err
+	}
+	if err := s3.checkPrefixLength(); err != nil {
+		return err
+	}
+	if s3.LockOwnerID == "" {
+		s3.LockOwnerID = defaultLockOwnerID()
+	}
+
+	for _, pattern := range slices.Concat(s3.AllowKeys, s3.DenyKeys, s3.CacheKeys) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+		}
+	}
+	if err := s3.validateContextHeaders(); err != nil {
+		return err
+	}
+
+	switch s3.CreateBucket {
+	case "", "none", "lazy", "provision":
+	default:
+		return fmt.Errorf("unsupported create_bucket mode %q", s3.CreateBucket)
+	}
+	if s3.UnconditionalLocks && s3.SkipInitialLockRead {
+		return errors.New("unconditional_locks cannot be combined with skip_initial_lock_read")
+	}
+	if s3.lockPollInterval() >= s3.lockTimeout() {
+		return fmt.Errorf("lock_poll_interval %s must be shorter than lock_timeout %s", s3.lockPollInterval(), s3.lockTimeout())
+	}
+	if s3.CleanupLocksAge > 0 && time.Duration(s3.CleanupLocksAge) < s3.lockExpiration() {
+		return fmt.Errorf("cleanup_locks_age %s must not be shorter than lock_expiration %s", time.Duration(s3.CleanupLocksAge), s3.lockExpiration())
+	}
+	if s3.ObfuscateKeys && s3.EncryptionKey == "" {
+		return errors.New("obfuscate_keys requires an encryption_key")
+	}
+	if err := s3.validateMetricLabels(); err != nil {
+		return err
+	}
+	if err := s3.validateSSE(); err != nil {
+		return err
+	}
+	if err := s3.validateTags(); err != nil {
+		return err
+	}
+	for _, class := range []string{s3.StorageClass, s3.LockStorageClass} {
+		switch class {
+		case "GLACIER", "DEEP_ARCHIVE":
+			return fmt.Errorf("storage class %s requires restoring objects before they can be read", class)
+		}
+	}
+	if err := s3.validateNotifications(); err != nil {
+		return err
+	}
+
+	if len(s3.EncryptionKey) == 0 {
+		s3.Logger.Info("Clear text certificate storage active")
+		s3.iowrap = &CleartextIO{}
+	} else {
+		key, err := s3.secretKey()
+		if err != nil {
+			s3.Logger.Error("deriving encryption key failed", zap.Error(err))
+			return err
+		}
+		s3.Logger.Info("Encrypted certificate storage active", zap.String("algorithm", cmp.Or(s3.EncryptionAlgorithm, "secretbox")))
+		switch s3.EncryptionAlgorithm {
+		case "", "secretbox":
+			s3.iowrap = &SecretBoxIO{SecretKey: key}
+		case "aesgcm":
+			s3.iowrap = &AESGCMIO{SecretKey: key}
+		default:
+			return fmt.Errorf("unsupported encryption algorithm %q", s3.EncryptionAlgorithm)
+		}
+	}
+
+	switch s3.Compression {
+	case "", "none":
+	case "gzip":
+		s3.Logger.Info("Compressed certificate storage active", zap.Int("min_size", s3.CompressionMinSize))
+		s3.iowrap = &GzipIO{IO: s3.iowrap, MinSize: s3.CompressionMinSize}
+	default:
+		return fmt.Errorf("unsupported compression %q", s3.Compression)
+	}
+
+	switch s3.JitterMode {
+	case "", "none", "full", "equal":
+	default:
+		return fmt.Errorf("unsupported jitter mode %q", s3.JitterMode)
+	}
+
+	if len(s3.Pipeline) > 0 {
+		s3.Logger.Info("Storage pipeline active", zap.Strings("stages", s3.Pipeline))
+		p, err := s3.newPipelineIO(s3.iowrap)
+		if err != nil {
+			return err
+		}
+		s3.iowrap = p
+	}
+	s3.setupConfigIO()
+
+	// S3 Client
+	useProfile := s3.Profile != "" || s3.CredentialsFile != ""
+	useIAM := !useProfile && (s3.UseIAMRole || (s3.AccessKey == "" && s3.SecretKey == ""))
+	creds := credentials.NewStaticV4(s3.AccessKey, s3.SecretKey, s3.SessionToken)
+	switch {
+	case useProfile:
+		creds = credentials.NewFileAWSCredentials(s3.CredentialsFile, s3.Profile)
+	case useIAM:
+		creds = credentials.NewIAM("")
+	}
+	client, err := s3.newClient(creds)
+
+	if err != nil {
+		return err
+	}
+
+	s3.Client = client
+
+	// Without this check, unreachable metadata endpoints or missing
+	// profiles would only show up as failing requests once the storage is
+	// used.
+	switch {
+	case useProfile:
+		if _, err := client.GetCreds(); err != nil {
+			return fmt.Errorf("loading credentials of profile %q: %w", cmp.Or(s3.Profile, "default"), err)
+		}
+	case useIAM:
+		if _, err := client.GetCreds(); err != nil {
+			return fmt.Errorf("retrieving IAM role credentials: %w", err)
+		}
+	}
+
+	if s3.LockAccessKey != "" {
+		s3.lockCli, err = s3.newClient(credentials.NewStaticV4(s3.LockAccessKey, s3.LockSecretKey, ""))
+		if err != nil {
+			return err
+		}
+	}
+	if s3.FallbackHost != "" {
+		s3.fallbackCli, err = s3.newClientFor(s3.FallbackHost, s3.useTLS(), creds)
+		if err != nil {
+			return fmt.Errorf("creating client for fallback_host: %w", err)
+		}
+	}
+	s3.setClientTrace()
+	if s3.CredentialExpiryWarn > 0 {
+		s3.watchCredentials()
+	}
+
+	switch s3.CreateBucket {
+	case "", "none":
+		if !s3.SkipBucketCheck {
+			if err := s3.Ping(context); err != nil {
+				return err
+			}
+		}
+	case "lazy":
+	case "provision":
+		if err := s3.ensureBucket(context); err != nil {
+			return err
+		}
+	}
+	if err := s3.registerMetrics(context.GetMetricsRegistry()); err != nil {
+		return err
+	}
+	if s3.EmitEvents {
+		eventsAppIface, err := context.App("events")
+		if err != nil {
+			return fmt.Errorf("getting events app: %w", err)
+		}
+		events := eventsAppIface.(*caddyevents.App)
+		s3.emit = func(name string, data map[string]any) {
+			events.Emit(context, name, data)
+		}
+	}
+
+	if s3.PrefixMarker {
+		if err := s3.ensurePrefixMarker(context); err != nil {
+			return fmt.Errorf("creating prefix marker: %w", err)
+		}
+	}
+
+	// The bucket is set up last, since serialized setups take a lock that
+	// is written with the IO set up above.
+	if s3.CreateBucket == "provision" {
+		if err := s3.setupBucket(context); err != nil {
+			return err
+		}
+	}
+
+	if s3.CleanupLocksOnStart {
+		if _, err := s3.cleanupLocks(context, s3.cleanupLocksAge()); err != nil {
+			s3.Logger.Warn("cleaning up stale locks failed", zap.Error(err))
+		}
+	}
+
+	s3.register()
+	if s3.ExposeLocks {
+		s3.exposeLocks()
+	}
+	if s3.ExposeHealth {
+		s3.exposeHealth()
+	}
+
+	return nil
+}
+
+func (s3 *S3) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.s3",
+		New: func() caddy.Module {
+			return new(S3)
+		},
+	}
+}
+
+// Cleanup waits up to ShutdownGrace for in-flight operations to complete,
+// so that a reload does not leave half-written objects or orphaned locks.
+func (s3 *S3) Cleanup() error {
+	grace := time.Duration(s3.ShutdownGrace)
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+
+	if !s3.inflight.drain(grace) {
+		s3.Logger.Warn("shutdown grace period expired with operations still in flight")
+	}
+
+	s3.stopCredentials()
+	s3.stopHeartbeats()
+	s3.unexposeLocks()
+	s3.unexposeHealth()
+	s3.unregister()
+	return nil
+}
+
+// inflight counts the operations Cleanup waits for. Once draining has
+// started, new operations are no longer counted, as certmagic may keep
+// using the storage after a reload.
+type inflight struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	idle     chan struct{}
+}
+
+// track counts an operation until the returned function is called.
+func (i *inflight) track() func() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.draining {
+		return func() {}
+	}
+	i.n++
+	return func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.n--
+		if i.n == 0 && i.idle != nil {
+			close(i.idle)
+			i.idle = nil
+		}
+	}
+}
+
+// drain stops counting new operations and waits up to timeout for the
+// counted ones to finish. It reports whether all of them did.
+func (i *inflight) drain(timeout time.Duration) bool {
+	i.mu.Lock()
+	i.draining = true
+	if i.n == 0 {
+		i.mu.Unlock()
+		return true
+	}
+	if i.idle == nil {
+		i.idle = make(chan struct{})
+	}
+	idle := i.idle
+	i.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// defaultPrefix is used if no prefix is configured.
+const defaultPrefix = "acme"
+
+const defaultShutdownGrace = 5 * time.Second
+
+const defaultStoreConcurrency = 8
+
+const defaultBucketSetupTimeout = time.Minute
+
+const (
+	defaultListRetries       = 3
+	defaultListRetryMaxDelay = 5 * time.Second
+	defaultMaxRetries        = 3
+	defaultRetryMaxDelay     = 5 * time.Second
+)
+
+// ErrReadOnly is returned when modifying a key that is read-only.
+var ErrReadOnly = errors.New("storage is read-only")
+
+// ErrKeyNotAllowed is returned for keys rejected by AllowKeys or DenyKeys.
+var ErrKeyNotAllowed = errors.New("key not allowed")
+
+// ErrInvalidKey is returned for keys with an unexpected shape if
+// StrictKeyPrefix is set.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrKeyTooLong is returned for keys whose object name exceeds
+// MaxKeyLength.
+var ErrKeyTooLong = errors.New("object name too long")
+
+// maxKeyLength is the default of MaxKeyLength, which is the maximum
+// length of an S3 object key in bytes.
+const maxKeyLength = 1024
+
+func (s3 *S3) Store(ctx context.Context, key string, value []byte) (err error) {
+	defer s3.observe("store", time.Now(), &err)
+	ctx, span := s3.startSpan(ctx, "store", key)
+	defer endSpan(span, &err)
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	if err := s3.checkAllowed(key); err != nil {
+		return err
+	}
+	if err := s3.checkWritable(key); err != nil {
+		return err
+	}
+	// Lock files are only written by Lock, so that a value can never
+	// replace a held lock.
+	if isLockName(key) {
+		return fmt.Errorf("%w: %s is reserved for locks", ErrInvalidKey, key)
+	}
+	if s3.isChecksumName(key) {
+		return fmt.Errorf("%w: %s is reserved for checksums", ErrInvalidKey, key)
+	}
+
+	defer s3.inflight.track()()
+	defer s3.holdMigration()()
+
+	ctx, cancel := s3.writeContext(ctx)
+	defer cancel()
+
+	if err := s3.lazyCreateBucket(ctx); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(s3.valueIO(key).ByteReader(value))
+	if err != nil {
+		return err
+	}
+	s3.Logger.Debug("storing object", s3.logKey(s3.objName(key)), zap.Int("bytes", len(value)))
+	delta, err := s3.checkQuota(ctx, key, len(body))
+	if err != nil {
+		return err
+	}
+
+	opts := s3.putOptions(key)
+	if s3.DetectConcurrentStore || s3.RejectConcurrentStore {
+		if err := s3.setStorePrecondition(ctx, key, &opts); err != nil {
+			return err
+		}
+	}
+	var attempts int
+	err = s3.withRetries(ctx, "store", s3.objName(key), func() error {
+		attempts++
+		_, err := s3.Client.PutObject(ctx,
+			s3.Bucket,
+			s3.objName(key),
+			bytes.NewReader(body),
+			int64(len(body)),
+			opts,
+		)
+		return err
+	})
+	// A retried conditional write fails if the response to an earlier
+	// attempt that succeeded was lost, so the object is compared first.
+	if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed && attempts > 1 && s3.storedBody(ctx, key, body) {
+		err = nil
+	}
+	if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+		if s3.RejectConcurrentStore {
+			return fmt.Errorf("%w: %s", ErrStoreConflict, s3.objName(key))
+		}
+		s3.Logger.Warn("concurrent store detected, overwriting", s3.logKey(s3.objName(key)))
+		_, err = s3.Client.PutObject(ctx,
+			s3.Bucket,
+			s3.objName(key),
+			bytes.NewReader(body),
+			int64(len(body)),
+			s3.putOptions(key),
+		)
+	}
+	s3.listCache.invalidate(key)
+	s3.loadCache.invalidate(key)
+	if err != nil {
+		return err
+	}
+	if s3.VerifyAfterStore {
+		if err := s3.verifyStored(ctx, key, value); err != nil {
+			return err
+		}
+	}
+	if s3.WriteChecksumSidecar {
+		if err := s3.writeChecksum(ctx, key, value); err != nil {
+			return fmt.Errorf("writing checksum of %s: %w", s3.objName(key), err)
+		}
+	}
+	s3.addUsage(delta)
+
+	return s3.mirror(key, func(client *minio.Client, bucket string) error {
+		_, err := client.PutObject(ctx,
+			bucket,
+			s3.objName(key),
+			bytes.NewReader(body),
+			int64(len(body)),
+			s3.putOptions(key),
+		)
+		return err
+	})
+}
+
+// storedBody reports whether the object of key holds body.
+func (s3 *S3) storedBody(ctx context.Context, key string, body []byte) bool {
+	obj, err := s3.Client.GetObject(ctx, s3.Bucket, s3.objName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return false
+	}
+	defer obj.Close()
+	got, err := io.ReadAll(obj)
+	return err == nil && bytes.Equal(got, body)
+}
+
+// ErrStoreConflict is returned by Store if RejectConcurrentStore is set and
+// the object was written by someone else while it was being stored.
+var ErrStoreConflict = errors.New("concurrent store to the same key")
+
+// setStorePrecondition makes the write of key conditional on the object
+// still having its current ETag, or still not existing.
+func (s3 *S3) setStorePrecondition(ctx context.Context, key string, opts *minio.PutObjectOptions) error {
+	oi, err := s3.Client.StatObject(ctx, s3.Bucket, s3.objName(key), minio.StatObjectOptions{})
+	switch {
+	case err == nil:
+		opts.SetMatchETag(oi.ETag)
+	case s3.notExist(err):
+		opts.SetMatchETagExcept("*")
+	default:
+		return err
+	}
+	return nil
+}
+
+// StoreMany stores all items using up to StoreConcurrency concurrent
+// uploads. A failing item does not stop the others; the returned error
+// names every key that could not be stored.
+func (s3 *S3) StoreMany(ctx context.Context, items map[string][]byte) error {
+	workers := s3.StoreConcurrency
+	if workers <= 0 {
+		workers = defaultStoreConcurrency
+	}
+
+	keys := slices.Sorted(maps.Keys(items))
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := s3.Store(ctx, key, items[key]); err != nil {
+				errs[i] = fmt.Errorf("storing %s: %w", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (s3 *S3) Load(ctx context.Context, key string) (_ []byte, err error) {
+	defer s3.observe("load", time.Now(), &err)
+	ctx, span := s3.startSpan(ctx, "load", key)
+	defer endSpan(span, &err)
+	if err := s3.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := s3.checkAllowed(key); err != nil {
+		return nil, err
+	}
+	// Lock files hold timestamps, not values.
+	if isLockName(key) {
+		return nil, fs.ErrNotExist
+	}
+
+	if !s3.cacheable(key) {
+		return s3.load(ctx, key)
+	}
+	buf, generation, ok := s3.loadCache.get(key)
+	if ok {
+		return buf, nil
+	}
+	buf, err = s3.load(ctx, key)
+	if err == nil {
+		s3.loadCache.put(key, buf, generation, time.Duration(s3.CacheTTL), cmp.Or(s3.CacheSize, defaultCacheSize))
+	}
+	return buf, err
+}
+
+// load reads the value of key from the current prefix, the ReadPrefixes
+// and the MirrorBucket, in that order.
+func (s3 *S3) load(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	s3.Logger.Debug("loading object", s3.logKey(s3.objName(key)))
+	for _, name := range s3.readNames(key) {
+		buf, err := s3.loadObject(ctx, s3.Bucket, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return buf, err
+		}
+	}
+	if s3.MirrorBucket != "" {
+		return s3.loadObject(ctx, s3.MirrorBucket, s3.objName(key))
+	}
+	return nil, fs.ErrNotExist
+}
+
+// ErrStoreNotVerified is returned by Store if VerifyAfterStore is set and
+// the object read back differs from the stored value.
+var ErrStoreNotVerified = errors.New("stored object could not be verified")
+
+// verifyStored reads the object for key back and compares it with value.
+func (s3 *S3) verifyStored(ctx context.Context, key string, value []byte) error {
+	got, err := s3.loadObject(ctx, s3.Bucket, s3.objName(key))
+	if err != nil {
+		return fmt.Errorf("%w: reading back %s: %w", ErrStoreNotVerified, s3.objName(key), err)
+	}
+	if !bytes.Equal(got, value) {
+		return fmt.Errorf("%w: %s differs from the stored value", ErrStoreNotVerified, s3.objName(key))
+	}
+	return nil
+}
+
+// loadObject reads and unwraps the object name from bucket.
+func (s3 *S3) loadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	buf, err := s3.loadObjectFrom(ctx, s3.Client, bucket, name)
+	if s3.fallbackCli != nil && isConnectionError(err) {
+		s3.Logger.Warn("host unreachable, reading from fallback host", s3.logKey(name), zap.String("host", s3.Host), zap.String("fallback_host", s3.FallbackHost), zap.Error(err))
+		return s3.loadObjectFrom(ctx, s3.fallbackCli, bucket, name)
+	}
+	return buf, err
+}
+
+func (s3 *S3) loadObjectFrom(ctx context.Context, client *minio.Client, bucket, name string) ([]byte, error) {
+	var buf []byte
+	err := s3.withRetries(ctx, "load", name, func() error {
+		var err error
+		buf, err = s3.loadObjectOnce(ctx, client, bucket, name)
+		return err
+	})
+	return buf, err
+}
+
+func (s3 *S3) loadObjectOnce(ctx context.Context, client *minio.Client, bucket, name string) ([]byte, error) {
+	r, err := client.GetObject(ctx, bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		if s3.notExist(err) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	} else if r != nil {
+		// AWS (at least) doesn't return an error on key doesn't exist. We have
+		// to examine the empty object returned.
+		_, err = r.Stat()
+		if err != nil && s3.notExist(err) {
+			return nil, fs.ErrNotExist
+		}
+	}
+	defer r.Close()
+
+	if !s3.VerifyETag && !s3.AllowCleartextFallbackOnDecryptError {
+		buf, err := io.ReadAll(s3.readIO().WrapReader(r))
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if s3.VerifyETag {
+		oi, err := r.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyETag(oi, raw); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, name)
+		}
+	}
+	buf, err := io.ReadAll(s3.readIO().WrapReader(bytes.NewReader(raw)))
+	if errors.Is(err, ErrDecryptionFailed) && s3.AllowCleartextFallbackOnDecryptError {
+		s3.Logger.Error("decryption failed, returning the raw object as cleartext fallback",
+			zap.String("bucket", bucket),
+			s3.logKey(name),
+			zap.Error(err),
+		)
+		return raw, nil
+	}
+	return buf, err
+}
+
+func (s3 *S3) Delete(ctx context.Context, key string) (err error) {
+	defer s3.observe("delete", time.Now(), &err)
+	ctx, span := s3.startSpan(ctx, "delete", key)
+	defer endSpan(span, &err)
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	if err := s3.checkAllowed(key); err != nil {
+		return err
+	}
+	if err := s3.checkWritable(key); err != nil {
+		return err
+	}
+	if isLockName(key) {
+		return fmt.Errorf("%w: %s is reserved for locks", ErrInvalidKey, key)
+	}
+	s3.Logger.Debug("deleting object", s3.logKey(s3.objName(key)))
+
+	defer s3.inflight.track()()
+	defer s3.holdMigration()()
+
+	ctx, cancel := s3.writeContext(ctx)
+	defer cancel()
+	defer s3.listCache.invalidate(key)
+	defer s3.loadCache.invalidate(key)
+
+	// The key may also name a directory, whose contents are deleted in
+	// bulk. Only keys without an object of their own are listed as one.
+	info, err := s3.Client.StatObject(ctx, s3.Bucket, s3.objName(key), minio.StatObjectOptions{})
+	isDir := s3.notExist(err)
+	if err != nil && !isDir {
+		return err
+	}
+
+	dir := strings.TrimSuffix(key, "/") + "/"
+	if isDir {
+		deleted, err := s3.removeObjects(ctx, s3.Client, s3.Bucket, dir, nil)
+		if deleted > 0 {
+			s3.listCache.invalidateAll()
+			s3.staleUsage()
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		err = s3.Client.RemoveObject(ctx, s3.Bucket, s3.objName(key), minio.RemoveObjectOptions{})
+		if err != nil {
+			return err
+		}
+		s3.addUsage(usageDelta{objects: -1, bytes: -info.Size})
+		if s3.WriteChecksumSidecar {
+			if err := s3.removeChecksum(ctx, key); err != nil {
+				return fmt.Errorf("removing checksum of %s: %w", s3.objName(key), err)
+			}
+		}
+	}
+
+	return s3.mirror(key, func(client *minio.Client, bucket string) error {
+		if isDir {
+			_, err := s3.removeObjects(ctx, client, bucket, dir, nil)
+			return err
+		}
+		return client.RemoveObject(ctx, bucket, s3.objName(key), minio.RemoveObjectOptions{})
+	})
+}
+
+// mirror applies a write of key to MirrorBucket and to the bucket on
+// FallbackHost, if configured. Failures are only returned if
+// MirrorRequired is set.
+func (s3 *S3) mirror(key string, write func(client *minio.Client, bucket string) error) error {
+	type target struct {
+		client *minio.Client
+		bucket string
+		name   string
+	}
+	var targets []target
+	if s3.MirrorBucket != "" {
+		targets = append(targets, target{s3.Client, s3.MirrorBucket, "mirror bucket " + s3.MirrorBucket})
+	}
+	if s3.fallbackCli != nil {
+		targets = append(targets, target{s3.fallbackCli, s3.Bucket, "fallback host " + s3.FallbackHost})
+	}
+
+	var errs []error
+	for _, t := range targets {
+		err := write(t.client, t.bucket)
+		if err == nil {
+			continue
+		}
+		if s3.MirrorRequired {
+			errs = append(errs, fmt.Errorf("writing %s to %s: %w", key, t.name, err))
+			continue
+		}
+		s3.Logger.Warn("mirroring write failed", s3.logKey(s3.objName(key)), zap.String("target", t.name), zap.Error(err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s3 *S3) Exists(ctx context.Context, key string) bool {
+	ctx, span := s3.startSpan(ctx, "exists", key)
+	defer span.End()
+	s3.Logger.Debug("checking existence", s3.logKey(s3.objName(key)))
+	if s3.checkKey(key) != nil {
+		return false
+	}
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+	for _, name := range s3.readNames(key) {
+		_, err := s3.Client.StatObject(ctx, s3.Bucket, name, minio.StatObjectOptions{})
+		if err == nil {
+			return true
+		}
+		if !s3.notExist(err) {
+			s3.Logger.Warn("checking existence failed", s3.logKey(name), zap.Error(err))
+			return false
+		}
+	}
+	return false
+}
+
+// List returns the keys below prefix, relative to the storage prefix. If
+// recursive is false, only the direct children of prefix are returned, with
+// "directories" as a single entry each.
+func (s3 *S3) List(ctx context.Context, prefix string, recursive bool) (_ []string, err error) {
+	defer s3.observe("list", time.Now(), &err)
+	ctx, span := s3.startSpan(ctx, "list", prefix)
+	defer endSpan(span, &err)
+	keys, generation, ok := s3.listCache.get(prefix, recursive)
+	if ok && s3.ListCacheTTL > 0 {
+		return keys, nil
+	}
+
+	keys, err = s3.list(ctx, prefix, recursive)
+	if err == nil && s3.ListCacheTTL > 0 {
+		s3.listCache.put(prefix, recursive, keys, generation, time.Duration(s3.ListCacheTTL))
+	}
+	return keys, err
+}
+
+func (s3 *S3) list(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, t := range s3.listTargets(prefix) {
+		names, err := s3.listPrefix(ctx, t.name, recursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			key, err := s3.logicalKey(strings.TrimSuffix(name, "/"), t.strip)
+			if err != nil {
+				s3.Logger.Warn("skipping listed object", s3.logKey(name), zap.Error(err))
+				continue
+			}
+			if t.scope != "" && !recursive {
+				// The scope directory itself is the only direct child of
+				// the root below a scope prefix.
+				key = t.scope
+			}
+			// A listing resumed after a common prefix returns it again.
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// listTarget is an object name prefix to list, along with the storage
+// prefix to strip from the names found. scope is set for the scope
+// prefixes listed at the root.
+type listTarget struct {
+	name, strip, scope string
+}
+
+// listTargets returns the object name prefixes covering the keys below
+// prefix. At the root, these are the storage prefix and every scope
+// prefix that is not nested inside it.
+func (s3 *S3) listTargets(prefix string) []listTarget {
+	prefix = normalizeKey(prefix)
+	if prefix != "" {
+		name := s3.objName(prefix)
+		if !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		return []listTarget{{name: name, strip: s3.storagePrefix(prefix)}}
+	}
+
+	root := s3.objName("")
+	targets := []listTarget{{name: root, strip: root}}
+	for scope := range s3.ScopePrefixes {
+		p := s3.objName(scope + "/")
+		if strings.HasPrefix(p, root) || slices.ContainsFunc(targets, func(t listTarget) bool { return t.name == p }) {
+			continue
+		}
+		targets = append(targets, listTarget{name: p, strip: s3.storagePrefix(scope), scope: scope})
+	}
+	return targets
+}
+
+// ErrListFailed is returned by List if the listing could not be completed,
+// so that a partial listing is never mistaken for the complete result.
+var ErrListFailed = errors.New("listing failed")
+
+// listPrefix returns the object names below p, or the common prefixes
+// ending in "/" for "directories" if recursive is false. A listing that
+// fails with a transient error such as SlowDown is resumed after the last
+// name received.
+func (s3 *S3) listPrefix(ctx context.Context, p string, recursive bool) ([]string, error) {
+	retries := s3.ListRetries
+	if retries <= 0 {
+		retries = defaultListRetries
+	}
+	maxDelay := time.Duration(s3.ListRetryMaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = defaultListRetryMaxDelay
+	}
+
+	var names []string
+	var after string
+	for attempt := 0; ; attempt++ {
+		var err error
+		for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+			Prefix:     p,
+			Recursive:  recursive,
+			StartAfter: after,
+		}) {
+			if obj.Err != nil {
+				err = obj.Err
+				break
+			}
+			after = obj.Key
+			if s3.isInternal(obj.Key) || s3.isChecksumName(obj.Key) {
+				continue
+			}
+			names = append(names, obj.Key)
+		}
+		// The listing ends without an error if the context is done.
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			return names, nil
+		}
+		if attempt >= retries || !s3.retryable(ctx, err) {
+			return nil, fmt.Errorf("%w: %s: %w", ErrListFailed, p, err)
+		}
+
+		s3.Logger.Warn("resuming list after transient error", zap.String("prefix", s3.redact(p)), zap.String("after", s3.redact(after)), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %w", ErrListFailed, p, ctx.Err())
+		case <-time.After(backoff(attempt, maxDelay, s3.JitterMode)):
+		}
+	}
+}
+
+func (s3 *S3) Stat(ctx context.Context, key string) (_ certmagic.KeyInfo, err error) {
+	s3.Logger.Debug("stat object", s3.logKey(s3.objName(key)))
+	ctx, span := s3.startSpan(ctx, "stat", key)
+	defer endSpan(span, &err)
+
+	ki, err := s3.StatFull(ctx, key)
+	return ki.KeyInfo, err
+}
+
+// KeyInfo extends certmagic.KeyInfo with the object details returned by
+// StatFull.
+type KeyInfo struct {
+	certmagic.KeyInfo
+
+	ETag         string
+	StorageClass string
+	// Metadata holds the user metadata of the object, without the
+	// x-amz-meta- prefix.
+	Metadata map[string]string
+}
+
+// StatFull is like Stat, but also returns the ETag, storage class and user
+// metadata of the object. For a key that is not an object but has objects
+// below it, only Key is set and IsTerminal is false.
+func (s3 *S3) StatFull(ctx context.Context, key string) (KeyInfo, error) {
+	if err := s3.checkKey(key); err != nil {
+		return KeyInfo{}, err
+	}
+	ctx, cancel := s3.readContext(ctx)
+	defer cancel()
+
+	var ki KeyInfo
+	for _, name := range s3.readNames(key) {
+		oi, err := s3.Client.StatObject(ctx, s3.Bucket, name, minio.StatObjectOptions{})
+		if err != nil {
+			if s3.notExist(err) {
+				continue
+			}
+			return ki, err
+		}
+		ki.Key = key
+		ki.Size = oi.Size
+		ki.Modified = oi.LastModified
+		ki.IsTerminal = true
+		ki.ETag = oi.ETag
+		ki.StorageClass = oi.Metadata.Get("X-Amz-Storage-Class")
+		if ki.StorageClass == "" {
+			// S3 omits the storage class header for the default class.
+			ki.StorageClass = "STANDARD"
+		}
+		ki.Metadata = oi.UserMetadata
+		return ki, nil
+	}
+
+	// Without an object, the key may still name a directory, which
+	// certmagic recurses into if it is not terminal.
+	dir, err := s3.isDir(ctx, key)
+	if err != nil {
+		return ki, err
+	}
+	if dir {
+		ki.Key = key
+		return ki, nil
+	}
+	return ki, fs.ErrNotExist
+}
+
+// isDir reports whether there are objects below key. With ObfuscateKeys,
+// object names do not reflect the key hierarchy and keys are never
+// directories.
+func (s3 *S3) isDir(ctx context.Context, key string) (bool, error) {
+	if s3.ObfuscateKeys {
+		return false, nil
+	}
+	prefix := s3.objName(key)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		if !s3.isInternal(obj.Key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readNames returns the object names key is looked up under, starting
+// with the one it is written to, followed by those below ReadPrefixes.
+// Without a prefix, the name with a leading separator that earlier
+// versions wrote to is tried as well.
+func (s3 *S3) readNames(key string) []string {
+	names := []string{s3.objName(key)}
+	if s3.storagePrefix(key) == "" && !s3.ObfuscateKeys {
+		names = append(names, "/"+names[0])
+	}
+	for _, p := range s3.ReadPrefixes {
+		name := joinPrefix(p) + normalizeKey(key)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s3 *S3) objName(key string) string {
+	key = normalizeKey(key)
+	if s3.ObfuscateKeys {
+		return s3.storagePrefix(key) + s3.obfuscateKey(key)
+	}
+	return s3.storagePrefix(key) + key
+}
 
-	iowrap IO
+// storagePrefix returns the part of the object name of key in front of
+// the key itself.
+func (s3 *S3) storagePrefix(key string) string {
+	return joinPrefix(s3.keyPrefix(key))
 }
 
-func init() {
-	caddy.RegisterModule(new(S3))
+// joinPrefix returns prefix normalized like a key and followed by a single
+// separator, or nothing if prefix is empty, so that object names never
+// start with or contain an empty segment. ".." segments are kept as they
+// are, so that keys cannot reach outside of the prefix.
+func joinPrefix(prefix string) string {
+	prefix = strings.TrimRight(normalizeKey(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
 }
 
-func (s3 *S3) Provision(context caddy.Context) error {
-	s3.Logger = context.Logger(s3)
+// normalizeKey strips leading separators and collapses repeated ones, since
+// certmagic versions differ in how they join key components.
+func normalizeKey(key string) string {
+	key = strings.TrimLeft(key, "/")
+	for strings.Contains(key, "//") {
+		key = strings.ReplaceAll(key, "//", "/")
+	}
+	return key
+}
 
-	// S3 Client
-	client, err := minio.New(s3.Host, &minio.Options{
-		Creds:  credentials.NewStaticV4(s3.AccessKey, s3.SecretKey, ""),
-		Secure: true,
-	})
+// checkKey returns ErrInvalidKey if StrictKeyPrefix is set and key is not
+// already in normalized form.
+func (s3 *S3) checkKey(key string) error {
+	if s3.StrictKeyPrefix && normalizeKey(key) != key {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return s3.checkNameLength(s3.objName(key))
+}
 
-	if err != nil {
-		return err
+// checkNameLength returns ErrKeyTooLong if the object name exceeds
+// MaxKeyLength, before S3 rejects it with a less helpful error.
+func (s3 *S3) checkNameLength(name string) error {
+	limit := s3.MaxKeyLength
+	if limit <= 0 {
+		limit = maxKeyLength
 	}
+	if len(name) > limit {
+		return fmt.Errorf("%w: %d bytes exceed the limit of %d: %.64s...", ErrKeyTooLong, len(name), limit, name)
+	}
+	return nil
+}
 
-	s3.Client = client
+// checkPrefixLength returns an error if a configured prefix leaves no room
+// for keys within MaxKeyLength.
+func (s3 *S3) checkPrefixLength() error {
+	if s3.MaxKeyLength < 0 {
+		return fmt.Errorf("invalid max_key_length %d", s3.MaxKeyLength)
+	}
+	for _, prefix := range slices.Concat([]string{s3.Prefix}, slices.Collect(maps.Values(s3.ScopePrefixes))) {
+		// The shortest usable key is a single character.
+		if err := s3.checkNameLength(joinPrefix(prefix) + "x"); err != nil {
+			return fmt.Errorf("prefix %q leaves no room for keys: %w", prefix, err)
+		}
+	}
+	return nil
+}
 
-	if len(s3.EncryptionKey) == 0 {
-		s3.Logger.Info("Clear text certificate storage active")
-		s3.iowrap = &CleartextIO{}
-	} else if len(s3.EncryptionKey) != 32 {
-		s3.Logger.Error("encryption key must have exactly 32 bytes")
-		return errors.New("encryption key must have exactly 32 bytes")
-	} else {
-		s3.Logger.Info("Encrypted certificate storage active")
-		sb := &SecretBoxIO{}
-		copy(sb.SecretKey[:], []byte(s3.EncryptionKey))
-		s3.iowrap = sb
+// checkAllowed returns ErrKeyNotAllowed if key is rejected by the
+// configured allow and deny patterns.
+func (s3 *S3) checkAllowed(key string) error {
+	key = normalizeKey(key)
+	if key == healthKey {
+		return nil
+	}
+	for _, pattern := range s3.DenyKeys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return fmt.Errorf("%w: %s", ErrKeyNotAllowed, key)
+		}
+	}
+	if len(s3.AllowKeys) == 0 {
+		return nil
+	}
+	for _, pattern := range s3.AllowKeys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrKeyNotAllowed, key)
+}
+
+// checkBucketPrefix detects a Prefix that starts with the bucket name,
+// which doubles the bucket in every object path, and either warns about it
+// or strips it if StripBucketFromPrefix is set.
+func (s3 *S3) checkBucketPrefix() {
+	if s3.Bucket == "" {
+		return
 	}
+	prefix := strings.TrimPrefix(s3.Prefix, "/")
+	if prefix != s3.Bucket && !strings.HasPrefix(prefix, s3.Bucket+"/") {
+		return
+	}
+
+	if !s3.StripBucketFromPrefix {
+		s3.Logger.Warn("prefix starts with the bucket name",
+			zap.String("bucket", s3.Bucket),
+			zap.String("prefix", s3.Prefix),
+		)
+		return
+	}
+	stripped := strings.TrimPrefix(strings.TrimPrefix(prefix, s3.Bucket), "/")
+	s3.Logger.Info("stripping bucket name from prefix",
+		zap.String("bucket", s3.Bucket),
+		zap.String("prefix", s3.Prefix),
+		zap.String("stripped", stripped),
+	)
+	s3.Prefix = stripped
+}
 
+// applyOCSPPrefix adds OCSPPrefix to ScopePrefixes.
+func (s3 *S3) applyOCSPPrefix() error {
+	if s3.OCSPPrefix == "" {
+		return nil
+	}
+	if prefix, ok := s3.ScopePrefixes["ocsp"]; ok && prefix != s3.OCSPPrefix {
+		return fmt.Errorf("ocsp_prefix %q conflicts with scope prefix %q for ocsp", s3.OCSPPrefix, prefix)
+	}
+	if s3.ScopePrefixes == nil {
+		s3.ScopePrefixes = make(map[string]string)
+	}
+	s3.ScopePrefixes["ocsp"] = s3.OCSPPrefix
 	return nil
 }
 
-func (s3 *S3) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID: "caddy.storage.s3",
-		New: func() caddy.Module {
-			return new(S3)
-		},
+// keyPrefix returns the prefix configured for the scope of key.
+func (s3 *S3) keyPrefix(key string) string {
+	scope, _, _ := strings.Cut(normalizeKey(key), "/")
+	if prefix, ok := s3.ScopePrefixes[scope]; ok {
+		return prefix
 	}
+	return s3.prefix()
 }
 
-var (
-	LockExpiration   = 2 * time.Minute
-	LockPollInterval = 1 * time.Second
-	LockTimeout      = 15 * time.Second
-)
+// prefix returns Prefix, which MigratePrefix may switch at any time.
+func (s3 *S3) prefix() string {
+	s3.prefixMu.RLock()
+	defer s3.prefixMu.RUnlock()
+	return s3.Prefix
+}
 
-func (s3 *S3) Lock(ctx context.Context, key string) error {
-	s3.Logger.Info(fmt.Sprintf("Lock: %v", s3.objName(key)))
-	var startedAt = time.Now()
+func (s3 *S3) newClient(creds *credentials.Credentials) (*minio.Client, error) {
+	return s3.newClientFor(s3.Host, s3.useTLS(), creds)
+}
 
-	data, err := s3.getLockFile(ctx, key)
-	if err == nil {
-		lt, err := time.Parse(time.RFC3339, data)
-		if err == nil && lt.Add(LockTimeout).After(time.Now()) {
-			return fmt.Errorf("lock already exists and is still valid")
-		}
+// newClientFor returns a client for host with the connection options of
+// s3, using TLS if secure is set.
+func (s3 *S3) newClientFor(host string, secure bool, creds *credentials.Credentials) (*minio.Client, error) {
+	tr, err := s3.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = tr
+	if len(s3.ContextHeaders) > 0 {
+		rt = &contextHeaderTransport{base: tr, headers: s3.ContextHeaders}
+	}
+	lookup, err := s3.bucketLookup()
+	if err != nil {
+		return nil, err
 	}
+	return minio.New(host, &minio.Options{
+		Creds:        creds,
+		Region:       s3.Region,
+		Secure:       secure,
+		Transport:    rt,
+		BucketLookup: lookup,
+	})
+}
 
-	for {
-		err = s3.putLockFile(ctx, key)
-		if err == nil {
-			return nil
-		}
+// bucketLookup returns the bucket addressing style set by BucketLookup.
+func (s3 *S3) bucketLookup() (minio.BucketLookupType, error) {
+	switch s3.BucketLookup {
+	case "", "auto":
+		return minio.BucketLookupAuto, nil
+	case "path":
+		return minio.BucketLookupPath, nil
+	case "dns":
+		return minio.BucketLookupDNS, nil
+	}
+	return minio.BucketLookupAuto, fmt.Errorf("unsupported bucket_lookup %q", s3.BucketLookup)
+}
 
-		lt, err := time.Parse(time.RFC3339, data)
-		if err != nil {
-			return s3.putLockFile(ctx, key)
+// newTransport returns the default minio transport adjusted to the
+// connection options.
+func (s3 *S3) newTransport() (*http.Transport, error) {
+	tr, err := minio.DefaultTransport(s3.useTLS())
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.TLSClientConfig != nil {
+		switch s3.MinTLSVersion {
+		case "", "1.2":
+			tr.TLSClientConfig.MinVersion = tls.VersionTLS12
+		case "1.3":
+			tr.TLSClientConfig.MinVersion = tls.VersionTLS13
+		default:
+			return nil, fmt.Errorf("unsupported min_tls_version %q", s3.MinTLSVersion)
 		}
 
-		if lt.Add(LockTimeout).Before(time.Now()) {
-			return s3.putLockFile(ctx, key)
+		if s3.TLSClientCert != "" || s3.TLSClientKey != "" {
+			cert, err := tls.LoadX509KeyPair(s3.TLSClientCert, s3.TLSClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("loading TLS client certificate: %w", err)
+			}
+			tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
 		}
+	}
 
-		if startedAt.Add(LockTimeout).Before(time.Now()) {
-			return fmt.Errorf("timeout while acquiring lock")
+	if s3.ProxyURL != "" {
+		u, err := url.Parse(s3.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy_url %q", s3.ProxyURL)
 		}
+		tr.Proxy = http.ProxyURL(u)
+	}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(LockPollInterval):
-			continue
+	if s3.DisableHTTP2 {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP1(true)
+	}
+
+	switch {
+	case s3.KeepAlive < 0:
+		tr.DisableKeepAlives = true
+	case s3.KeepAlive > 0:
+		tr.IdleConnTimeout = time.Duration(s3.KeepAlive)
+	}
+	if s3.KeepAlive > 0 || s3.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if s3.KeepAlive > 0 {
+			dialer.KeepAlive = time.Duration(s3.KeepAlive)
+		}
+		if s3.ConnectTimeout > 0 {
+			dialer.Timeout = time.Duration(s3.ConnectTimeout)
+			tr.TLSHandshakeTimeout = time.Duration(s3.ConnectTimeout)
 		}
+		tr.DialContext = dialer.DialContext
 	}
+	return tr, nil
 }
 
-func (s3 *S3) getLockFile(ctx context.Context, key string) (string, error) {
-	obj, err := s3.Client.GetObject(ctx, s3.Bucket, s3.objLockName(key), minio.GetObjectOptions{})
-	if err != nil {
-		return "", err
+// lockClient returns the client used for lock files.
+func (s3 *S3) lockClient() *minio.Client {
+	if s3.lockCli != nil {
+		return s3.lockCli
 	}
+	return s3.Client
+}
 
-	defer obj.Close()
-	buf, err := io.ReadAll(obj)
-	if err != nil {
-		return "", err
+// checkWritable returns ErrReadOnly if key may not be modified.
+func (s3 *S3) checkWritable(key string) error {
+	if s3.ReadOnly || s3.readOnly(s3.objName(key)) {
+		return fmt.Errorf("%w: %s", ErrReadOnly, key)
 	}
+	return nil
+}
 
-	return string(buf), nil
+// readOnly reports whether the object name lies below a read-only prefix.
+func (s3 *S3) readOnly(name string) bool {
+	for _, p := range s3.ReadOnlyPrefixes {
+		if strings.HasPrefix(name, strings.TrimPrefix(p, "/")) {
+			return true
+		}
+	}
+	return false
 }
 
-func (s3 *S3) putLockFile(ctx context.Context, key string) error {
-	// Object does not exist, we're creating a lock file.
-	r := bytes.NewReader([]byte(time.Now().Format(time.RFC3339)))
-	_, err := s3.Client.PutObject(ctx, s3.Bucket, s3.objLockName(key), r, int64(r.Len()), minio.PutObjectOptions{})
-	return err
+// notExist reports whether err means that the requested object is missing,
+// including 403 Forbidden if Treat403AsNotExist is set.
+func (s3 *S3) notExist(err error) bool {
+	if isNotExist(err) {
+		return true
+	}
+	return s3.Treat403AsNotExist && minio.ToErrorResponse(err).StatusCode == http.StatusForbidden
 }
 
-func (s3 *S3) Unlock(ctx context.Context, key string) error {
-	s3.Logger.Info(fmt.Sprintf("Release lock: %v", s3.objName(key)))
+// isNotExist reports whether err is the response for a missing object. The
+// error code is checked as well, since not every backend sets the status of
+// errors reported while reading the object body.
+func isNotExist(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey"
+}
 
-	// Prüfe ob die Lock-Datei existiert und gültig ist
-	data, err := s3.getLockFile(ctx, key)
-	if err != nil {
-		return fmt.Errorf("lock file does not exist")
+// useTLS reports whether Host must be reached over TLS, which is the case
+// unless Insecure is set or it is listed in InsecureHosts.
+func (s3 *S3) useTLS() bool {
+	if s3.Insecure {
+		return false
 	}
+	hostname := s3.Host
+	if h, _, err := net.SplitHostPort(s3.Host); err == nil {
+		hostname = h
+	}
+	return !slices.Contains(s3.InsecureHosts, s3.Host) && !slices.Contains(s3.InsecureHosts, hostname)
+}
 
-	// Validiere den Lock-Datei-Inhalt
-	_, err = time.Parse(time.RFC3339, data)
-	if err != nil {
-		return fmt.Errorf("invalid lock file content")
+// markerName returns the name of the folder marker object for the prefix,
+// or an empty string if there is no prefix to mark.
+func (s3 *S3) markerName() string {
+	if strings.Trim(s3.prefix(), "/") == "" {
+		return ""
 	}
+	return s3.objName("")
+}
 
-	// Lösche die Lock-Datei
-	return s3.Client.RemoveObject(ctx, s3.Bucket, s3.objLockName(key), minio.RemoveObjectOptions{})
+// isInternal reports whether name is an object maintained by the storage
+// itself rather than one stored on behalf of certmagic.
+func (s3 *S3) isInternal(name string) bool {
+	return name == s3.markerName() || name == s3.objName(healthKey) || name == s3.objName(bucketSetupKey) || isQueueName(name)
 }
 
-func (s3 *S3) Store(ctx context.Context, key string, value []byte) error {
-	r := s3.iowrap.ByteReader(value)
-	s3.Logger.Info(fmt.Sprintf("Store: %v, %v bytes", s3.objName(key), len(value)))
-	_, err := s3.Client.PutObject(ctx,
-		s3.Bucket,
-		s3.objName(key),
-		r,
-		r.Len(),
-		minio.PutObjectOptions{},
-	)
+// ensurePrefixMarker creates the folder marker object if it is missing.
+func (s3 *S3) ensurePrefixMarker(ctx context.Context) error {
+	name := s3.markerName()
+	if name == "" {
+		return nil
+	}
+
+	statCtx, cancel := s3.readContext(ctx)
+	_, err := s3.Client.StatObject(statCtx, s3.Bucket, name, minio.StatObjectOptions{})
+	cancel()
+	if err == nil {
+		return nil
+	}
+	if !s3.notExist(err) {
+		return err
+	}
+
+	ctx, cancel = s3.writeContext(ctx)
+	defer cancel()
+	_, err = s3.Client.PutObject(ctx, s3.Bucket, name, bytes.NewReader(nil), 0, minio.PutObjectOptions{})
 	return err
 }
 
-func (s3 *S3) Load(ctx context.Context, key string) ([]byte, error) {
-	s3.Logger.Info(fmt.Sprintf("Load: %v", s3.objName(key)))
-	r, err := s3.Client.GetObject(ctx, s3.Bucket, s3.objName(key), minio.GetObjectOptions{})
-	if err != nil {
-		if err.Error() == "The specified key does not exist." {
-			return nil, fs.ErrNotExist
+// putOptions returns the options used to write the object for key.
+func (s3 *S3) putOptions(key string) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{ServerSideEncryption: s3.serverSideEncryption()}
+	opts.UserTags = s3.objectTags(key)
+	if keyType(key) == "lock" {
+		opts.StorageClass = s3.LockStorageClass
+	} else {
+		opts.StorageClass = s3.StorageClass
+	}
+	if s3.StoreOriginalKey {
+		opts.UserMetadata = map[string]string{"certmagic-key": key}
+	}
+	return opts
+}
+
+// copyOptions returns the options used to copy the object for key to name
+// in bucket, writing it like putOptions would.
+func (s3 *S3) copyOptions(key, bucket, name string) minio.CopyDestOptions {
+	opts := s3.putOptions(key)
+	dst := minio.CopyDestOptions{
+		Bucket:     bucket,
+		Object:     name,
+		Encryption: opts.ServerSideEncryption,
+	}
+	if opts.UserTags != nil {
+		dst.UserTags = opts.UserTags
+		dst.ReplaceTags = true
+	}
+	if opts.StorageClass != "" || opts.UserMetadata != nil {
+		dst.UserMetadata = maps.Clone(opts.UserMetadata)
+		if dst.UserMetadata == nil {
+			dst.UserMetadata = map[string]string{}
 		}
-		return nil, err
-	} else if r != nil {
-		// AWS (at least) doesn't return an error on key doesn't exist. We have
-		// to examine the empty object returned.
-		_, err = r.Stat()
-		if err != nil {
-			er := minio.ToErrorResponse(err)
-			if er.StatusCode == 404 {
-				return nil, fs.ErrNotExist
-			}
+		if opts.StorageClass != "" {
+			dst.UserMetadata["X-Amz-Storage-Class"] = opts.StorageClass
 		}
+		dst.ReplaceMetadata = true
 	}
-	defer r.Close()
-	buf, err := io.ReadAll(s3.iowrap.WrapReader(r))
-	if err != nil {
-		return nil, err
-	}
-	return buf, nil
+	return dst
 }
 
-func (s3 *S3) Delete(ctx context.Context, key string) error {
-	s3.Logger.Info(fmt.Sprintf("Delete: %v", s3.objName(key)))
-	return s3.Client.RemoveObject(ctx, s3.Bucket, s3.objName(key), minio.RemoveObjectOptions{})
+// setupConfigIO prepares the IO used for config keys if CompressConfigKeys
+// is set and values are not compressed anyway.
+func (s3 *S3) setupConfigIO() {
+	if !s3.CompressConfigKeys || s3.Compression == "gzip" || slices.Contains(s3.Pipeline, "gzip") {
+		return
+	}
+	s3.configIO = &GzipIO{IO: s3.iowrap, MinSize: s3.CompressionMinSize}
 }
 
-func (s3 *S3) Exists(ctx context.Context, key string) bool {
-	s3.Logger.Info(fmt.Sprintf("Exists: %v", s3.objName(key)))
-	_, err := s3.Client.StatObject(ctx, s3.Bucket, s3.objName(key), minio.StatObjectOptions{})
-	return err == nil
+// valueIO returns the IO used to store the value of key.
+func (s3 *S3) valueIO(key string) IO {
+	if s3.configIO != nil && keyType(key) == "config" {
+		return s3.configIO
+	}
+	return s3.iowrap
 }
 
-func (s3 *S3) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	var keys []string
-	for obj := range s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
-		Prefix:    s3.objName(""),
-		Recursive: true,
-	}) {
-		keys = append(keys, obj.Key)
+// readIO returns the IO used to read values. Since GzipIO passes values
+// that are not compressed through, it also reads all other keys.
+func (s3 *S3) readIO() IO {
+	if s3.configIO != nil {
+		return s3.configIO
 	}
-	return keys, nil
+	return s3.iowrap
 }
 
-func (s3 *S3) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	s3.Logger.Info(fmt.Sprintf("Stat: %v", s3.objName(key)))
-	var ki certmagic.KeyInfo
-	oi, err := s3.Client.StatObject(ctx, s3.Bucket, s3.objName(key), minio.StatObjectOptions{})
-	if err != nil {
-		return ki, fs.ErrNotExist
+// keyType classifies a certmagic key by the kind of data stored under it.
+func keyType(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	switch {
+	case strings.HasSuffix(key, ".lock"):
+		return "lock"
+	case strings.HasPrefix(key, "ocsp/"):
+		return "ocsp"
+	case strings.HasPrefix(key, "config/"), path.Base(key) == "autosave.json":
+		return "config"
+	}
+
+	switch path.Ext(key) {
+	case ".crt":
+		return "certificate"
+	case ".key":
+		return "key"
+	case ".json":
+		return "meta"
 	}
-	ki.Key = key
-	ki.Size = oi.Size
-	ki.Modified = oi.LastModified
-	ki.IsTerminal = true
-	return ki, nil
+	return "other"
 }
 
-func (s3 *S3) objName(key string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimPrefix(s3.Prefix, "/"), strings.TrimPrefix(key, "/"))
+// readContext derives the context for a single read call to S3.
+func (s3 *S3) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s3.ReadTimeout, s3.OperationTimeout)
+}
+
+// writeContext derives the context for a single write call to S3.
+func (s3 *S3) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s3.WriteTimeout, s3.OperationTimeout)
 }
 
-func (s3 *S3) objLockName(key string) string {
-	return s3.objName(key) + ".lock"
+func withTimeout(ctx context.Context, timeout, fallback caddy.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout))
 }
 
 // CertMagicStorage converts s to a certmagic.Storage instance.
@@ -258,6 +1998,73 @@ func (s3 *S3) CertMagicStorage() (certmagic.Storage, error) {
 func (s3 *S3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		key := d.Val()
+
+		switch key {
+		case "pipeline":
+			s3.Pipeline = d.RemainingArgs()
+			continue
+		case "notification_config":
+			nc, err := parseNotificationConfig(d)
+			if err != nil {
+				return err
+			}
+			s3.NotificationConfigs = append(s3.NotificationConfigs, nc)
+			continue
+		case "read_prefixes":
+			s3.ReadPrefixes = append(s3.ReadPrefixes, d.RemainingArgs()...)
+			continue
+		case "allow_keys":
+			s3.AllowKeys = append(s3.AllowKeys, d.RemainingArgs()...)
+			continue
+		case "deny_keys":
+			s3.DenyKeys = append(s3.DenyKeys, d.RemainingArgs()...)
+			continue
+		case "cache_keys":
+			s3.CacheKeys = append(s3.CacheKeys, d.RemainingArgs()...)
+			continue
+		case "readonly_prefixes":
+			s3.ReadOnlyPrefixes = append(s3.ReadOnlyPrefixes, d.RemainingArgs()...)
+			continue
+		case "insecure_hosts":
+			s3.InsecureHosts = append(s3.InsecureHosts, d.RemainingArgs()...)
+			continue
+		case "scope_prefixes":
+			m, err := parseMap(d)
+			if err != nil {
+				return err
+			}
+			s3.ScopePrefixes = m
+			continue
+		case "context_headers":
+			m, err := parseMap(d)
+			if err != nil {
+				return err
+			}
+			s3.ContextHeaders = m
+			continue
+		case "metric_labels":
+			m, err := parseMap(d)
+			if err != nil {
+				return err
+			}
+			s3.MetricLabels = m
+			continue
+		case "tags":
+			m, err := parseMap(d)
+			if err != nil {
+				return err
+			}
+			s3.Tags = m
+			continue
+		case "lock_tags":
+			m, err := parseMap(d)
+			if err != nil {
+				return err
+			}
+			s3.LockTags = m
+			continue
+		}
+
 		var value string
 
 		if !d.Args(&value) {
@@ -265,29 +2072,416 @@ func (s3 *S3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		}
 
 		switch key {
+		case "name":
+			s3.Name = value
+		case "use":
+			s3.Use = value
 		case "host":
 			s3.Host = value
 		case "bucket":
 			s3.Bucket = value
+		case "region":
+			s3.Region = value
+		case "bucket_lookup":
+			s3.BucketLookup = value
+		case "path_style":
+			var pathStyle bool
+			if err := parseBool(d, value, &pathStyle); err != nil {
+				return err
+			}
+			s3.BucketLookup = "auto"
+			if pathStyle {
+				s3.BucketLookup = "path"
+			}
 		case "access_key":
 			s3.AccessKey = value
 		case "secret_key":
 			s3.SecretKey = value
+		case "lock_access_key":
+			s3.LockAccessKey = value
+		case "credential_expiry_warn":
+			if err := parseDuration(d, value, &s3.CredentialExpiryWarn); err != nil {
+				return err
+			}
+		case "insecure":
+			if err := parseBool(d, value, &s3.Insecure); err != nil {
+				return err
+			}
+		case "session_token":
+			s3.SessionToken = value
+		case "profile":
+			s3.Profile = value
+		case "credentials_file":
+			s3.CredentialsFile = value
+		case "use_iam_role":
+			if err := parseBool(d, value, &s3.UseIAMRole); err != nil {
+				return err
+			}
+		case "lock_secret_key":
+			s3.LockSecretKey = value
+		case "ocsp_prefix":
+			s3.OCSPPrefix = value
 		case "prefix":
-			if value != "" {
-				s3.Prefix = value
+			s3.Prefix = value
+		case "max_key_length":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid max_key_length %q: %v", value, err)
+			}
+			s3.MaxKeyLength = n
+		case "metric_prefix_label":
+			s3.MetricPrefixLabel = value
+		case "strip_bucket_from_prefix":
+			if err := parseBool(d, value, &s3.StripBucketFromPrefix); err != nil {
+				return err
+			}
+		case "log_level":
+			s3.LogLevel = value
+		case "redact_keys":
+			if err := parseBool(d, value, &s3.RedactKeys); err != nil {
+				return err
+			}
+		case "read_only":
+			if err := parseBool(d, value, &s3.ReadOnly); err != nil {
+				return err
+			}
+		case "expose_locks":
+			if err := parseBool(d, value, &s3.ExposeLocks); err != nil {
+				return err
+			}
+		case "expose_health":
+			if err := parseBool(d, value, &s3.ExposeHealth); err != nil {
+				return err
+			}
+		case "health_check_timeout":
+			if err := parseDuration(d, value, &s3.HealthCheckTimeout); err != nil {
+				return err
+			}
+		case "obfuscate_keys":
+			if err := parseBool(d, value, &s3.ObfuscateKeys); err != nil {
+				return err
+			}
+		case "prefix_marker":
+			if err := parseBool(d, value, &s3.PrefixMarker); err != nil {
+				return err
+			}
+		case "max_total_objects", "max_total_bytes":
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid %s %q: %v", key, value, err)
+			}
+			if key == "max_total_objects" {
+				s3.MaxTotalObjects = limit
 			} else {
-				s3.Prefix = "acme"
+				s3.MaxTotalBytes = limit
+			}
+		case "quota_refresh":
+			if err := parseDuration(d, value, &s3.QuotaRefresh); err != nil {
+				return err
+			}
+		case "shutdown_grace":
+			if err := parseDuration(d, value, &s3.ShutdownGrace); err != nil {
+				return err
+			}
+		case "encrypt_locks":
+			if err := parseBool(d, value, &s3.EncryptLocks); err != nil {
+				return err
+			}
+		case "treat_403_as_not_exist":
+			if err := parseBool(d, value, &s3.Treat403AsNotExist); err != nil {
+				return err
+			}
+		case "delete_after_migrate":
+			if err := parseBool(d, value, &s3.DeleteAfterMigrate); err != nil {
+				return err
+			}
+		case "mirror_bucket":
+			s3.MirrorBucket = value
+		case "fallback_host":
+			s3.FallbackHost = value
+		case "mirror_required":
+			if err := parseBool(d, value, &s3.MirrorRequired); err != nil {
+				return err
+			}
+		case "create_bucket":
+			switch value {
+			case "true":
+				s3.CreateBucket = "provision"
+			case "false":
+				s3.CreateBucket = "none"
+			default:
+				s3.CreateBucket = value
+			}
+		case "serialize_bucket_setup":
+			if err := parseBool(d, value, &s3.SerializeBucketSetup); err != nil {
+				return err
 			}
+		case "bucket_setup_timeout":
+			if err := parseDuration(d, value, &s3.BucketSetupTimeout); err != nil {
+				return err
+			}
+		case "skip_bucket_check":
+			if err := parseBool(d, value, &s3.SkipBucketCheck); err != nil {
+				return err
+			}
+		case "disable_http2":
+			if err := parseBool(d, value, &s3.DisableHTTP2); err != nil {
+				return err
+			}
+		case "keep_alive":
+			if value == "off" {
+				s3.KeepAlive = -1
+			} else if err := parseDuration(d, value, &s3.KeepAlive); err != nil {
+				return err
+			}
+		case "min_tls_version":
+			s3.MinTLSVersion = value
+		case "connect_timeout":
+			if err := parseDuration(d, value, &s3.ConnectTimeout); err != nil {
+				return err
+			}
+		case "proxy_url":
+			s3.ProxyURL = value
+		case "tls_client_cert":
+			s3.TLSClientCert = value
+		case "tls_client_key":
+			s3.TLSClientKey = value
+		case "client_trace":
+			if err := parseBool(d, value, &s3.ClientTrace); err != nil {
+				return err
+			}
+		case "strict_key_prefix":
+			if err := parseBool(d, value, &s3.StrictKeyPrefix); err != nil {
+				return err
+			}
+		case "verify_etag":
+			if err := parseBool(d, value, &s3.VerifyETag); err != nil {
+				return err
+			}
+		case "server_side_encryption":
+			s3.ServerSideEncryption = value
+		case "sse_kms_key_id":
+			s3.SSEKMSKeyID = value
+		case "sse_kms_bucket_key":
+			if err := parseBool(d, value, &s3.SSEKMSBucketKey); err != nil {
+				return err
+			}
+		case "detect_concurrent_store":
+			if err := parseBool(d, value, &s3.DetectConcurrentStore); err != nil {
+				return err
+			}
+		case "reject_concurrent_store":
+			if err := parseBool(d, value, &s3.RejectConcurrentStore); err != nil {
+				return err
+			}
+		case "write_checksum_sidecar":
+			if err := parseBool(d, value, &s3.WriteChecksumSidecar); err != nil {
+				return err
+			}
+		case "verify_after_store":
+			if err := parseBool(d, value, &s3.VerifyAfterStore); err != nil {
+				return err
+			}
+		case "store_original_key":
+			if err := parseBool(d, value, &s3.StoreOriginalKey); err != nil {
+				return err
+			}
+		case "skip_initial_lock_read":
+			if err := parseBool(d, value, &s3.SkipInitialLockRead); err != nil {
+				return err
+			}
+		case "unconditional_locks":
+			if err := parseBool(d, value, &s3.UnconditionalLocks); err != nil {
+				return err
+			}
+		case "emit_events":
+			if err := parseBool(d, value, &s3.EmitEvents); err != nil {
+				return err
+			}
+		case "fair_locking":
+			if err := parseBool(d, value, &s3.FairLocking); err != nil {
+				return err
+			}
+		case "cleanup_locks_on_start":
+			if err := parseBool(d, value, &s3.CleanupLocksOnStart); err != nil {
+				return err
+			}
+		case "cleanup_locks_age":
+			if err := parseDuration(d, value, &s3.CleanupLocksAge); err != nil {
+				return err
+			}
+		case "max_lock_age":
+			if err := parseDuration(d, value, &s3.MaxLockAge); err != nil {
+				return err
+			}
+		case "lock_timeout":
+			if err := parseDuration(d, value, &s3.LockTimeout); err != nil {
+				return err
+			}
+		case "lock_poll_interval":
+			if err := parseDuration(d, value, &s3.LockPollInterval); err != nil {
+				return err
+			}
+		case "lock_expiration":
+			if err := parseDuration(d, value, &s3.LockExpiration); err != nil {
+				return err
+			}
+		case "lock_heartbeat":
+			if err := parseDuration(d, value, &s3.LockHeartbeat); err != nil {
+				return err
+			}
+		case "lock_owner_id":
+			s3.LockOwnerID = value
+		case "tag_by_type":
+			if err := parseBool(d, value, &s3.TagByType); err != nil {
+				return err
+			}
+		case "storage_class":
+			s3.StorageClass = value
+		case "lock_storage_class":
+			s3.LockStorageClass = value
 		case "encryption_key":
 			s3.EncryptionKey = value
+		case "encryption_algorithm":
+			s3.EncryptionAlgorithm = value
+		case "encryption_key_derivation":
+			s3.EncryptionKeyDerivation = value
+		case "encryption_key_salt":
+			s3.EncryptionKeySalt = value
+		case "allow_cleartext_fallback_on_decrypt_error":
+			if err := parseBool(d, value, &s3.AllowCleartextFallbackOnDecryptError); err != nil {
+				return err
+			}
+		case "max_retries":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid max_retries %q: %v", value, err)
+			}
+			s3.MaxRetries = n
+		case "retry_max_delay":
+			if err := parseDuration(d, value, &s3.RetryMaxDelay); err != nil {
+				return err
+			}
+		case "list_retries":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid list_retries %q: %v", value, err)
+			}
+			s3.ListRetries = n
+		case "list_retry_max_delay":
+			if err := parseDuration(d, value, &s3.ListRetryMaxDelay); err != nil {
+				return err
+			}
+		case "jitter_mode":
+			s3.JitterMode = value
+		case "compression":
+			s3.Compression = value
+		case "compress_config_keys":
+			if err := parseBool(d, value, &s3.CompressConfigKeys); err != nil {
+				return err
+			}
+		case "compression_min_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid compression_min_size %q: %v", value, err)
+			}
+			s3.CompressionMinSize = size
+		case "store_concurrency":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid store_concurrency %q: %v", value, err)
+			}
+			s3.StoreConcurrency = n
+		case "list_cache_ttl":
+			if err := parseDuration(d, value, &s3.ListCacheTTL); err != nil {
+				return err
+			}
+		case "cache_ttl":
+			if err := parseDuration(d, value, &s3.CacheTTL); err != nil {
+				return err
+			}
+		case "cache_size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return d.Errf("invalid cache_size %q: %v", value, err)
+			}
+			s3.CacheSize = size
+		case "operation_timeout":
+			if err := parseDuration(d, value, &s3.OperationTimeout); err != nil {
+				return err
+			}
+		case "read_timeout":
+			if err := parseDuration(d, value, &s3.ReadTimeout); err != nil {
+				return err
+			}
+		case "write_timeout":
+			if err := parseDuration(d, value, &s3.WriteTimeout); err != nil {
+				return err
+			}
+		case "retry_operation_timeout":
+			if err := parseBool(d, value, &s3.RetryOperationTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseMap reads a block of key value pairs following the current token.
+func parseMap(d *caddyfile.Dispenser) (map[string]string, error) {
+	m := make(map[string]string)
+	for d.NextBlock(0) {
+		key := d.Val()
+		var value string
+		if !d.Args(&value) {
+			return nil, d.ArgErr()
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func parseNotificationConfig(d *caddyfile.Dispenser) (NotificationConfig, error) {
+	var nc NotificationConfig
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "arn":
+			if !d.Args(&nc.Arn) {
+				return nc, d.ArgErr()
+			}
+		case "events":
+			nc.Events = append(nc.Events, d.RemainingArgs()...)
+		default:
+			return nc, d.Errf("unrecognized notification_config option %q", d.Val())
 		}
 	}
+	if nc.Arn == "" {
+		return nc, d.Err("notification_config requires an arn")
+	}
+	return nc, nil
+}
+
+func parseBool(d *caddyfile.Dispenser, value string, dst *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return d.Errf("invalid boolean %q: %v", value, err)
+	}
+	*dst = b
+	return nil
+}
+
+func parseDuration(d *caddyfile.Dispenser, value string, dst *caddy.Duration) error {
+	dur, err := caddy.ParseDuration(value)
+	if err != nil {
+		return d.Errf("invalid duration %q: %v", value, err)
+	}
+	*dst = caddy.Duration(dur)
 	return nil
 }
 
 var (
 	_ caddy.Provisioner      = (*S3)(nil)
+	_ caddy.CleanerUpper     = (*S3)(nil)
 	_ caddy.StorageConverter = (*S3)(nil)
 	_ caddyfile.Unmarshaler  = (*S3)(nil)
 )
@@ -2,14 +2,41 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func setupMinioContainer(t *testing.T) (testcontainers.Container, string, error) {
@@ -121,6 +148,12 @@ func TestS3Integration(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Test mutual exclusion between two clients
+	err = s3Storage.SelfTestLocking(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Test Delete
 	err = s3Storage.Delete(ctx, testKey)
 	if err != nil {
@@ -224,3 +257,2178 @@ func TestS3LockEdgeCases(t *testing.T) {
 		t.Error("Expected error when trying to unlock non-existent lock")
 	}
 }
+
+func TestOperationTimeouts(t *testing.T) {
+	const slow = 200 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		read       time.Duration
+		write      time.Duration
+		operation  time.Duration
+		readFails  bool
+		writeFails bool
+	}{
+		{name: "read timeout", read: 50 * time.Millisecond, readFails: true},
+		{name: "write timeout", write: 50 * time.Millisecond, writeFails: true},
+		{name: "shared fallback", operation: 50 * time.Millisecond, readFails: true, writeFails: true},
+		{name: "specific overrides fallback", read: 5 * time.Second, write: 5 * time.Second, operation: 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			fake := newFakeS3(t, "test-bucket")
+			s3Storage := newFakeStorage(t, fake)
+			s3Storage.ReadTimeout = caddy.Duration(tt.read)
+			s3Storage.WriteTimeout = caddy.Duration(tt.write)
+			s3Storage.OperationTimeout = caddy.Duration(tt.operation)
+
+			fake.putObject("test-bucket", s3Storage.objName("existing"), []byte("data"), time.Now())
+			fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				select {
+				case <-time.After(slow):
+				case <-r.Context().Done():
+				}
+				return false
+			})
+
+			_, err := s3Storage.Load(ctx, "existing")
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.readFails {
+				t.Errorf("Load: expected deadline exceeded %v, got err %v", tt.readFails, err)
+			}
+
+			err = s3Storage.Store(ctx, "new", []byte("data"))
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.writeFails {
+				t.Errorf("Store: expected deadline exceeded %v, got err %v", tt.writeFails, err)
+			}
+
+			err = s3Storage.Delete(ctx, "existing")
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.writeFails {
+				t.Errorf("Delete: expected deadline exceeded %v, got err %v", tt.writeFails, err)
+			}
+		})
+	}
+}
+
+func TestPrefixMarker(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.PrefixMarker = true
+
+	err := s3Storage.ensurePrefixMarker(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", "test/") == nil {
+		t.Fatal("Expected prefix marker object to exist")
+	}
+
+	err = s3Storage.Store(ctx, "test-key", []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s3Storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key == "" || key == "test/" {
+			t.Errorf("Expected prefix marker to be filtered from listing, got %v", keys)
+		}
+	}
+	if len(keys) != 1 {
+		t.Errorf("Expected exactly one key, got %v", keys)
+	}
+}
+
+func TestPrefixMarkerTreat403AsNotExist(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.PrefixMarker = true
+	s3Storage.Treat403AsNotExist = true
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return true
+		}
+		return false
+	})
+	if err := s3Storage.ensurePrefixMarker(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("test-bucket", "test/") == nil {
+		t.Error("Expected prefix marker to be created after a 403 stat")
+	}
+}
+
+func TestCleanupDrainsInflight(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ShutdownGrace = caddy.Duration(5 * time.Second)
+
+	started := make(chan struct{})
+	var once sync.Once
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut {
+			once.Do(func() { close(started) })
+			time.Sleep(200 * time.Millisecond)
+		}
+		return false
+	})
+
+	stored := make(chan error, 1)
+	go func() {
+		stored <- s3Storage.Store(ctx, "slow-key", []byte("test-data"))
+	}()
+	<-started
+
+	err := s3Storage.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatalf("Expected slow store to succeed, got %v", err)
+		}
+	default:
+		t.Fatal("Expected Cleanup to wait for the in-flight store")
+	}
+	if fake.object("test-bucket", s3Storage.objName("slow-key")) == nil {
+		t.Error("Expected slow store to be written")
+	}
+}
+
+func TestInflightDrain(t *testing.T) {
+	var ops inflight
+	done := ops.track()
+	if ops.drain(10 * time.Millisecond) {
+		t.Error("Expected drain to time out with an operation in flight")
+	}
+
+	// Operations started while draining are not counted.
+	ops.track()()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done()
+	}()
+	if !ops.drain(time.Second) {
+		t.Error("Expected drain to finish once the operation is done")
+	}
+	ops.track()
+	if !ops.drain(time.Second) {
+		t.Error("Expected operations started after draining not to be waited for")
+	}
+}
+
+func TestScopePrefixes(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ScopePrefixes = map[string]string{
+		"certificates": "certs",
+		"ocsp":         "/staples",
+	}
+
+	tests := []struct {
+		key    string
+		object string
+	}{
+		{key: "certificates/acme/example.com/example.com.crt", object: "certs/certificates/acme/example.com/example.com.crt"},
+		{key: "ocsp/example.com-123", object: "staples/ocsp/example.com-123"},
+		{key: "acme/acme/users/default/default.json", object: "test/acme/acme/users/default/default.json"},
+	}
+
+	for _, tt := range tests {
+		err := s3Storage.Store(ctx, tt.key, []byte(tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fake.object("test-bucket", tt.object) == nil {
+			t.Errorf("Expected %s to be stored as %s, have %v", tt.key, tt.object, fake.keys("test-bucket"))
+		}
+
+		data, err := s3Storage.Load(ctx, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.key {
+			t.Errorf("Expected %s, got %s", tt.key, data)
+		}
+	}
+
+	keys, err := s3Storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if !slices.Contains(keys, tt.key) {
+			t.Errorf("Expected %s in listing across all scopes, got %v", tt.key, keys)
+		}
+	}
+	if len(keys) != len(tests) {
+		t.Errorf("Expected %d keys across all scopes, got %v", len(tests), keys)
+	}
+
+	keys, err = s3Storage.List(ctx, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if expected := []string{"acme", "certificates", "ocsp"}; !slices.Equal(keys, expected) {
+		t.Errorf("Expected scopes %v at the root, got %v", expected, keys)
+	}
+}
+
+func TestOCSPPrefix(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.OCSPPrefix = "ocsp-cache"
+	if err := s3Storage.applyOCSPPrefix(); err != nil {
+		t.Fatal(err)
+	}
+
+	ocspKey := "ocsp/example.com-a1b2c3"
+	certKey := "certificates/acme/example.com/example.com.crt"
+	for _, key := range []string{ocspKey, certKey} {
+		if err := s3Storage.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"ocsp-cache/" + ocspKey,
+		"test/" + certKey,
+	}
+	if keys := fake.keys("test-bucket"); !slices.Equal(keys, expected) {
+		t.Errorf("Expected objects %v, got %v", expected, keys)
+	}
+
+	data, err := s3Storage.Load(ctx, ocspKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != ocspKey {
+		t.Errorf("Expected %s, got %s", ocspKey, data)
+	}
+	keys, err := s3Storage.List(ctx, "ocsp", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{ocspKey}) {
+		t.Errorf("Expected OCSP listing %v, got %v", []string{ocspKey}, keys)
+	}
+
+	s3Storage.OCSPPrefix = "staples"
+	if err := s3Storage.applyOCSPPrefix(); err == nil {
+		t.Error("Expected conflicting OCSP prefixes to be rejected")
+	}
+}
+
+func TestUnmarshalCaddyfileScopePrefixes(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`s3 {
+		bucket test-bucket
+		scope_prefixes {
+			certificates certs
+			ocsp staples
+		}
+		prefix acme
+		ocsp_prefix staples
+	}`)
+
+	var s3Storage S3
+	err := s3Storage.UnmarshalCaddyfile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s3Storage.ScopePrefixes["certificates"] != "certs" || s3Storage.ScopePrefixes["ocsp"] != "staples" {
+		t.Errorf("Unexpected scope prefixes: %v", s3Storage.ScopePrefixes)
+	}
+	if s3Storage.OCSPPrefix != "staples" {
+		t.Errorf("Expected ocsp prefix staples, got %s", s3Storage.OCSPPrefix)
+	}
+	if s3Storage.Bucket != "test-bucket" || s3Storage.Prefix != "acme" {
+		t.Errorf("Unexpected bucket/prefix: %s/%s", s3Storage.Bucket, s3Storage.Prefix)
+	}
+}
+
+func TestDefaultPrefix(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	for _, prefix := range []string{"", `prefix ""`} {
+		d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+			host %s
+			bucket test-bucket
+			access_key test
+			secret_key test
+			insecure true
+			%s
+		}`, fake.host(), prefix))
+		s3Storage := new(S3)
+		if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := s3Storage.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if s3Storage.Prefix != "acme" {
+			t.Errorf("%q: expected default prefix acme, got %q", prefix, s3Storage.Prefix)
+		}
+		if got := s3Storage.objName("test-key"); got != "acme/test-key" {
+			t.Errorf("%q: expected object name acme/test-key, got %q", prefix, got)
+		}
+	}
+}
+
+func TestTagByType(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.TagByType = true
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "certificates/acme/example.com/example.com.crt", expected: "certificate"},
+		{key: "certificates/acme/example.com/example.com.key", expected: "key"},
+		{key: "certificates/acme/example.com/example.com.json", expected: "meta"},
+		{key: "ocsp/example.com-0123abcd", expected: "ocsp"},
+		{key: "acme/acme/challenge_tokens/example.com", expected: "other"},
+	}
+
+	for _, tt := range tests {
+		err := s3Storage.Store(ctx, tt.key, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tags, err := s3Storage.Client.GetObjectTagging(ctx, s3Storage.Bucket, s3Storage.objName(tt.key), minio.GetObjectTaggingOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tags.ToMap()["type"]; got != tt.expected {
+			t.Errorf("%s: expected type tag %q, got %q", tt.key, tt.expected, got)
+		}
+	}
+
+	err := s3Storage.Lock(ctx, "certificates/acme/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := s3Storage.Client.GetObjectTagging(ctx, s3Storage.Bucket, s3Storage.objLockName("certificates/acme/example.com"), minio.GetObjectTaggingOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tags.ToMap()["type"]; got != "lock" {
+		t.Errorf("Expected lock file to be tagged as lock, got %q", got)
+	}
+}
+
+func TestUseTLS(t *testing.T) {
+	insecureHosts := []string{"localhost", "127.0.0.1", "minio.internal:9000"}
+
+	tests := []struct {
+		host string
+		tls  bool
+	}{
+		{host: "localhost:9000", tls: false},
+		{host: "127.0.0.1", tls: false},
+		{host: "minio.internal:9000", tls: false},
+		{host: "minio.internal:9443", tls: true},
+		{host: "s3.amazonaws.com", tls: true},
+		{host: "localhost.example.com", tls: true},
+	}
+
+	for _, tt := range tests {
+		s3Storage := &S3{Host: tt.host, InsecureHosts: insecureHosts}
+		if got := s3Storage.useTLS(); got != tt.tls {
+			t.Errorf("%s: expected TLS %v, got %v", tt.host, tt.tls, got)
+		}
+	}
+
+	s3Storage := &S3{Host: "localhost:9000"}
+	if !s3Storage.useTLS() {
+		t.Error("Expected TLS to be required without insecure hosts")
+	}
+
+	s3Storage = &S3{Host: "s3.amazonaws.com", Insecure: true}
+	if s3Storage.useTLS() {
+		t.Error("Expected plain HTTP with insecure set")
+	}
+}
+
+func TestProvisionInsecureHost(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	s3Storage := &S3{
+		Host:          fake.host(),
+		Bucket:        "test-bucket",
+		AccessKey:     "test",
+		SecretKey:     "test",
+		Prefix:        "test",
+		InsecureHosts: []string{"127.0.0.1"},
+	}
+	err := s3Storage.Provision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3Storage.Store(ctx, "test-key", []byte("test-data"))
+	if err != nil {
+		t.Fatalf("Expected plain HTTP store to an insecure host to succeed, got %v", err)
+	}
+}
+
+func TestProvisionInsecure(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+		host %s
+		bucket test-bucket
+		access_key test
+		secret_key test
+		insecure true
+	}`, fake.host()))
+	s3Storage := new(S3)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s3Storage.Store(ctx, "test-key", []byte("test-data"))
+	if err != nil {
+		t.Fatalf("Expected plain HTTP store with insecure set to succeed, got %v", err)
+	}
+}
+
+func TestProvisionValidatesBeforeRequests(t *testing.T) {
+	invalid := map[string]func(s3 *S3){
+		"compression":   func(s3 *S3) { s3.Compression = "zstd" },
+		"jitter_mode":   func(s3 *S3) { s3.JitterMode = "random" },
+		"storage_class": func(s3 *S3) { s3.StorageClass = "GLACIER" },
+		"create_bucket": func(s3 *S3) { s3.CreateBucket = "always" },
+		"encryption":    func(s3 *S3) { s3.EncryptionKey, s3.EncryptionAlgorithm = "12345678123456781234567812345678", "rot13" },
+		"obfuscate":     func(s3 *S3) { s3.ObfuscateKeys = true },
+	}
+	for name, configure := range invalid {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeS3(t, "test-bucket")
+			var requests atomic.Int32
+			fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				requests.Add(1)
+				return false
+			})
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+			defer cancel()
+
+			s3Storage := &S3{
+				Host:          fake.host(),
+				Bucket:        "test-bucket",
+				AccessKey:     "test",
+				SecretKey:     "test",
+				InsecureHosts: []string{"127.0.0.1"},
+				PrefixMarker:  true,
+			}
+			configure(s3Storage)
+			if err := s3Storage.Provision(ctx); err == nil {
+				t.Fatal("Expected the invalid configuration to be rejected")
+			}
+			if n := requests.Load(); n != 0 {
+				t.Errorf("Expected no requests before validation, got %d", n)
+			}
+		})
+	}
+}
+
+func TestTreat403AsNotExist(t *testing.T) {
+	for _, treat403 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("treat_403_as_not_exist=%v", treat403), func(t *testing.T) {
+			ctx := t.Context()
+			fake := newFakeS3(t, "test-bucket")
+			s3Storage := newFakeStorage(t, fake)
+			s3Storage.Treat403AsNotExist = treat403
+
+			fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if strings.Contains(r.URL.Path, "forbidden-key") {
+					w.WriteHeader(http.StatusForbidden)
+					if r.Method != http.MethodHead {
+						fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied.</Message></Error>`)
+					}
+					return true
+				}
+				return false
+			})
+
+			_, err := s3Storage.Load(ctx, "forbidden-key")
+			if got := errors.Is(err, fs.ErrNotExist); got != treat403 {
+				t.Errorf("Load: expected not exist %v, got err %v", treat403, err)
+			}
+			if err == nil {
+				t.Error("Load: expected an error")
+			}
+
+			_, err = s3Storage.Stat(ctx, "forbidden-key")
+			if got := errors.Is(err, fs.ErrNotExist); got != treat403 {
+				t.Errorf("Stat: expected not exist %v, got err %v", treat403, err)
+			}
+			if err == nil {
+				t.Error("Stat: expected an error")
+			}
+
+			if s3Storage.Exists(ctx, "forbidden-key") {
+				t.Error("Exists: expected forbidden key to not exist")
+			}
+		})
+	}
+}
+
+func TestIsNotExist(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchKey"}, true},
+		{minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NotFound"}, true},
+		{minio.ErrorResponse{Code: "NoSuchKey", Message: "Object not found"}, true},
+		{minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, false},
+		{minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}, false},
+		{errors.New("The specified key does not exist."), false},
+	} {
+		if got := isNotExist(tc.err); got != tc.expected {
+			t.Errorf("isNotExist(%v): expected %v, got %v", tc.err, tc.expected, got)
+		}
+	}
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case strings.Contains(r.URL.Path, "missing-key") && r.Method != http.MethodPut:
+			// Providers word the message differently from AWS.
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method != http.MethodHead {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>Object not found</Message></Error>`)
+			}
+			return true
+		case strings.Contains(r.URL.Path, "broken-key") && r.Method == http.MethodGet:
+			writeFakeError(w, http.StatusBadRequest, "InvalidRequest", "Bad request.")
+			return true
+		}
+		return false
+	})
+
+	if _, err := s3Storage.Load(ctx, "missing-key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load: expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := s3Storage.Stat(ctx, "missing-key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: expected fs.ErrNotExist, got %v", err)
+	}
+	if s3Storage.Exists(ctx, "missing-key") {
+		t.Error("Exists: expected missing key to not exist")
+	}
+	if err := s3Storage.Lock(ctx, "missing-key"); err != nil {
+		t.Errorf("Lock: expected missing lock to be acquired, got %v", err)
+	}
+
+	// A lock file that cannot be read must not be mistaken for a free lock.
+	if err := s3Storage.Lock(ctx, "broken-key"); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lock: expected read error, got %v", err)
+	}
+}
+
+func TestReadOnlyPrefixes(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ReadOnlyPrefixes = []string{"/test/certificates/legacy-ca"}
+
+	legacyKey := "certificates/legacy-ca/example.com/example.com.crt"
+	fake.putObject("test-bucket", s3Storage.objName(legacyKey), []byte("legacy"), time.Now())
+
+	data, err := s3Storage.Load(ctx, legacyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "legacy" {
+		t.Errorf("Expected legacy, got %s", data)
+	}
+
+	err = s3Storage.Store(ctx, legacyKey, []byte("overwritten"))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on store, got %v", err)
+	}
+
+	err = s3Storage.Delete(ctx, legacyKey)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on delete, got %v", err)
+	}
+
+	if obj := fake.object("test-bucket", s3Storage.objName(legacyKey)); obj == nil || string(obj.data) != "legacy" {
+		t.Error("Expected read-only object to be unchanged")
+	}
+
+	err = s3Storage.Store(ctx, "certificates/acme/example.com/example.com.crt", []byte("data"))
+	if err != nil {
+		t.Errorf("Expected store outside read-only prefix to succeed, got %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ReadOnly = true
+
+	testKey := "certificates/example.com/example.com.crt"
+	fake.putObject("test-bucket", s3Storage.objName(testKey), []byte("cert"), time.Now())
+	var writes atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writes.Add(1)
+		}
+		return false
+	})
+
+	if data, err := s3Storage.Load(ctx, testKey); err != nil || string(data) != "cert" {
+		t.Errorf("Expected load to work, got %q, %v", data, err)
+	}
+	if !s3Storage.Exists(ctx, testKey) {
+		t.Error("Expected key to exist")
+	}
+	if _, err := s3Storage.Stat(ctx, testKey); err != nil {
+		t.Errorf("Expected stat to work, got %v", err)
+	}
+	if keys, err := s3Storage.List(ctx, "", true); err != nil || len(keys) != 1 {
+		t.Errorf("Expected list to work, got %v, %v", keys, err)
+	}
+
+	if err := s3Storage.Store(ctx, testKey, []byte("new")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on store, got %v", err)
+	}
+	if err := s3Storage.Delete(ctx, testKey); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on delete, got %v", err)
+	}
+	if _, err := s3Storage.DeleteAll(ctx, "certificates"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on DeleteAll, got %v", err)
+	}
+	if _, err := s3Storage.DeleteOlderThan(ctx, "certificates", 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on DeleteOlderThan, got %v", err)
+	}
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Errorf("Expected lock to be a no-op, got %v", err)
+	}
+	if err := s3Storage.Unlock(ctx, testKey); err != nil {
+		t.Errorf("Expected unlock to be a no-op, got %v", err)
+	}
+	if err := s3Storage.ForceUnlock(ctx, testKey); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected read-only error on ForceUnlock, got %v", err)
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("Expected no write requests, got %d", n)
+	}
+	if obj := fake.object("test-bucket", s3Storage.objName(testKey)); obj == nil || string(obj.data) != "cert" {
+		t.Error("Expected object to be unchanged")
+	}
+}
+
+func TestReadOnlyProvision(t *testing.T) {
+	fake := newFakeS3(t)
+	var requests atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		requests.Add(1)
+		return false
+	})
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	for name, set := range map[string]func(*S3){
+		"create_bucket":          func(s3 *S3) { s3.CreateBucket = "provision" },
+		"prefix_marker":          func(s3 *S3) { s3.PrefixMarker = true },
+		"cleanup_locks_on_start": func(s3 *S3) { s3.CleanupLocksOnStart = true },
+	} {
+		s3Storage := &S3{
+			Host:          fake.host(),
+			Bucket:        "test-bucket",
+			AccessKey:     "test",
+			SecretKey:     "test",
+			Prefix:        "test",
+			InsecureHosts: []string{"127.0.0.1"},
+			ReadOnly:      true,
+		}
+		set(s3Storage)
+		if err := s3Storage.Provision(ctx); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected read_only to conflict with %s, got %v", name, err)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected no requests, got %d", n)
+	}
+}
+
+func TestStoreOriginalKey(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StoreOriginalKey = true
+	s3Storage.ScopePrefixes = map[string]string{"certificates": "certs"}
+
+	testKey := "/certificates/acme/example.com/example.com.crt"
+	err := s3Storage.Store(ctx, testKey, []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oi, err := s3Storage.Client.StatObject(ctx, s3Storage.Bucket, s3Storage.objName(testKey), minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := oi.UserMetadata["Certmagic-Key"]; got != testKey {
+		t.Errorf("Expected original key %q in metadata, got %q", testKey, got)
+	}
+}
+
+func TestObjectNames(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+
+	tests := []struct {
+		prefix, key, want string
+	}{
+		{"", "/test-key", "test-key"},
+		{"", "certificates/example.com", "certificates/example.com"},
+		{"/", "test-key", "test-key"},
+		{"acme/", "test-key", "acme/test-key"},
+		{"/acme//certs/", "a//b", "acme/certs/a/b"},
+		{"acme", "../outside", "acme/../outside"},
+		{"acme", "certificates/../example.com", "acme/certificates/../example.com"},
+	}
+	for _, tt := range tests {
+		s3Storage := newFakeStorage(t, fake)
+		s3Storage.Prefix = tt.prefix
+		if got := s3Storage.objName(tt.key); got != tt.want {
+			t.Errorf("prefix %q: objName(%q) = %q, want %q", tt.prefix, tt.key, got, tt.want)
+		}
+
+		if err := s3Storage.Store(ctx, tt.key, []byte(tt.want)); err != nil {
+			t.Fatal(err)
+		}
+		if obj := fake.object("test-bucket", tt.want); obj == nil {
+			t.Errorf("prefix %q: expected %q to be stored as %q", tt.prefix, tt.key, tt.want)
+		}
+		if data, err := s3Storage.Load(ctx, tt.key); err != nil || string(data) != tt.want {
+			t.Errorf("prefix %q: expected to load %q, got %q, %v", tt.prefix, tt.key, data, err)
+		}
+	}
+
+	// Objects written with a leading separator by earlier versions can
+	// still be loaded without a prefix.
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.Prefix = ""
+	fake.putObject("test-bucket", "/legacy-key", []byte("legacy"), time.Now())
+	if data, err := s3Storage.Load(ctx, "legacy-key"); err != nil || string(data) != "legacy" {
+		t.Errorf("Expected to load legacy object, got %q, %v", data, err)
+	}
+}
+
+func TestKeyNormalization(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ScopePrefixes = map[string]string{"certificates": "certs"}
+
+	keys := []string{
+		"certificates/acme/example.com/example.com.crt",
+		"/certificates/acme/example.com/example.com.crt",
+		"//certificates//acme/example.com/example.com.crt",
+	}
+	for _, key := range keys {
+		if got, want := s3Storage.objName(key), "certs/certificates/acme/example.com/example.com.crt"; got != want {
+			t.Errorf("objName(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	err := s3Storage.Store(ctx, keys[1], []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		data, err := s3Storage.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", key, err)
+		}
+		if string(data) != "test-data" {
+			t.Errorf("Load(%q) = %s, want test-data", key, data)
+		}
+	}
+	if got := fake.keys("test-bucket"); len(got) != 1 {
+		t.Errorf("Expected a single object, got %v", got)
+	}
+}
+
+func TestStrictKeyPrefix(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StrictKeyPrefix = true
+
+	err := s3Storage.Store(ctx, "certificates/example.com.crt", []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"/certificates/example.com.crt", "certificates//example.com.crt"} {
+		if err := s3Storage.Store(ctx, key, []byte("test-data")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Store(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := s3Storage.Load(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Load(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if s3Storage.Exists(ctx, key) {
+			t.Errorf("Exists(%q): expected false for invalid key", key)
+		}
+	}
+}
+
+func TestStoreMany(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StoreConcurrency = 3
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "12345678123456781234567812345678")
+	s3Storage.iowrap = sb
+
+	failing := "certificates/fail.example.com/fail.example.com.crt"
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, failing) {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return true
+		}
+		return false
+	})
+
+	items := map[string][]byte{failing: []byte("fail")}
+	for i := range 20 {
+		items[fmt.Sprintf("certificates/host%d.example.com/host%d.example.com.crt", i, i)] = []byte(fmt.Sprintf("cert-%d", i))
+	}
+
+	err := s3Storage.StoreMany(ctx, items)
+	if err == nil || !strings.Contains(err.Error(), failing) {
+		t.Fatalf("Expected error naming %s, got %v", failing, err)
+	}
+	if strings.Count(err.Error(), "storing ") != 1 {
+		t.Errorf("Expected a single failed key, got %v", err)
+	}
+
+	for key, value := range items {
+		if key == failing {
+			continue
+		}
+		obj := fake.object("test-bucket", s3Storage.objName(key))
+		if obj == nil {
+			t.Fatalf("Expected %s to be stored", key)
+		}
+		if bytes.Equal(obj.data, value) {
+			t.Errorf("Expected %s to be encrypted", key)
+		}
+		data, err := s3Storage.Load(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Errorf("Load(%q) = %s, want %s", key, data, value)
+		}
+	}
+}
+
+func TestKeyPatterns(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.AllowKeys = []string{"certificates/*/*/*", "acme/*/*/*/*"}
+	s3Storage.DenyKeys = []string{"certificates/*/internal.example.com/*"}
+
+	allowed := "certificates/acme/example.com/example.com.crt"
+	err := s3Storage.Store(ctx, allowed, []byte("test-data"))
+	if err != nil {
+		t.Fatalf("Expected allowed key to be stored, got %v", err)
+	}
+	if _, err := s3Storage.Load(ctx, allowed); err != nil {
+		t.Errorf("Expected allowed key to load, got %v", err)
+	}
+	if err := s3Storage.Delete(ctx, allowed); err != nil {
+		t.Errorf("Expected allowed key to be deleted, got %v", err)
+	}
+
+	for _, key := range []string{
+		"certificates/acme/internal.example.com/internal.example.com.crt",
+		"unexpected/key",
+	} {
+		if err := s3Storage.Store(ctx, key, []byte("test-data")); !errors.Is(err, ErrKeyNotAllowed) {
+			t.Errorf("Store(%q): expected ErrKeyNotAllowed, got %v", key, err)
+		}
+		if _, err := s3Storage.Load(ctx, key); !errors.Is(err, ErrKeyNotAllowed) {
+			t.Errorf("Load(%q): expected ErrKeyNotAllowed, got %v", key, err)
+		}
+		if err := s3Storage.Delete(ctx, key); !errors.Is(err, ErrKeyNotAllowed) {
+			t.Errorf("Delete(%q): expected ErrKeyNotAllowed, got %v", key, err)
+		}
+	}
+	if keys := fake.keys("test-bucket"); len(keys) != 0 {
+		t.Errorf("Expected no objects to be stored, got %v", keys)
+	}
+}
+
+func TestReadPrefixes(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ReadPrefixes = []string{"legacy", "/older/"}
+
+	testKey := "certificates/acme/example.com/example.com.crt"
+	fake.putObject("test-bucket", "older/"+testKey, []byte("older"), time.Now())
+	fake.putObject("test-bucket", "legacy/"+testKey, []byte("legacy"), time.Now())
+
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "legacy" {
+		t.Errorf("Expected value from first read prefix, got %s", data)
+	}
+	if !s3Storage.Exists(ctx, testKey) {
+		t.Error("Expected key to exist via read prefix")
+	}
+	ki, err := s3Storage.Stat(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.Size != int64(len("legacy")) {
+		t.Errorf("Expected size of legacy object, got %d", ki.Size)
+	}
+
+	olderKey := "certificates/acme/older.example.com/older.example.com.crt"
+	fake.putObject("test-bucket", "older/"+olderKey, []byte("older"), time.Now())
+	data, err = s3Storage.Load(ctx, olderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "older" {
+		t.Errorf("Expected value from second read prefix, got %s", data)
+	}
+
+	err = s3Storage.Store(ctx, testKey, []byte("current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := fake.object("test-bucket", "test/"+testKey); obj == nil || string(obj.data) != "current" {
+		t.Error("Expected store to write below the primary prefix")
+	}
+	if obj := fake.object("test-bucket", "legacy/"+testKey); obj == nil || string(obj.data) != "legacy" {
+		t.Error("Expected legacy object to be unchanged")
+	}
+	data, err = s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "current" {
+		t.Errorf("Expected value from primary prefix, got %s", data)
+	}
+
+	_, err = s3Storage.Load(ctx, "certificates/missing.crt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for missing key, got %v", err)
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	s3Storage := &S3{Host: "s3.example.com"}
+	tr, err := s3Storage.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.TLSNextProto != nil || tr.DisableKeepAlives {
+		t.Error("Expected default transport without options")
+	}
+
+	s3Storage.DisableHTTP2 = true
+	s3Storage.KeepAlive = caddy.Duration(90 * time.Second)
+	tr, err = s3Storage.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Error("Expected HTTP/2 upgrade to be disabled")
+	}
+	if tr.Protocols == nil || tr.Protocols.HTTP2() || !tr.Protocols.HTTP1() {
+		t.Error("Expected transport to only speak HTTP/1.1")
+	}
+	if tr.IdleConnTimeout != 90*time.Second || tr.DisableKeepAlives {
+		t.Errorf("Expected keep-alive of 90s, got idle timeout %s", tr.IdleConnTimeout)
+	}
+
+	s3Storage.KeepAlive = -1
+	tr, err = s3Storage.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.DisableKeepAlives {
+		t.Error("Expected keep-alives to be disabled")
+	}
+}
+
+func TestUnmarshalCaddyfileTransportOptions(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`s3 {
+		disable_http2 true
+		keep_alive off
+		min_tls_version 1.3
+		connect_timeout 5s
+		proxy_url http://proxy.example.com:3128
+		tls_client_cert /etc/caddy/client.crt
+		tls_client_key /etc/caddy/client.key
+	}`)
+	s3Storage := new(S3)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if !s3Storage.DisableHTTP2 || s3Storage.KeepAlive >= 0 {
+		t.Errorf("Expected HTTP/2 and keep-alive to be disabled, got %v and %v", s3Storage.DisableHTTP2, s3Storage.KeepAlive)
+	}
+	if s3Storage.MinTLSVersion != "1.3" {
+		t.Errorf("Expected min TLS version 1.3, got %q", s3Storage.MinTLSVersion)
+	}
+	if s3Storage.ConnectTimeout != caddy.Duration(5*time.Second) || s3Storage.ProxyURL != "http://proxy.example.com:3128" {
+		t.Errorf("Unexpected connect timeout %v or proxy %q", s3Storage.ConnectTimeout, s3Storage.ProxyURL)
+	}
+	if s3Storage.TLSClientCert != "/etc/caddy/client.crt" || s3Storage.TLSClientKey != "/etc/caddy/client.key" {
+		t.Errorf("Unexpected client certificate %q, %q", s3Storage.TLSClientCert, s3Storage.TLSClientKey)
+	}
+}
+
+func TestMirrorBucket(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket", "mirror-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MirrorBucket = "mirror-bucket"
+
+	testKey := "certificates/example.com/example.com.crt"
+	err := s3Storage.Store(ctx, testKey, []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{"test-bucket", "mirror-bucket"} {
+		if obj := fake.object(bucket, s3Storage.objName(testKey)); obj == nil || string(obj.data) != "test-data" {
+			t.Errorf("Expected object in %s after store", bucket)
+		}
+	}
+
+	// Simulate an object lost from the primary bucket.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, "/test-bucket/") {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return true
+		}
+		return false
+	})
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test-data" {
+		t.Errorf("Expected value from mirror bucket, got %s", data)
+	}
+	fake.setIntercept(nil)
+
+	err = s3Storage.Delete(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{"test-bucket", "mirror-bucket"} {
+		if fake.object(bucket, s3Storage.objName(testKey)) != nil {
+			t.Errorf("Expected object to be deleted from %s", bucket)
+		}
+	}
+}
+
+func TestMirrorBucketFailures(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.MirrorBucket = "missing-bucket"
+
+	err := s3Storage.Store(ctx, "best-effort", []byte("test-data"))
+	if err != nil {
+		t.Errorf("Expected best-effort mirror failure to be ignored, got %v", err)
+	}
+
+	s3Storage.MirrorRequired = true
+	err = s3Storage.Store(ctx, "required", []byte("test-data"))
+	if err == nil {
+		t.Error("Expected required mirror failure to be returned")
+	}
+	if fake.object("test-bucket", s3Storage.objName("required")) == nil {
+		t.Error("Expected object in primary bucket despite mirror failure")
+	}
+}
+
+func TestStatDirectory(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	testKey := "certificates/acme/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+
+	ki, err := s3Storage.Stat(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ki.IsTerminal || ki.Size != int64(len("test-data")) {
+		t.Errorf("Expected object to be terminal, got %+v", ki)
+	}
+
+	for _, dir := range []string{"certificates", "certificates/acme/", "certificates/acme/example.com"} {
+		ki, err := s3Storage.Stat(ctx, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		if ki.IsTerminal || ki.Key != dir {
+			t.Errorf("%s: expected directory not to be terminal, got %+v", dir, ki)
+		}
+	}
+
+	// Neither an object nor a prefix of one.
+	for _, key := range []string{"certificates/acme/example", "missing"} {
+		if _, err := s3Storage.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist, got %v", key, err)
+		}
+	}
+}
+
+func TestFallbackHost(t *testing.T) {
+	ctx := t.Context()
+	primary := newFakeS3(t, "test-bucket")
+	secondary := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, primary)
+	s3Storage.FallbackHost = secondary.host()
+	s3Storage.fallbackCli = newFakeStorage(t, secondary).Client
+
+	testKey := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, fake := range []*fakeS3{primary, secondary} {
+		if obj := fake.object("test-bucket", s3Storage.objName(testKey)); obj == nil || string(obj.data) != "test-data" {
+			t.Errorf("Expected object on %s after store", fake.host())
+		}
+	}
+
+	// A missing object is an answer from the primary and is not looked up
+	// on the fallback.
+	secondary.putObject("test-bucket", s3Storage.objName("fallback-only"), []byte("stale"), time.Now())
+	if _, err := s3Storage.Load(ctx, "fallback-only"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not found from primary, got %v", err)
+	}
+
+	// Point the primary client at a port nobody listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+	s3Storage.Client, err = minio.New(unreachable, &minio.Options{
+		Creds:      credentials.NewStaticV4("test", "test", ""),
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Storage.MaxRetries = 1
+	data, err := s3Storage.Load(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test-data" {
+		t.Errorf("Expected value from fallback host, got %s", data)
+	}
+
+	if err := s3Storage.Delete(ctx, testKey); err == nil {
+		t.Error("Expected delete to fail while the primary is unreachable")
+	}
+}
+
+func TestStatFull(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StoreOriginalKey = true
+
+	testKey := "certificates/example.com/example.com.crt"
+	err := s3Storage.Store(ctx, testKey, []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ki, err := s3Storage.StatFull(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("test-data"))
+	if ki.ETag != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected ETag %x, got %s", sum, ki.ETag)
+	}
+	if ki.StorageClass != "STANDARD" {
+		t.Errorf("Expected STANDARD storage class, got %q", ki.StorageClass)
+	}
+	if got := ki.Metadata["Certmagic-Key"]; got != testKey {
+		t.Errorf("Expected original key %q in metadata, got %q", testKey, got)
+	}
+	if ki.Key != testKey || ki.Size != int64(len("test-data")) || !ki.IsTerminal {
+		t.Errorf("Unexpected key info %+v", ki.KeyInfo)
+	}
+
+	_, err = s3Storage.Client.PutObject(ctx, "test-bucket", s3Storage.objName("archived"), bytes.NewReader([]byte("old")), 3, minio.PutObjectOptions{StorageClass: "GLACIER"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki, err = s3Storage.StatFull(ctx, "archived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.StorageClass != "GLACIER" {
+		t.Errorf("Expected GLACIER storage class, got %q", ki.StorageClass)
+	}
+
+	_, err = s3Storage.StatFull(ctx, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.StorageClass = "STANDARD_IA"
+
+	testKey := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(ctx, testKey, []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	ki, err := s3Storage.StatFull(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.StorageClass != "STANDARD_IA" {
+		t.Errorf("Expected STANDARD_IA storage class, got %q", ki.StorageClass)
+	}
+
+	if err := s3Storage.Lock(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.object("test-bucket", s3Storage.objLockName(testKey)).header.Get("X-Amz-Storage-Class"); got != "" {
+		t.Errorf("Expected lock file in the default storage class, got %q", got)
+	}
+
+	ctxCaddy, cancel := caddy.NewContext(caddy.Context{Context: ctx})
+	defer cancel()
+	err = (&S3{Host: fake.host(), Bucket: "test-bucket", AccessKey: "test", SecretKey: "test", InsecureHosts: []string{"127.0.0.1"}, StorageClass: "GLACIER"}).Provision(ctxCaddy)
+	if err == nil || !strings.Contains(err.Error(), "GLACIER") {
+		t.Errorf("Expected error for an archive storage class, got %v", err)
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		version  string
+		expected uint16
+		connects bool
+	}{
+		{version: "", expected: tls.VersionTLS12, connects: true},
+		{version: "1.2", expected: tls.VersionTLS12, connects: true},
+		{version: "1.3", expected: tls.VersionTLS13, connects: false},
+	}
+	for _, tt := range tests {
+		s3Storage := &S3{Host: srv.Listener.Addr().String(), MinTLSVersion: tt.version}
+		tr, err := s3Storage.newTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.TLSClientConfig.MinVersion != tt.expected {
+			t.Errorf("%q: expected min version %x, got %x", tt.version, tt.expected, tr.TLSClientConfig.MinVersion)
+		}
+
+		tr.TLSClientConfig.RootCAs = roots
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if connected := err == nil; connected != tt.connects {
+			t.Errorf("%q: expected connection to a TLS 1.2 server to succeed: %v, got error %v", tt.version, tt.connects, err)
+		}
+	}
+
+	s3Storage := &S3{Host: "s3.example.com", MinTLSVersion: "1.1"}
+	if _, err := s3Storage.newTransport(); err == nil {
+		t.Error("Expected error for unsupported TLS version")
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	// The fake serves proxied requests as well, since it only looks at the
+	// path of the absolute request URI.
+	fake := newFakeS3(t, "test-bucket")
+	var proxied atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Host == "s3.example.invalid" {
+			proxied.Add(1)
+		}
+		return false
+	})
+
+	s3Storage := &S3{
+		Host:      "s3.example.invalid",
+		Bucket:    "test-bucket",
+		AccessKey: "test",
+		SecretKey: "test",
+		Insecure:  true,
+		ProxyURL:  "http://" + fake.host(),
+	}
+	if err := s3Storage.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	if proxied.Load() == 0 {
+		t.Error("Expected requests to go through the proxy")
+	}
+
+	s3Storage = &S3{Host: "s3.example.com", ProxyURL: "://proxy"}
+	if _, err := s3Storage.newTransport(); err == nil {
+		t.Error("Expected error for invalid proxy URL")
+	}
+}
+
+func TestBucketLookup(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	// Requests are sent through the fake as a proxy, so that the requested
+	// host does not need to resolve.
+	fake := newFakeS3(t)
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		requests = append(requests, r.URL.Host+r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+		return true
+	})
+
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{config: "bucket_lookup path", expected: "s3.example.invalid/test-bucket/test/test-key"},
+		{config: "path_style true", expected: "s3.example.invalid/test-bucket/test/test-key"},
+		{config: "bucket_lookup dns", expected: "test-bucket.s3.example.invalid/test/test-key"},
+	}
+	for _, tt := range tests {
+		d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+			host s3.example.invalid
+			bucket test-bucket
+			prefix test
+			region us-east-1
+			access_key test
+			secret_key test
+			insecure true
+			proxy_url http://%s
+			skip_bucket_check true
+			%s
+		}`, fake.host(), tt.config))
+		s3Storage := new(S3)
+		if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := s3Storage.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+		if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err != nil {
+			t.Fatalf("%s: %v", tt.config, err)
+		}
+		mu.Lock()
+		if !slices.Contains(requests, tt.expected) {
+			t.Errorf("%s: expected request to %s, got %v", tt.config, tt.expected, requests)
+		}
+		mu.Unlock()
+	}
+
+	if _, err := (&S3{BucketLookup: "virtual"}).bucketLookup(); err == nil {
+		t.Error("Expected error for unsupported bucket lookup")
+	}
+}
+
+func TestTransportConnectTimeout(t *testing.T) {
+	// The listener accepts connections, but never completes a handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	s3Storage := &S3{Host: ln.Addr().String(), ConnectTimeout: caddy.Duration(100 * time.Millisecond)}
+	tr, err := s3Storage.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + ln.Addr().String())
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected handshake to time out")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Expected connect timeout to apply, gave up after %v", elapsed)
+	}
+}
+
+func TestTransportClientCert(t *testing.T) {
+	var presented atomic.Bool
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented.Store(len(r.TLS.PeerCertificates) > 0)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "caddy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s3Storage := &S3{Host: srv.Listener.Addr().String(), TLSClientCert: certFile, TLSClientKey: keyFile}
+	tr, err := s3Storage.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.TLSClientConfig.RootCAs = roots
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !presented.Load() {
+		t.Error("Expected client certificate to be presented")
+	}
+
+	s3Storage.TLSClientKey = filepath.Join(dir, "missing.key")
+	if _, err := s3Storage.newTransport(); err == nil {
+		t.Error("Expected error for missing client key")
+	}
+}
+
+func TestCheckBucketPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		strip    bool
+		expected string
+		warns    bool
+	}{
+		{prefix: "acme", expected: "acme"},
+		{prefix: "test-bucket-certs", expected: "test-bucket-certs"},
+		{prefix: "test-bucket/acme", expected: "test-bucket/acme", warns: true},
+		{prefix: "/test-bucket", expected: "/test-bucket", warns: true},
+		{prefix: "test-bucket/acme", strip: true, expected: "acme"},
+		{prefix: "/test-bucket/acme", strip: true, expected: "acme"},
+		{prefix: "test-bucket", strip: true, expected: ""},
+	}
+	for _, tt := range tests {
+		core, logs := observer.New(zap.WarnLevel)
+		s3Storage := &S3{
+			Logger:                zap.New(core),
+			Bucket:                "test-bucket",
+			Prefix:                tt.prefix,
+			StripBucketFromPrefix: tt.strip,
+		}
+		s3Storage.checkBucketPrefix()
+		if s3Storage.Prefix != tt.expected {
+			t.Errorf("%q: expected prefix %q, got %q", tt.prefix, tt.expected, s3Storage.Prefix)
+		}
+		if warned := logs.FilterMessage("prefix starts with the bucket name").Len() > 0; warned != tt.warns {
+			t.Errorf("%q: expected warning %v, got %v", tt.prefix, tt.warns, warned)
+		}
+	}
+}
+
+func TestVerifyAfterStore(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.VerifyAfterStore = true
+
+	err := s3Storage.Store(ctx, "ok", []byte("test-data"))
+	if err != nil {
+		t.Fatalf("Expected verified store to succeed, got %v", err)
+	}
+
+	// Acknowledge writes without persisting them.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut {
+			return false
+		}
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return true
+	})
+	err = s3Storage.Store(ctx, "dropped", []byte("test-data"))
+	if !errors.Is(err, ErrStoreNotVerified) {
+		t.Errorf("Expected ErrStoreNotVerified for dropped write, got %v", err)
+	}
+	err = s3Storage.Store(ctx, "ok", []byte("new-data"))
+	if !errors.Is(err, ErrStoreNotVerified) {
+		t.Errorf("Expected ErrStoreNotVerified for stale object, got %v", err)
+	}
+
+	s3Storage.VerifyAfterStore = false
+	err = s3Storage.Store(ctx, "unverified", []byte("test-data"))
+	if err != nil {
+		t.Errorf("Expected unverified store to succeed, got %v", err)
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	// "test/" plus the key makes the object name exactly 1024 bytes long.
+	maxKey := strings.Repeat("k", maxKeyLength-len("test/"))
+	if err := s3Storage.Store(ctx, maxKey, []byte("data")); err != nil {
+		t.Errorf("Expected key at the limit to be stored, got %v", err)
+	}
+
+	longKey := maxKey + "k"
+	requests := 0
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		requests++
+		return false
+	})
+	if err := s3Storage.Store(ctx, longKey, []byte("data")); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Store: expected ErrKeyTooLong, got %v", err)
+	}
+	if _, err := s3Storage.Load(ctx, longKey); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Load: expected ErrKeyTooLong, got %v", err)
+	}
+	if err := s3Storage.Delete(ctx, longKey); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Delete: expected ErrKeyTooLong, got %v", err)
+	}
+	// The lock file name is longer than the key itself.
+	if err := s3Storage.Lock(ctx, maxKey); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Lock: expected ErrKeyTooLong, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests for over-limit keys, got %d", requests)
+	}
+
+	s3Storage.MaxKeyLength = 16
+	if err := s3Storage.Store(ctx, "certificates/example.com", []byte("data")); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong with custom limit, got %v", err)
+	}
+}
+
+func TestCheckPrefixLength(t *testing.T) {
+	s3Storage := &S3{Prefix: "acme"}
+	if err := s3Storage.checkPrefixLength(); err != nil {
+		t.Errorf("Expected short prefix to be accepted, got %v", err)
+	}
+
+	s3Storage = &S3{Prefix: "acme", ScopePrefixes: map[string]string{"ocsp": strings.Repeat("p", maxKeyLength)}}
+	if err := s3Storage.checkPrefixLength(); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong for long scope prefix, got %v", err)
+	}
+
+	s3Storage = &S3{Prefix: "acme", MaxKeyLength: -1}
+	if err := s3Storage.checkPrefixLength(); err == nil {
+		t.Error("Expected error for negative max_key_length")
+	}
+}
+
+func TestListResumesAfterThrottling(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	fake.pageSize = 2
+	s3Storage := newFakeStorage(t, fake)
+
+	var expected []string
+	for i := range 5 {
+		key := fmt.Sprintf("certificates/example%d.com.crt", i)
+		fake.putObject("test-bucket", s3Storage.objName(key), []byte("cert"), time.Now())
+		expected = append(expected, key)
+	}
+
+	var throttled atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("continuation-token") != "" && throttled.Add(1) == 1 {
+			writeFakeError(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+			return true
+		}
+		return false
+	})
+
+	keys, err := s3Storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttled.Load() == 0 {
+		t.Fatal("Expected listing to be throttled")
+	}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Has("list-type") {
+			writeFakeError(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+			return true
+		}
+		return false
+	})
+	s3Storage.ListRetries = 1
+	s3Storage.ListRetryMaxDelay = caddy.Duration(time.Millisecond)
+	if _, err := s3Storage.List(ctx, "", true); err == nil {
+		t.Error("Expected error once retries are exhausted")
+	}
+}
+
+func TestListFailsMidStream(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	fake.pageSize = 2
+	s3Storage := newFakeStorage(t, fake)
+
+	for i := range 5 {
+		fake.putObject("test-bucket", s3Storage.objName(fmt.Sprintf("certificates/example%d.com.crt", i)), []byte("cert"), time.Now())
+	}
+
+	// The first page is returned, the listing then fails.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("continuation-token") != "" {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return true
+		}
+		return false
+	})
+	keys, err := s3Storage.List(ctx, "", true)
+	if !errors.Is(err, ErrListFailed) {
+		t.Errorf("Expected ErrListFailed, got %v", err)
+	}
+	if keys != nil {
+		t.Errorf("Expected no partial result, got %v", keys)
+	}
+
+	// A listing cut short by the context fails as well.
+	fake.setIntercept(nil)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s3Storage.List(canceled, "", true); !errors.Is(err, ErrListFailed) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected ErrListFailed for a canceled listing, got %v", err)
+	}
+}
+
+func TestListPrefixAndRecursive(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	for _, key := range []string{
+		"acme/acme/users/default/default.json",
+		"certificates/acme/example.com/example.com.crt",
+		"certificates/acme/example.com/example.com.key",
+		"certificates/acme/example.org/example.org.crt",
+		"certificates-old/acme/example.com/example.com.crt",
+	} {
+		fake.putObject("test-bucket", s3Storage.objName(key), []byte("data"), time.Now())
+	}
+
+	tests := []struct {
+		prefix    string
+		recursive bool
+		expected  []string
+	}{
+		{prefix: "", recursive: false, expected: []string{"acme", "certificates", "certificates-old"}},
+		{prefix: "certificates", recursive: false, expected: []string{"certificates/acme"}},
+		{prefix: "certificates/acme", recursive: false, expected: []string{"certificates/acme/example.com", "certificates/acme/example.org"}},
+		{prefix: "certificates/acme/", recursive: false, expected: []string{"certificates/acme/example.com", "certificates/acme/example.org"}},
+		{prefix: "certificates/acme/example.com", recursive: false, expected: []string{
+			"certificates/acme/example.com/example.com.crt",
+			"certificates/acme/example.com/example.com.key",
+		}},
+		{prefix: "certificates", recursive: true, expected: []string{
+			"certificates/acme/example.com/example.com.crt",
+			"certificates/acme/example.com/example.com.key",
+			"certificates/acme/example.org/example.org.crt",
+		}},
+		{prefix: "missing", recursive: true, expected: nil},
+	}
+	for _, tt := range tests {
+		keys, err := s3Storage.List(ctx, tt.prefix, tt.recursive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(keys)
+		if !slices.Equal(keys, tt.expected) {
+			t.Errorf("List(%q, %v): expected %v, got %v", tt.prefix, tt.recursive, tt.expected, keys)
+		}
+	}
+}
+
+func TestUseIAMRole(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+
+	var requests atomic.Int32
+	var fail atomic.Bool
+	creds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"AccessKeyId":"role","SecretAccessKey":"role","Token":"token","Expiration":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer creds.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", creds.URL)
+
+	tests := []struct {
+		name      string
+		storage   *S3
+		fail      bool
+		expectIAM bool
+		expectErr bool
+	}{
+		{name: "explicit", storage: &S3{UseIAMRole: true, AccessKey: "ignored", SecretKey: "ignored"}, expectIAM: true},
+		{name: "blank keys", storage: &S3{}, expectIAM: true},
+		{name: "static keys", storage: &S3{AccessKey: "test", SecretKey: "test"}, fail: true},
+		{name: "unreachable", storage: &S3{UseIAMRole: true}, fail: true, expectIAM: true, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+			defer cancel()
+
+			requests.Store(0)
+			fail.Store(tt.fail)
+			s3Storage := tt.storage
+			s3Storage.Host = fake.host()
+			s3Storage.Bucket = "test-bucket"
+			s3Storage.InsecureHosts = []string{"127.0.0.1"}
+
+			err := s3Storage.Provision(ctx)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Expected error %v, got %v", tt.expectErr, err)
+			}
+			if queried := requests.Load() > 0; queried != tt.expectIAM {
+				t.Errorf("Expected credentials endpoint to be queried: %v, got %v", tt.expectIAM, queried)
+			}
+			if err != nil {
+				return
+			}
+			v, err := s3Storage.Client.GetCreds()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := s3Storage.AccessKey
+			if tt.expectIAM {
+				expected = "role"
+			}
+			if v.AccessKeyID != expected {
+				t.Errorf("Expected access key %q, got %q", expected, v.AccessKeyID)
+			}
+		})
+	}
+}
+
+func TestProfileCredentials(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	file := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(file, []byte(`[default]
+aws_access_key_id = default-key
+aws_secret_access_key = default-secret
+
+[dev]
+aws_access_key_id = dev-key
+aws_secret_access_key = dev-secret
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_PROFILE", "")
+
+	tests := []struct {
+		profile   string
+		expected  string
+		expectErr bool
+	}{
+		{profile: "dev", expected: "dev-key"},
+		{profile: "", expected: "default-key"},
+		{profile: "missing", expectErr: true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+		s3Storage := &S3{
+			Host:            fake.host(),
+			Bucket:          "test-bucket",
+			AccessKey:       "ignored",
+			SecretKey:       "ignored",
+			Profile:         tt.profile,
+			CredentialsFile: file,
+			InsecureHosts:   []string{"127.0.0.1"},
+		}
+		err := s3Storage.Provision(ctx)
+		cancel()
+		if tt.expectErr {
+			if err == nil || !strings.Contains(err.Error(), tt.profile) {
+				t.Errorf("%q: expected error naming the profile, got %v", tt.profile, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := s3Storage.Client.GetCreds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.AccessKeyID != tt.expected {
+			t.Errorf("%q: expected access key %q, got %q", tt.profile, tt.expected, v.AccessKeyID)
+		}
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	// STS tokens can be well over a kilobyte long.
+	token := strings.Repeat("FwoGZXIvYXdzE", 100)
+	d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+		host %s
+		bucket test-bucket
+		access_key ASIATEST
+		secret_key test
+		session_token %s
+		insecure_hosts 127.0.0.1
+	}`, fake.host(), token))
+	s3Storage := new(S3)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if s3Storage.SessionToken != token {
+		t.Fatalf("Expected session token of %d bytes, got %d", len(token), len(s3Storage.SessionToken))
+	}
+	if err := s3Storage.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent atomic.Value
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		sent.Store(r.Header.Get("X-Amz-Security-Token"))
+		return false
+	})
+	if err := s3Storage.Store(t.Context(), "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sent.Load().(string); got != token {
+		t.Errorf("Expected session token to be sent with requests, got %q", got)
+	}
+}
+
+func TestConcurrentStore(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		fake := newFakeS3(t, "test-bucket")
+		core, logs := observer.New(zap.WarnLevel)
+		s3Storage := newFakeStorage(t, fake)
+		s3Storage.Logger = zap.New(core)
+		s3Storage.DetectConcurrentStore = true
+		s3Storage.RejectConcurrentStore = reject
+
+		key := "certificates/example.com/example.com.crt"
+		if err := s3Storage.Store(t.Context(), key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Hold the first two writes until both have read the current ETag.
+		var puts atomic.Int32
+		both := make(chan struct{})
+		fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodPut {
+				switch puts.Add(1) {
+				case 1:
+					select {
+					case <-both:
+					case <-time.After(time.Second):
+					}
+				case 2:
+					close(both)
+				}
+			}
+			return false
+		})
+
+		errs := make(chan error, 2)
+		for _, value := range []string{"first", "second"} {
+			go func() {
+				errs <- s3Storage.Store(t.Context(), key, []byte(value))
+			}()
+		}
+		var conflicts int
+		for range 2 {
+			err := <-errs
+			if errors.Is(err, ErrStoreConflict) {
+				conflicts++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if reject && conflicts != 1 {
+			t.Errorf("Expected exactly one store to fail with ErrStoreConflict, got %d", conflicts)
+		}
+		if !reject {
+			if conflicts != 0 {
+				t.Errorf("Expected both stores to succeed, got %d conflicts", conflicts)
+			}
+			if logs.FilterMessage("concurrent store detected, overwriting").Len() != 1 {
+				t.Error("Expected the concurrent store to be logged")
+			}
+		}
+		data, err := s3Storage.Load(t.Context(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "first" && string(data) != "second" {
+			t.Errorf("Expected one of the concurrent values, got %q", data)
+		}
+	}
+}
+
+func TestStoreRetriedConditionalWrite(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.RejectConcurrentStore = true
+	s3Storage.MaxRetries = 2
+
+	key := "certificates/example.com/example.com.crt"
+	if err := s3Storage.Store(t.Context(), key, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply the first write but lose its response, so the retry fails its
+	// precondition against the value it wrote itself.
+	var puts atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut || puts.Add(1) != 1 {
+			return false
+		}
+		fake.putObject("test-bucket", "test/"+key, []byte("new"), time.Now())
+		writeFakeError(w, http.StatusInternalServerError, "InternalError", "response lost")
+		return true
+	})
+
+	if err := s3Storage.Store(t.Context(), key, []byte("new")); err != nil {
+		t.Fatalf("Expected the retried store to succeed, got %v", err)
+	}
+	if puts.Load() < 2 {
+		t.Fatalf("Expected the store to be retried, got %d writes", puts.Load())
+	}
+
+	// A real conflict is still reported.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && r.Header.Get("If-Match") != "" {
+			fake.putObject("test-bucket", "test/"+key, []byte("other"), time.Now())
+		}
+		return false
+	})
+	if err := s3Storage.Store(t.Context(), key, []byte("mine")); !errors.Is(err, ErrStoreConflict) {
+		t.Errorf("Expected ErrStoreConflict, got %v", err)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.region = "eu-central-1"
+
+	var lookups atomic.Int32
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Has("location") {
+			lookups.Add(1)
+		}
+		return false
+	})
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+	d := caddyfile.NewTestDispenser(fmt.Sprintf(`s3 {
+		host %s
+		bucket test-bucket
+		region eu-central-1
+		access_key test
+		secret_key test
+		insecure true
+		create_bucket provision
+	}`, fake.host()))
+	s3Storage := new(S3)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s3Storage.Load(ctx, "test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test-data" {
+		t.Errorf("Expected test-data, got %s", data)
+	}
+	if n := lookups.Load(); n != 0 {
+		t.Errorf("Expected no bucket location lookups with a configured region, got %d", n)
+	}
+
+	s3Storage.Region = "us-west-2"
+	client, err := s3Storage.newClient(credentials.NewStaticV4("test", "test", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Storage.Client = client
+	if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err == nil {
+		t.Error("Expected requests signed for another region to fail")
+	}
+}
+
+func TestOperationLogging(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	core, logs := observer.New(zap.DebugLevel)
+	s3Storage.Logger = zap.New(core)
+
+	if err := s3Storage.Store(ctx, "test-key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, "test-key"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterLevelExact(zap.InfoLevel).Len() != 0 {
+		t.Errorf("Expected no info messages for individual operations, got %v", logs.FilterLevelExact(zap.InfoLevel).All())
+	}
+	entries := logs.FilterMessage("storing object").All()
+	if len(entries) != 1 || entries[0].Level != zap.DebugLevel {
+		t.Fatalf("Expected one debug message for the store, got %v", entries)
+	}
+	if fields := entries[0].ContextMap(); fields["key"] != s3Storage.objName("test-key") || fields["bytes"] != int64(4) {
+		t.Errorf("Expected key and size fields, got %v", fields)
+	}
+
+	cctx, cancel := caddy.NewContext(caddy.Context{Context: ctx})
+	defer cancel()
+	newStorage := func(level string) *S3 {
+		return &S3{
+			Host:          fake.host(),
+			Bucket:        "test-bucket",
+			AccessKey:     "test",
+			SecretKey:     "test",
+			InsecureHosts: []string{"127.0.0.1"},
+			LogLevel:      level,
+		}
+	}
+	quiet := newStorage("warn")
+	if err := quiet.Provision(cctx); err != nil {
+		t.Fatal(err)
+	}
+	if quiet.Logger.Core().Enabled(zap.InfoLevel) || !quiet.Logger.Core().Enabled(zap.WarnLevel) {
+		t.Error("Expected log_level warn to leave out info messages")
+	}
+	if err := newStorage("loud").Provision(cctx); err == nil {
+		t.Error("Expected error for invalid log_level")
+	}
+}
@@ -0,0 +1,110 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+// selfTestLockKey is the key locked by SelfTestLocking.
+const selfTestLockKey = ".lock-self-test"
+
+// ErrSelfTestFailed is returned by SelfTestLocking if the locks written by
+// two instances do not exclude each other.
+var ErrSelfTestFailed = errors.New("lock self test failed")
+
+// SelfTestLocking verifies that locking works against the configured
+// backend. It creates a second instance with its own client against the
+// same bucket and checks that the second instance cannot acquire a lock
+// held by this one, and that it can once the lock is released. Every step
+// is logged; the returned error names the steps that failed.
+func (s3 *S3) SelfTestLocking(ctx context.Context) error {
+	peer, err := s3.selfTestPeer()
+	if err != nil {
+		return fmt.Errorf("%w: creating second instance: %v", ErrSelfTestFailed, err)
+	}
+
+	var errs []error
+	step := func(name string, err error) bool {
+		if err != nil {
+			s3.Logger.Warn("lock self test step failed", zap.String("step", name), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%w: %s: %v", ErrSelfTestFailed, name, err))
+			return false
+		}
+		s3.Logger.Info("lock self test step passed", zap.String("step", name))
+		return true
+	}
+
+	if !step("first instance acquires lock", s3.Lock(ctx, selfTestLockKey)) {
+		return errors.Join(errs...)
+	}
+
+	// The second instance must give up instead of taking over the lock,
+	// either right away or once it stops waiting for it.
+	waitCtx, cancel := context.WithTimeout(ctx, 2*s3.lockPollInterval())
+	err = peer.Lock(waitCtx, selfTestLockKey)
+	cancel()
+	switch {
+	case err == nil:
+		step("second instance is excluded", errors.New("acquired the held lock"))
+		peer.Unlock(ctx, selfTestLockKey)
+	case errors.Is(err, errLockHeld) || errors.Is(err, context.DeadlineExceeded):
+		step("second instance is excluded", nil)
+	default:
+		step("second instance is excluded", err)
+	}
+
+	if !step("first instance releases lock", s3.Unlock(ctx, selfTestLockKey)) {
+		return errors.Join(errs...)
+	}
+	if step("second instance acquires released lock", peer.Lock(ctx, selfTestLockKey)) {
+		step("second instance releases lock", peer.Unlock(ctx, selfTestLockKey))
+	}
+	return errors.Join(errs...)
+}
+
+// selfTestPeer returns a second instance with the configuration of s3 but
+// its own lock owner ID and separate clients, as if it ran in another
+// process.
+func (s3 *S3) selfTestPeer() (*S3, error) {
+	// Round-tripping the configuration is how Caddy builds instances, and
+	// leaves the unexported state such as held locks behind.
+	cfg, err := json.Marshal(s3)
+	if err != nil {
+		return nil, err
+	}
+	peer := new(S3)
+	if err := json.Unmarshal(cfg, peer); err != nil {
+		return nil, err
+	}
+	peer.Logger = s3.Logger.Named("self-test-peer")
+	peer.LockOwnerID = defaultLockOwnerID()
+	peer.iowrap = s3.iowrap
+	peer.configIO = s3.configIO
+
+	if peer.Client, err = s3.cloneClient(s3.Client); err != nil {
+		return nil, err
+	}
+	if s3.lockCli != nil {
+		if peer.lockCli, err = s3.cloneClient(s3.lockCli); err != nil {
+			return nil, err
+		}
+	}
+	return peer, nil
+}
+
+// cloneClient returns a new client for the endpoint of cli using its
+// current credentials.
+func (s3 *S3) cloneClient(cli *minio.Client) (*minio.Client, error) {
+	v, err := cli.GetCreds()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := cli.EndpointURL()
+	return s3.newClientFor(endpoint.Host, endpoint.Scheme == "https", credentials.NewStaticV4(v.AccessKeyID, v.SecretAccessKey, v.SessionToken))
+}
@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTestLocking(t *testing.T) {
+	defer func(interval time.Duration) { LockPollInterval = interval }(LockPollInterval)
+	LockPollInterval = 50 * time.Millisecond
+
+	for _, fair := range []bool{false, true} {
+		fake := newFakeS3(t, "test-bucket")
+		// The peer talks to the endpoint of the client, even though Host
+		// alone would be reached over TLS.
+		s3Storage := newFakeStorage(t, fake)
+		s3Storage.FairLocking = fair
+
+		if err := s3Storage.SelfTestLocking(t.Context()); err != nil {
+			t.Errorf("fair locking %v: expected self test to pass, got %v", fair, err)
+		}
+		if keys := fake.keys("test-bucket"); len(keys) != 0 {
+			t.Errorf("fair locking %v: expected no leftover objects, got %v", fair, keys)
+		}
+	}
+}
+
+func TestSelfTestLockingBrokenBackend(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.InsecureHosts = []string{"127.0.0.1"}
+
+	// A backend that loses lock files lets both instances acquire the lock.
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, ".lock") {
+			w.WriteHeader(http.StatusOK)
+			return true
+		}
+		return false
+	})
+
+	err := s3Storage.SelfTestLocking(t.Context())
+	if !errors.Is(err, ErrSelfTestFailed) {
+		t.Errorf("Expected ErrSelfTestFailed, got %v", err)
+	}
+}
+
+func TestSelfTestPeer(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.InsecureHosts = []string{"127.0.0.1"}
+	s3Storage.LockOwnerID = "first"
+
+	peer, err := s3Storage.selfTestPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.LockOwnerID == "" || peer.LockOwnerID == s3Storage.LockOwnerID {
+		t.Errorf("Expected the second instance to have its own owner ID, got %q", peer.LockOwnerID)
+	}
+}
+
+func TestSelfTestLockingReadError(t *testing.T) {
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.InsecureHosts = []string{"127.0.0.1"}
+
+	// Reading a held lock fails, which must not count as being excluded.
+	lockName := s3Storage.objLockName(selfTestLockKey)
+	fake.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, lockName) && fake.object("test-bucket", lockName) != nil {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+			return true
+		}
+		return false
+	})
+
+	err := s3Storage.SelfTestLocking(t.Context())
+	if !errors.Is(err, ErrSelfTestFailed) || !strings.Contains(err.Error(), "second instance is excluded") {
+		t.Errorf("Expected the exclusion step to fail, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"fmt"
+	"sync"
+)
+
+// definitions holds the storages provisioned with a name, so that other
+// storages can refer to them with use.
+var (
+	definitionsMu sync.RWMutex
+	definitions   = map[string]*S3{}
+)
+
+// register makes the configuration of s3 available under its name.
+func (s3 *S3) register() {
+	if s3.Name == "" {
+		return
+	}
+
+	definitionsMu.Lock()
+	defer definitionsMu.Unlock()
+	definitions[s3.Name] = s3
+}
+
+// unregister removes s3 from the definitions unless it has already been
+// replaced by a newer storage with the same name, e.g. after a reload.
+func (s3 *S3) unregister() {
+	if s3.Name == "" {
+		return
+	}
+
+	definitionsMu.Lock()
+	defer definitionsMu.Unlock()
+	if definitions[s3.Name] == s3 {
+		delete(definitions, s3.Name)
+	}
+}
+
+// resolveShared fills the connection settings left empty in s3 from the
+// storage named in Use.
+func (s3 *S3) resolveShared() error {
+	if s3.Use == "" {
+		return nil
+	}
+
+	definitionsMu.RLock()
+	def, ok := definitions[s3.Use]
+	definitionsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("shared storage %q is not defined", s3.Use)
+	}
+
+	for _, f := range []struct{ dst, src *string }{
+		{&s3.Host, &def.Host},
+		{&s3.FallbackHost, &def.FallbackHost},
+		{&s3.Bucket, &def.Bucket},
+		{&s3.Region, &def.Region},
+		{&s3.BucketLookup, &def.BucketLookup},
+		{&s3.Prefix, &def.Prefix},
+		{&s3.AccessKey, &def.AccessKey},
+		{&s3.SecretKey, &def.SecretKey},
+		{&s3.SessionToken, &def.SessionToken},
+		{&s3.Profile, &def.Profile},
+		{&s3.CredentialsFile, &def.CredentialsFile},
+		{&s3.LockAccessKey, &def.LockAccessKey},
+		{&s3.LockSecretKey, &def.LockSecretKey},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+	s3.UseIAMRole = s3.UseIAMRole || def.UseIAMRole
+	s3.SkipBucketCheck = s3.SkipBucketCheck || def.SkipBucketCheck
+	return nil
+}
@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSharedDefinition(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	shared := &S3{
+		Name:      "shared",
+		Host:      "s3.example.com",
+		Bucket:    "shared-bucket",
+		Prefix:    "shared-prefix",
+		AccessKey: "access",
+		SecretKey: "secret",
+		// The host is not reachable.
+		SkipBucketCheck: true,
+	}
+	err := shared.Provision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &S3{Use: "shared"}
+	second := &S3{Use: "shared", Prefix: "own-prefix"}
+	for _, s3Storage := range []*S3{first, second} {
+		err := s3Storage.Provision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s3Storage.Host != shared.Host || s3Storage.Bucket != shared.Bucket || s3Storage.AccessKey != shared.AccessKey {
+			t.Errorf("Expected shared host and bucket, got %s/%s", s3Storage.Host, s3Storage.Bucket)
+		}
+	}
+
+	if first.Prefix != "shared-prefix" {
+		t.Errorf("Expected shared prefix, got %s", first.Prefix)
+	}
+	if second.Prefix != "own-prefix" {
+		t.Errorf("Expected explicit prefix to take precedence, got %s", second.Prefix)
+	}
+
+	err = shared.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&S3{Use: "shared"}).Provision(ctx)
+	if err == nil {
+		t.Error("Expected error when referring to a storage that is no longer defined")
+	}
+}
@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// sseBucketKeyHeader enables an S3 Bucket Key for an object encrypted with
+// SSE-KMS, which reduces the number of requests S3 makes to KMS.
+const sseBucketKeyHeader = "X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"
+
+// validateSSE returns an error for server-side encryption options that
+// have no effect with the current configuration.
+func (s3 *S3) validateSSE() error {
+	switch s3.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return fmt.Errorf("unsupported server_side_encryption %q", s3.ServerSideEncryption)
+	}
+	if s3.ServerSideEncryption != "aws:kms" && (s3.SSEKMSKeyID != "" || s3.SSEKMSBucketKey) {
+		return errors.New("sse_kms_key_id and sse_kms_bucket_key require server_side_encryption aws:kms")
+	}
+	return nil
+}
+
+// serverSideEncryption returns the server-side encryption to request when
+// writing objects, or nil to use the default of the bucket.
+func (s3 *S3) serverSideEncryption() encrypt.ServerSide {
+	if s3.ServerSideEncryption == "AES256" {
+		return encrypt.NewSSE()
+	}
+	if s3.ServerSideEncryption != "aws:kms" {
+		return nil
+	}
+	// NewSSEKMS only fails for an encryption context that cannot be
+	// marshaled.
+	sse, _ := encrypt.NewSSEKMS(s3.SSEKMSKeyID, nil)
+	if s3.SSEKMSBucketKey {
+		return bucketKeySSE{sse}
+	}
+	return sse
+}
+
+// bucketKeySSE adds the bucket key header to an SSE-KMS encryption.
+type bucketKeySSE struct {
+	encrypt.ServerSide
+}
+
+func (sse bucketKeySSE) Marshal(h http.Header) {
+	sse.ServerSide.Marshal(h)
+	h.Set(sseBucketKeyHeader, "true")
+}
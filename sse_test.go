@@ -0,0 +1,106 @@
+package s3
+
+import "testing"
+
+func TestSSEKMSBucketKey(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	s3Storage.ServerSideEncryption = "aws:kms"
+	s3Storage.SSEKMSKeyID = "arn:aws:kms:eu-central-1:123456789012:key/test"
+	s3Storage.SSEKMSBucketKey = true
+	if err := s3Storage.validateSSE(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	obj := fake.object("test-bucket", s3Storage.objName("certificates/example.com/example.com.crt"))
+	if obj == nil {
+		t.Fatal("Expected object to be stored")
+	}
+	if got := obj.header.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+		t.Errorf("Expected SSE-KMS, got %q", got)
+	}
+	if got := obj.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != s3Storage.SSEKMSKeyID {
+		t.Errorf("Expected KMS key %q, got %q", s3Storage.SSEKMSKeyID, got)
+	}
+	if got := obj.header.Get(sseBucketKeyHeader); got != "true" {
+		t.Errorf("Expected bucket key to be enabled, got %q", got)
+	}
+
+	s3Storage.SSEKMSBucketKey = false
+	if err := s3Storage.Store(ctx, "plain", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.object("test-bucket", s3Storage.objName("plain")).header.Get(sseBucketKeyHeader); got != "" {
+		t.Errorf("Expected no bucket key header, got %q", got)
+	}
+}
+
+func TestSSEKMSBucketKeyRequiresSSEKMS(t *testing.T) {
+	s3Storage := &S3{SSEKMSBucketKey: true}
+	if err := s3Storage.validateSSE(); err == nil {
+		t.Error("Expected error for bucket key without SSE-KMS")
+	}
+	s3Storage.ServerSideEncryption = "aws:kms"
+	if err := s3Storage.validateSSE(); err != nil {
+		t.Errorf("Expected bucket key with SSE-KMS to be valid, got %v", err)
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+
+	tests := []struct {
+		sse    string
+		keyID  string
+		header string
+	}{
+		{sse: "AES256", header: "AES256"},
+		{sse: "aws:kms", header: "aws:kms"},
+		{sse: "aws:kms", keyID: "arn:aws:kms:eu-central-1:123456789012:key/test", header: "aws:kms"},
+	}
+	for _, tt := range tests {
+		s3Storage := newFakeStorage(t, fake)
+		// Server-side encryption is combined with client-side encryption.
+		sb := &SecretBoxIO{}
+		copy(sb.SecretKey[:], "12345678123456781234567812345678")
+		s3Storage.iowrap = sb
+		s3Storage.ServerSideEncryption = tt.sse
+		s3Storage.SSEKMSKeyID = tt.keyID
+		if err := s3Storage.validateSSE(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s3Storage.Store(ctx, "sse-key", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		obj := fake.object("test-bucket", s3Storage.objName("sse-key"))
+		if got := obj.header.Get("X-Amz-Server-Side-Encryption"); got != tt.header {
+			t.Errorf("%s: expected encryption %q, got %q", tt.sse, tt.header, got)
+		}
+		if got := obj.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != tt.keyID {
+			t.Errorf("%s: expected KMS key %q, got %q", tt.sse, tt.keyID, got)
+		}
+		if string(obj.data) == "data" {
+			t.Errorf("%s: expected value to be encrypted client-side as well", tt.sse)
+		}
+		if data, err := s3Storage.Load(ctx, "sse-key"); err != nil || string(data) != "data" {
+			t.Errorf("%s: expected to load the value, got %q, %v", tt.sse, data, err)
+		}
+	}
+
+	for _, s3Storage := range []*S3{
+		{ServerSideEncryption: "aws:kms:dsse"},
+		{ServerSideEncryption: "AES256", SSEKMSKeyID: "key"},
+		{ServerSideEncryption: "AES256", SSEKMSBucketKey: true},
+		{SSEKMSKeyID: "key"},
+	} {
+		if err := s3Storage.validateSSE(); err == nil {
+			t.Errorf("Expected error for %+v", s3Storage)
+		}
+	}
+}
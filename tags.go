@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// objectTags returns the tags of the object for key: the configured Tags,
+// the "type" tag if TagByType is set and, for lock files, the LockTags.
+func (s3 *S3) objectTags(key string) map[string]string {
+	t := maps.Clone(s3.Tags)
+	if t == nil {
+		t = map[string]string{}
+	}
+	if s3.TagByType {
+		t["type"] = keyType(key)
+	}
+	if keyType(key) == "lock" {
+		maps.Copy(t, s3.LockTags)
+	}
+	if len(t) == 0 {
+		return nil
+	}
+	return t
+}
+
+// validateTags checks that the tags written to objects are accepted by S3,
+// which allows at most 10 tags per object. Lock files get the most tags,
+// so checking theirs covers all objects.
+func (s3 *S3) validateTags() error {
+	if _, err := tags.MapToObjectTags(s3.objectTags(".lock")); err != nil {
+		return fmt.Errorf("invalid tags: %w", err)
+	}
+	return nil
+}
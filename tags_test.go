@@ -0,0 +1,70 @@
+package s3
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/minio/minio-go/v7"
+)
+
+func TestTags(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	d := caddyfile.NewTestDispenser(`s3 {
+		tags {
+			team platform
+			cost-center 1234
+		}
+		lock_tags {
+			expire 1d
+		}
+	}`)
+	if err := s3Storage.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3Storage.validateTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s3Storage.Store(ctx, "certificates/example.com/example.com.crt", []byte("cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := s3Storage.Client.GetObjectTagging(ctx, s3Storage.Bucket, s3Storage.objName("certificates/example.com/example.com.crt"), minio.GetObjectTaggingOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"team": "platform", "cost-center": "1234"}
+	if got := tags.ToMap(); !maps.Equal(got, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, got)
+	}
+
+	if err := s3Storage.Lock(ctx, "certificates/example.com"); err != nil {
+		t.Fatal(err)
+	}
+	tags, err = s3Storage.Client.GetObjectTagging(ctx, s3Storage.Bucket, s3Storage.objLockName("certificates/example.com"), minio.GetObjectTaggingOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["expire"] = "1d"
+	if got := tags.ToMap(); !maps.Equal(got, expected) {
+		t.Errorf("Expected lock tags %v, got %v", expected, got)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	s3Storage := &S3{Tags: map[string]string{}}
+	for i := range 10 {
+		s3Storage.Tags[string(rune('a'+i))] = "value"
+	}
+	if err := s3Storage.validateTags(); err != nil {
+		t.Errorf("Expected 10 tags to be valid, got %v", err)
+	}
+	s3Storage.TagByType = true
+	if err := s3Storage.validateTags(); err == nil {
+		t.Error("Expected error for more than 10 tags")
+	}
+}
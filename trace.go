@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// secretHeaders are masked in client traces.
+var secretHeaders = []string{
+	"authorization",
+	"x-amz-security-token",
+	"x-amz-server-side-encryption-customer-key",
+	"x-amz-copy-source-server-side-encryption-customer-key",
+}
+
+// traceWriter passes the HTTP traces of the minio client line by line to
+// a zap logger at debug level.
+type traceWriter struct {
+	logger *zap.Logger
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (tw *traceWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.buf = append(tw.buf, p...)
+	for {
+		i := bytes.IndexByte(tw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(tw.buf[:i]), "\r")
+		tw.buf = tw.buf[i+1:]
+		if line != "" {
+			tw.logger.Debug("client trace", zap.String("line", maskTraceLine(line)))
+		}
+	}
+	return len(p), nil
+}
+
+// maskTraceLine replaces the values of headers carrying credentials.
+func maskTraceLine(line string) string {
+	name, _, ok := strings.Cut(line, ":")
+	if ok && !strings.Contains(name, " ") {
+		for _, h := range secretHeaders {
+			if strings.EqualFold(name, h) {
+				return name + ": **REDACTED**"
+			}
+		}
+	}
+	return line
+}
+
+// setClientTrace enables tracing of the minio client if ClientTrace is set.
+func (s3 *S3) setClientTrace() {
+	for _, client := range []*minio.Client{s3.Client, s3.lockCli, s3.fallbackCli} {
+		switch {
+		case client == nil:
+		case s3.ClientTrace:
+			client.TraceOn(&traceWriter{logger: s3.Logger})
+		default:
+			client.TraceOff()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClientTrace(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+	core, logs := observer.New(zapcore.DebugLevel)
+	s3Storage.Logger = zap.New(core)
+
+	s3Storage.ClientTrace = true
+	s3Storage.setClientTrace()
+	err := s3Storage.Store(ctx, "test-key", []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traces := logs.FilterMessage("client trace").All()
+	if len(traces) == 0 {
+		t.Fatal("Expected client trace to be logged")
+	}
+	var sawRequest, sawAuth bool
+	for _, entry := range traces {
+		line := entry.ContextMap()["line"].(string)
+		if strings.HasPrefix(line, "PUT ") {
+			sawRequest = true
+		}
+		if strings.HasPrefix(strings.ToLower(line), "authorization:") {
+			sawAuth = true
+			if line != "Authorization: **REDACTED**" {
+				t.Errorf("Expected authorization header to be masked, got %q", line)
+			}
+		}
+		if strings.Contains(line, "Signature=") || strings.Contains(line, "Credential=") {
+			t.Errorf("Expected no credentials in trace, got %q", line)
+		}
+	}
+	if !sawRequest || !sawAuth {
+		t.Errorf("Expected request line and masked authorization header in trace")
+	}
+
+	s3Storage.ClientTrace = false
+	s3Storage.setClientTrace()
+	n := logs.FilterMessage("client trace").Len()
+	err = s3Storage.Store(ctx, "test-key", []byte("test-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterMessage("client trace").Len() != n {
+		t.Error("Expected no client trace after disabling it")
+	}
+}
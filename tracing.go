@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans of this package.
+const tracerName = "github.com/pteich/certmagic-s3"
+
+// startSpan starts a span for the storage operation op on key with the
+// globally registered tracer provider, which does nothing unless one has
+// been configured. Only the length of the key is recorded, since keys
+// contain domain names.
+func (s3 *S3) startSpan(ctx context.Context, op, key string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "s3."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("s3.bucket", s3.Bucket),
+			attribute.String("s3.operation", op),
+			attribute.Int("s3.key_length", len(key)),
+		),
+	)
+}
+
+// endSpan ends span, marking it as failed if *err is set.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -0,0 +1,89 @@
+package s3
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingSpan records the parts of a span checked by the tests.
+type recordingSpan struct {
+	noop.Span
+	name   string
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+func (s *recordingSpan) End(...trace.SpanEndOption)          { s.ended = true }
+
+// recordingTracer keeps every span it started.
+type recordingTracer struct {
+	embedded.Tracer
+
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+// recordingProvider hands out the same recordingTracer for every name.
+type recordingProvider struct {
+	embedded.TracerProvider
+	rt *recordingTracer
+}
+
+func (rp recordingProvider) Tracer(string, ...trace.TracerOption) trace.Tracer { return rp.rt }
+
+func (rt *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	span := &recordingSpan{name: name, attrs: map[attribute.Key]attribute.Value{}}
+	for _, kv := range cfg.Attributes() {
+		span.attrs[kv.Key] = kv.Value
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.spans = append(rt.spans, span)
+	return ctx, span
+}
+
+func TestTracing(t *testing.T) {
+	rt := &recordingTracer{}
+	defer func(tp trace.TracerProvider) { otel.SetTracerProvider(tp) }(otel.GetTracerProvider())
+	otel.SetTracerProvider(recordingProvider{rt: rt})
+
+	ctx := t.Context()
+	fake := newFakeS3(t, "test-bucket")
+	s3Storage := newFakeStorage(t, fake)
+
+	if err := s3Storage.Store(ctx, "test-key", []byte("test-data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Storage.Load(ctx, "missing"); err == nil {
+		t.Fatal("Expected error for a missing key")
+	}
+
+	if len(rt.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(rt.spans))
+	}
+	store, load := rt.spans[0], rt.spans[1]
+	if store.name != "s3.store" || !store.ended || store.status != codes.Unset {
+		t.Errorf("Unexpected store span %+v", store)
+	}
+	if got := store.attrs["s3.bucket"].AsString(); got != "test-bucket" {
+		t.Errorf("Expected bucket attribute, got %q", got)
+	}
+	if got := store.attrs["s3.key_length"].AsInt64(); got != int64(len("test-key")) {
+		t.Errorf("Expected key length attribute %d, got %d", len("test-key"), got)
+	}
+	if load.name != "s3.load" || !load.ended || load.status != codes.Error {
+		t.Errorf("Expected failed load span, got %+v", load)
+	}
+}